@@ -1,15 +1,35 @@
 package auth
 
-import "time"
+import (
+	"email_test_app/backend/mail"
+	"time"
+)
+
+// AuthState tracks whether an account's stored credentials still work
+type AuthState string
+
+const (
+	AuthStateActive AuthState = "active"
+	// AuthStateNeedsReauth means the provider rejected the refresh token and
+	// the user has to sign in again
+	AuthStateNeedsReauth AuthState = "needs_reauth"
+	// AuthStateSignedOut means the user logged out and the credentials were
+	// removed; the account's cached mail is kept
+	AuthStateSignedOut AuthState = "signed_out"
+)
 
 type Account struct {
-	Id                  int64  `json:"id"`
-	Email               string `json:"email"`
-	ImapUrl             string `json:"imap_url"`
-	OAuthAccessToken    string `json:"oauth_access_token"`
-	OAuthRefreshToken   string `json:"oauth_refresh_token"`
-	OAuthExpiry         int64  `json:"oauth_expiry"`
-	AppSpecificPassword string `json:"app_specific_password"`
+	Id                  int64     `json:"id"`
+	Email               string    `json:"email"`
+	ImapUrl             string    `json:"imap_url"`
+	OAuthAccessToken    string    `json:"oauth_access_token"`
+	OAuthRefreshToken   string    `json:"oauth_refresh_token"`
+	OAuthExpiry         int64     `json:"oauth_expiry"`
+	AppSpecificPassword string    `json:"app_specific_password"`
+	Provider            string    `json:"provider"`
+	AuthState           AuthState `json:"auth_state"`
+	// Connection holds the IMAP connection security settings
+	Connection mail.ConnectionSettings `json:"connection"`
 }
 
 func (a *Account) IsOAuthExpired() bool {
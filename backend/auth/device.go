@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DeviceLogin is a device authorization grant (RFC 8628) waiting for the user
+// to enter UserCode at VerificationURI on another device
+type DeviceLogin struct {
+	UserCode                string    `json:"user_code"`
+	VerificationURI         string    `json:"verification_uri"`
+	VerificationURIComplete string    `json:"verification_uri_complete"`
+	ExpiresAt               time.Time `json:"expires_at"`
+
+	config   *oauth2.Config
+	response *oauth2.DeviceAuthResponse
+}
+
+// SupportsDeviceLogin reports whether a provider can sign in with a device code
+func SupportsDeviceLogin(p Provider) bool {
+	return p.OAuthConfig().Endpoint.DeviceAuthURL != ""
+}
+
+// StartDeviceLogin requests a device and user code from the provider's device
+// authorization endpoint
+func StartDeviceLogin(ctx context.Context, config *oauth2.Config) (*DeviceLogin, error) {
+	if config.Endpoint.DeviceAuthURL == "" {
+		return nil, fmt.Errorf("provider does not support device login")
+	}
+
+	response, err := config.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+	if err != nil {
+		return nil, TokenError(fmt.Errorf("error requesting device code: %w", err))
+	}
+
+	return &DeviceLogin{
+		UserCode:                response.UserCode,
+		VerificationURI:         response.VerificationURI,
+		VerificationURIComplete: response.VerificationURIComplete,
+		ExpiresAt:               response.Expiry,
+		config:                  config,
+		response:                response,
+	}, nil
+}
+
+// Wait polls the token endpoint until the user approves or denies the login,
+// the code expires or ctx is done. The polling interval comes from the
+// provider and grows whenever it asks the client to slow down.
+func (d *DeviceLogin) Wait(ctx context.Context) (*oauth2.Token, error) {
+	token, err := d.config.DeviceAccessToken(ctx, d.response)
+	if err != nil {
+		return nil, TokenError(fmt.Errorf("error waiting for device login: %w", err))
+	}
+	return token, nil
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"email_test_app/backend/mail"
+	"testing"
+	"time"
+)
+
+const deviceCodeGrant = "urn:ietf:params:oauth:grant-type:device_code"
+
+// waitForDevice starts a device login against s and waits for it
+func waitForDevice(t *testing.T, s *tokenServer) (string, error) {
+	t.Helper()
+
+	login, err := StartDeviceLogin(context.Background(), s.config())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.UserCode != "ABCD-EFGH" || login.VerificationURI != s.URL+"/verify" {
+		t.Fatalf("got user code %q at %q, want ABCD-EFGH at %s/verify", login.UserCode, login.VerificationURI, s.URL)
+	}
+
+	token, err := login.Wait(context.Background())
+	if err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func TestDeviceLogin(t *testing.T) {
+	t.Run("authorization_pending", func(t *testing.T) {
+		t.Parallel()
+		s := newTokenServer(t,
+			tokenResponse{errorCode: "authorization_pending"},
+			tokenResponse{errorCode: "authorization_pending"},
+			tokenResponse{accessToken: "device-access-token"},
+		)
+
+		accessToken, err := waitForDevice(t, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accessToken != "device-access-token" {
+			t.Errorf("got access token %q, want device-access-token", accessToken)
+		}
+
+		requests := s.tokenRequests()
+		if len(requests) != 3 {
+			t.Fatalf("polled %d times, want 3", len(requests))
+		}
+		for _, r := range requests {
+			if r.grantType != deviceCodeGrant {
+				t.Errorf("got grant type %q, want %q", r.grantType, deviceCodeGrant)
+			}
+		}
+	})
+
+	t.Run("slow_down", func(t *testing.T) {
+		if testing.Short() {
+			t.Skip("slowing down adds 5 seconds between polls")
+		}
+		t.Parallel()
+		s := newTokenServer(t,
+			tokenResponse{errorCode: "slow_down"},
+			tokenResponse{accessToken: "device-access-token"},
+		)
+
+		if _, err := waitForDevice(t, s); err != nil {
+			t.Fatal(err)
+		}
+
+		// RFC 8628 section 3.5: the interval grows by 5 seconds
+		requests := s.tokenRequests()
+		if len(requests) != 2 {
+			t.Fatalf("polled %d times, want 2", len(requests))
+		}
+		if gap := requests[1].at.Sub(requests[0].at); gap < 5*time.Second {
+			t.Errorf("polled again after %v, want at least 5s after slow_down", gap)
+		}
+	})
+
+	t.Run("access_denied", func(t *testing.T) {
+		t.Parallel()
+		s := newTokenServer(t,
+			tokenResponse{errorCode: "authorization_pending"},
+			tokenResponse{errorCode: "access_denied"},
+		)
+
+		_, err := waitForDevice(t, s)
+		assertErrorCode(t, err, mail.ErrorAuthFailed)
+		if len(s.tokenRequests()) != 2 {
+			t.Errorf("polled %d times, want 2", len(s.tokenRequests()))
+		}
+	})
+
+	t.Run("expired_token", func(t *testing.T) {
+		t.Parallel()
+		s := newTokenServer(t, tokenResponse{errorCode: "expired_token"})
+
+		_, err := waitForDevice(t, s)
+		assertErrorCode(t, err, mail.ErrorAuthFailed)
+	})
+}
@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"email_test_app/backend/mail"
+	"errors"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+// TokenError classifies an error from a provider's OAuth endpoints, such as a
+// failed code exchange, token refresh or device login, into a *mail.Error
+func TokenError(err error) error {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return mail.ClassifyError(err)
+	}
+
+	// error codes are from RFC 6749 section 5.2 and RFC 8628 section 3.5
+	code := mail.ErrorServerRefused
+	switch retrieveErr.ErrorCode {
+	case "invalid_grant", "invalid_client", "unauthorized_client", "access_denied", "expired_token":
+		code = mail.ErrorAuthFailed
+	case "slow_down", "temporarily_unavailable":
+		code = mail.ErrorRateLimited
+	}
+	if retrieveErr.Response != nil && retrieveErr.Response.StatusCode == http.StatusTooManyRequests {
+		code = mail.ErrorRateLimited
+	}
+
+	return mail.NewError(code, err)
+}
+
+// NeedsReauth reports whether err means the provider rejected the refresh
+// token, so the account can't be used until the user signs in again. Other
+// failures, such as the provider being unreachable, may pass on retrying.
+func NeedsReauth(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"email_test_app/backend/mail"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenResponse is one answer of the fake token endpoint: a token, or an OAuth
+// error if errorCode is set
+type tokenResponse struct {
+	errorCode   string
+	status      int
+	accessToken string
+}
+
+// tokenServer is a fake provider whose token endpoint gives the queued
+// responses in order, repeating the last one
+type tokenServer struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	responses []tokenResponse
+	// requests holds the grant type of each token request and when it came
+	requests []tokenRequest
+}
+
+type tokenRequest struct {
+	grantType string
+	at        time.Time
+}
+
+func newTokenServer(t *testing.T, responses ...tokenResponse) *tokenServer {
+	s := &tokenServer{responses: responses}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"device_code":      "device-code",
+			"user_code":        "ABCD-EFGH",
+			"verification_uri": s.URL + "/verify",
+			"expires_in":       60,
+			"interval":         1,
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		s.mutex.Lock()
+		s.requests = append(s.requests, tokenRequest{grantType: r.PostForm.Get("grant_type"), at: time.Now()})
+		response := s.responses[0]
+		if len(s.responses) > 1 {
+			s.responses = s.responses[1:]
+		}
+		s.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if response.errorCode != "" {
+			status := response.status
+			if status == 0 {
+				status = http.StatusBadRequest
+			}
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{"error": response.errorCode})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  response.accessToken,
+			"token_type":    "Bearer",
+			"refresh_token": "refresh-token",
+			"expires_in":    3600,
+		})
+	})
+
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *tokenServer) config() *oauth2.Config {
+	return &oauth2.Config{
+		ClientID: "client-id",
+		Endpoint: oauth2.Endpoint{
+			DeviceAuthURL: s.URL + "/device",
+			TokenURL:      s.URL + "/token",
+			AuthStyle:     oauth2.AuthStyleInParams,
+		},
+	}
+}
+
+func (s *tokenServer) tokenRequests() []tokenRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]tokenRequest(nil), s.requests...)
+}
+
+// assertErrorCode checks that err is a *mail.Error with the given code
+func assertErrorCode(t *testing.T, err error, code mail.ErrorCode) {
+	t.Helper()
+
+	var mailErr *mail.Error
+	if !errors.As(err, &mailErr) {
+		t.Fatalf("got %T %v, want a *mail.Error", err, err)
+	}
+	if mailErr.Code != code {
+		t.Fatalf("got code %q (%v), want %q", mailErr.Code, err, code)
+	}
+}
+
+// refreshError refreshes an expired token against s and classifies the error
+// with TokenError. accountToken itself is tested in wails_app.
+func refreshError(s *tokenServer) error {
+	expired := &oauth2.Token{
+		AccessToken:  "old-access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Minute),
+	}
+	_, err := s.config().TokenSource(context.Background(), expired).Token()
+	if err != nil {
+		return TokenError(err)
+	}
+	return nil
+}
+
+func TestTokenError(t *testing.T) {
+	t.Run("invalid_grant", func(t *testing.T) {
+		s := newTokenServer(t, tokenResponse{errorCode: "invalid_grant"})
+
+		err := refreshError(s)
+		assertErrorCode(t, err, mail.ErrorAuthFailed)
+		if !NeedsReauth(err) {
+			t.Errorf("NeedsReauth(%v) = false, want true", err)
+		}
+	})
+
+	t.Run("temporarily_unavailable", func(t *testing.T) {
+		s := newTokenServer(t, tokenResponse{errorCode: "temporarily_unavailable", status: http.StatusServiceUnavailable})
+
+		err := refreshError(s)
+		assertErrorCode(t, err, mail.ErrorRateLimited)
+		if NeedsReauth(err) {
+			t.Errorf("NeedsReauth(%v) = true, want false", err)
+		}
+	})
+
+	t.Run("too many requests", func(t *testing.T) {
+		s := newTokenServer(t, tokenResponse{errorCode: "invalid_request", status: http.StatusTooManyRequests})
+
+		err := refreshError(s)
+		assertErrorCode(t, err, mail.ErrorRateLimited)
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		s := newTokenServer(t, tokenResponse{accessToken: "new-access-token"})
+		s.Close()
+
+		err := refreshError(s)
+		assertErrorCode(t, err, mail.ErrorNetwork)
+		if NeedsReauth(err) {
+			t.Errorf("NeedsReauth(%v) = true, want false", err)
+		}
+	})
+}
@@ -8,24 +8,35 @@ import (
 	"golang.org/x/oauth2/google"
 )
 
-var GmailOAuthConfig *oauth2.Config
+const GmailProviderName = "Gmail"
 
 const GmailImapUrl = "imap.gmail.com:993"
+const GmailSmtpUrl = "smtp.gmail.com:587"
 
 func init() {
 	// Load environment variables
 	godotenv.Load()
 
-	GmailOAuthConfig = &oauth2.Config{
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		RedirectURL:  "http://localhost:9498/oauth2callback",
-		Scopes: []string{
-			"https://mail.google.com/",
-			"https://www.googleapis.com/auth/userinfo.email",
-			"https://www.googleapis.com/auth/userinfo.profile",
-			"openid",
+	// Google's device flow doesn't allow the https://mail.google.com/ scope
+	endpoint := google.Endpoint
+	endpoint.DeviceAuthURL = ""
+
+	RegisterProvider(&OAuthProvider{
+		ProviderName: GmailProviderName,
+		Config: &oauth2.Config{
+			ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
+			ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
+			Scopes: []string{
+				"https://mail.google.com/",
+				"https://www.googleapis.com/auth/userinfo.email",
+				"https://www.googleapis.com/auth/userinfo.profile",
+				"openid",
+			},
+			Endpoint: endpoint,
 		},
-		Endpoint: google.Endpoint,
-	}
+		Imap:          GmailImapUrl,
+		Smtp:          GmailSmtpUrl,
+		UserInfoURL:   "https://www.googleapis.com/oauth2/v2/userinfo",
+		RevocationURL: "https://oauth2.googleapis.com/revoke",
+	})
 }
@@ -16,6 +16,17 @@ func GenerateCodeVerifier() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(codeVerifier), nil
 }
 
+// GenerateState creates an unguessable state parameter for a single
+// authorization request
+func GenerateState() (string, error) {
+	state := make([]byte, 32)
+	_, err := rand.Read(state)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(state), nil
+}
+
 // GenerateCodeChallenge creates a code challenge from the code verifier
 func GenerateCodeChallenge(verifier string) string {
 	sha := sha256.Sum256([]byte(verifier))
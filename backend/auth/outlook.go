@@ -1,15 +1,44 @@
 package auth
 
 import (
+	"os"
+
+	"github.com/joho/godotenv"
 	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/microsoft"
 )
 
-var OutlookOAuthConfig = &oauth2.Config{
-	ClientID:    "YOUR_MICROSOFT_CLIENT_ID",
-	RedirectURL: "http://localhost:PORT/oauth2callback",
-	Scopes:      []string{"https://outlook.office.com/IMAP.AccessAsUser.All"},
-	Endpoint: oauth2.Endpoint{
-		AuthURL:  "https://login.microsoftonline.com/common/oauth2/v2.0/authorize",
-		TokenURL: "https://login.microsoftonline.com/common/oauth2/v2.0/token",
-	},
+const OutlookProviderName = "Outlook.com"
+
+const OutlookImapUrl = "outlook.office365.com:993"
+const OutlookSmtpUrl = "smtp.office365.com:587"
+
+func init() {
+	// Load environment variables
+	godotenv.Load()
+
+	endpoint := microsoft.AzureADEndpoint("common")
+	// Public clients must not send a client secret, not even an empty one
+	endpoint.AuthStyle = oauth2.AuthStyleInParams
+
+	// Outlook is a public client: it has no secret and relies on PKCE. The
+	// email address comes from the id_token claims. Microsoft has no token
+	// revocation endpoint, so removing an account only forgets its tokens.
+	RegisterProvider(&OAuthProvider{
+		ProviderName: OutlookProviderName,
+		Config: &oauth2.Config{
+			ClientID: os.Getenv("MICROSOFT_CLIENT_ID"),
+			Scopes: []string{
+				"https://outlook.office.com/IMAP.AccessAsUser.All",
+				"https://outlook.office.com/SMTP.Send",
+				"offline_access",
+				"openid",
+				"email",
+				"profile",
+			},
+			Endpoint: endpoint,
+		},
+		Imap: OutlookImapUrl,
+		Smtp: OutlookSmtpUrl,
+	})
 }
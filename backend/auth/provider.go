@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"context"
+	"email_test_app/backend/mail"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/oauth2"
+)
+
+// Provider is an email provider that supports signing in with OAuth
+type Provider interface {
+	// Name is the key the provider is registered under and stored with accounts
+	Name() string
+	// OAuthConfig has no RedirectURL; the loopback address is only known once
+	// a sign-in starts
+	OAuthConfig() *oauth2.Config
+	ImapUrl() string
+	SmtpUrl() string
+	// LookupEmail returns the email address of the user a token belongs to
+	LookupEmail(ctx context.Context, token *oauth2.Token) (string, error)
+	// RevokeToken invalidates a token at the provider. Providers without a
+	// revocation endpoint do nothing.
+	RevokeToken(ctx context.Context, token *oauth2.Token) error
+}
+
+// OAuthProvider is a Provider described entirely by data. Providers that
+// expose an OpenID Connect id_token leave UserInfoURL empty.
+type OAuthProvider struct {
+	ProviderName  string
+	Config        *oauth2.Config
+	Imap          string
+	Smtp          string
+	UserInfoURL   string
+	RevocationURL string // RFC 7009 token revocation endpoint
+}
+
+func (p *OAuthProvider) Name() string                { return p.ProviderName }
+func (p *OAuthProvider) OAuthConfig() *oauth2.Config { return p.Config }
+func (p *OAuthProvider) ImapUrl() string             { return p.Imap }
+func (p *OAuthProvider) SmtpUrl() string             { return p.Smtp }
+
+func (p *OAuthProvider) LookupEmail(ctx context.Context, token *oauth2.Token) (string, error) {
+	if p.UserInfoURL == "" {
+		return IDTokenEmail(token)
+	}
+
+	client := p.Config.Client(ctx, token)
+	resp, err := client.Get(p.UserInfoURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var userInfo struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&userInfo); err != nil {
+		return "", err
+	}
+	if userInfo.Email == "" {
+		return "", fmt.Errorf("no email address in user info")
+	}
+
+	return userInfo.Email, nil
+}
+
+func (p *OAuthProvider) RevokeToken(ctx context.Context, token *oauth2.Token) error {
+	if p.RevocationURL == "" {
+		return nil
+	}
+
+	// revoking the refresh token also revokes the access tokens issued with it
+	form := url.Values{}
+	if token.RefreshToken != "" {
+		form.Set("token", token.RefreshToken)
+		form.Set("token_type_hint", "refresh_token")
+	} else {
+		form.Set("token", token.AccessToken)
+		form.Set("token_type_hint", "access_token")
+	}
+	form.Set("client_id", p.Config.ClientID)
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.RevocationURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// an already invalid token is reported as invalid_token or, by some
+	// providers, as a plain 400; either way it can no longer be used
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusBadRequest {
+		return fmt.Errorf("token revocation failed: %s", resp.Status)
+	}
+	return nil
+}
+
+var (
+	providers      = make(map[string]Provider)
+	providersMutex sync.RWMutex
+)
+
+// RegisterProvider makes a provider available by name, replacing any
+// provider already registered under that name
+func RegisterProvider(p Provider) {
+	providersMutex.Lock()
+	defer providersMutex.Unlock()
+	providers[p.Name()] = p
+}
+
+// GetProvider returns the provider registered under name
+func GetProvider(name string) (Provider, error) {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	p, ok := providers[name]
+	if !ok {
+		return nil, mail.NewError(mail.ErrorNotFound, fmt.Errorf("unsupported provider for OAuth: %q", name))
+	}
+	return p, nil
+}
+
+// ProviderNames returns the names of all registered providers, sorted
+func ProviderNames() []string {
+	providersMutex.RLock()
+	defer providersMutex.RUnlock()
+
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
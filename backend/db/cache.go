@@ -0,0 +1,207 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// bodyBytes is the size in bytes of a message's cached body and attachment
+// data. LENGTH counts characters in text, so values are measured as blobs.
+const bodyBytes = "COALESCE(LENGTH(CAST(body_plain AS BLOB)), 0) + COALESCE(LENGTH(CAST(body_html AS BLOB)), 0) + COALESCE(LENGTH(CAST(body_raw AS BLOB)), 0)"
+
+// hasBody selects messages whose body or attachments are cached; messages
+// are stored with empty bodies until they are fetched
+const hasBody = "(" + bodyBytes + ") > 0"
+
+// RetentionPolicy says which cached bodies may be evicted. Envelopes and
+// previews are always kept, so the message list works without the server.
+type RetentionPolicy struct {
+	// MaxDatabaseBytes is how large the database may grow before the least
+	// recently used bodies are evicted; 0 means no limit
+	MaxDatabaseBytes int64
+	// KeepDays protects the bodies of messages newer than this many days
+	KeepDays int
+	// KeepFlagged protects the bodies of flagged (starred) messages
+	KeepFlagged bool
+}
+
+// MailboxUsage is how much of the database a mailbox's cached messages take
+type MailboxUsage struct {
+	AccountId       int64
+	MailboxName     string
+	Messages        int64
+	CachedBodies    int64
+	EnvelopeBytes   int64
+	BodyBytes       int64
+	AttachmentBytes int64
+}
+
+// DatabaseSize returns the size of the database file and how much of it is
+// free pages waiting to be vacuumed
+func DatabaseSize(db *sql.DB) (size, free int64, err error) {
+	var pageSize, pageCount, freeCount int64
+	if err := db.QueryRow("PRAGMA page_size").Scan(&pageSize); err != nil {
+		return 0, 0, fmt.Errorf("error reading page size: %w", err)
+	}
+	if err := db.QueryRow("PRAGMA page_count").Scan(&pageCount); err != nil {
+		return 0, 0, fmt.Errorf("error reading page count: %w", err)
+	}
+	if err := db.QueryRow("PRAGMA freelist_count").Scan(&freeCount); err != nil {
+		return 0, 0, fmt.Errorf("error reading free page count: %w", err)
+	}
+	return pageCount * pageSize, freeCount * pageSize, nil
+}
+
+// GetMailboxUsage returns the space taken by the cached messages of every
+// mailbox, ordered by account and mailbox
+func GetMailboxUsage(db *sql.DB) ([]MailboxUsage, error) {
+	rows, err := db.Query(`
+		SELECT account_id, mailbox_name, COUNT(*),
+			COUNT(CASE WHEN ` + hasBody + ` THEN 1 END),
+			COALESCE(SUM(LENGTH(CAST(envelope AS BLOB)) + COALESCE(LENGTH(CAST(preview AS BLOB)), 0)), 0),
+			COALESCE(SUM(COALESCE(LENGTH(CAST(body_plain AS BLOB)), 0) + COALESCE(LENGTH(CAST(body_html AS BLOB)), 0)), 0),
+			COALESCE(SUM(LENGTH(CAST(body_raw AS BLOB))), 0)
+		FROM messages
+		GROUP BY account_id, mailbox_name
+		ORDER BY account_id, mailbox_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading storage usage: %w", err)
+	}
+	defer rows.Close()
+
+	var usage []MailboxUsage
+	for rows.Next() {
+		var u MailboxUsage
+		if err := rows.Scan(&u.AccountId, &u.MailboxName, &u.Messages, &u.CachedBodies, &u.EnvelopeBytes, &u.BodyBytes, &u.AttachmentBytes); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
+// MarkBodyAccessed records that a message's cached body was read, so it is
+// evicted after bodies that haven't been read for longer
+func MarkBodyAccessed(db *sql.DB, accountId int64, mailboxName string, uid uint32) error {
+	_, err := db.Exec(`
+		UPDATE messages SET body_accessed_at = ?
+		WHERE account_id = ? AND mailbox_name = ? AND uid = ?
+	`, time.Now().Unix(), accountId, mailboxName, uid)
+	if err != nil {
+		return fmt.Errorf("error recording body access: %w", err)
+	}
+	return nil
+}
+
+// SetFlaggedMessages marks the given messages of a mailbox as flagged and
+// every other one as not
+func SetFlaggedMessages(db *sql.DB, accountId int64, mailboxName string, uids []uint32) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE messages SET flagged = 0 WHERE account_id = ? AND mailbox_name = ? AND flagged != 0", accountId, mailboxName)
+	if err != nil {
+		return fmt.Errorf("error clearing flagged messages: %w", err)
+	}
+
+	stmt, err := tx.Prepare("UPDATE messages SET flagged = 1 WHERE account_id = ? AND mailbox_name = ? AND uid = ?")
+	if err != nil {
+		return fmt.Errorf("error preparing statement to flag messages: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, uid := range uids {
+		if _, err := stmt.Exec(accountId, mailboxName, uid); err != nil {
+			return fmt.Errorf("error flagging message %d: %w", uid, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// EvictBodies drops the least recently used cached bodies and attachments,
+// among those the policy doesn't protect, until the database has shrunk under
+// the policy's limit. It returns how many messages' bodies were dropped and
+// how many bytes that freed. The space is only returned to the filesystem by
+// a vacuum.
+func EvictBodies(db *sql.DB, policy RetentionPolicy) (evicted int64, freed int64, err error) {
+	if policy.MaxDatabaseBytes <= 0 {
+		return 0, 0, nil
+	}
+
+	size, free, err := DatabaseSize(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	excess := size - free - policy.MaxDatabaseBytes
+	if excess <= 0 {
+		return 0, 0, nil
+	}
+
+	query := `
+		SELECT id, ` + bodyBytes + ` FROM messages
+		WHERE ` + hasBody + ` AND COALESCE(date, 0) < ?`
+	args := []interface{}{time.Now().AddDate(0, 0, -policy.KeepDays).Unix()}
+	if policy.KeepFlagged {
+		query += " AND flagged = 0"
+	}
+	// prefetched bodies that were never opened go first
+	query += " ORDER BY COALESCE(body_accessed_at, 0), date"
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error finding bodies to evict: %w", err)
+	}
+
+	var ids []int64
+	for rows.Next() && freed < excess {
+		var id, bytes int64
+		if err := rows.Scan(&id, &bytes); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+		freed += bytes
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE messages SET body_plain = NULL, body_html = NULL, body_raw = NULL, body_accessed_at = NULL WHERE id = ?")
+	if err != nil {
+		return 0, 0, fmt.Errorf("error preparing statement to evict bodies: %w", err)
+	}
+	defer stmt.Close()
+
+	for _, id := range ids {
+		if _, err := stmt.Exec(id); err != nil {
+			return 0, 0, fmt.Errorf("error evicting body of message %d: %w", id, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return int64(len(ids)), freed, nil
+}
+
+// Vacuum rebuilds the database file, defragmenting it and returning every
+// free page to the filesystem
+func Vacuum(db *sql.DB) error {
+	if _, err := db.Exec("VACUUM"); err != nil {
+		return fmt.Errorf("error vacuuming database: %w", err)
+	}
+	return nil
+}
@@ -1,11 +1,18 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"email_test_app/backend/auth"
+	"email_test_app/backend/secrets"
+	"encoding/json"
 	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/emersion/go-imap"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -16,11 +23,23 @@ func InitDB(path string) (*sql.DB, error) {
 		return nil, err
 	}
 
+	if err := enableIncrementalVacuum(db); err != nil {
+		return nil, err
+	}
+
 	// Ensure database schema is set up
 	if err := createSchema(db); err != nil {
 		return nil, err
 	}
 
+	if err := migrateSchema(db); err != nil {
+		return nil, err
+	}
+
+	if err := createIndexes(db); err != nil {
+		return nil, err
+	}
+
 	if err := db.Ping(); err != nil {
 		return nil, err
 	}
@@ -32,8 +51,12 @@ func InitDB(path string) (*sql.DB, error) {
 	return db, nil
 }
 
-func GetAccounts(db *sql.DB) (map[int64]auth.Account, error) {
-	rows, err := db.Query("SELECT * FROM accounts")
+// GetAccounts returns every account with its credentials decrypted with vault
+func GetAccounts(db *sql.DB, vault *secrets.Vault) (map[int64]auth.Account, error) {
+	rows, err := db.Query(`
+		SELECT id, email, imap_url, oauth_access_token, oauth_refresh_token, oauth_expiry, app_specific_password, COALESCE(provider, ''), auth_state, COALESCE(connection_settings, '')
+		FROM accounts
+	`)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieving accounts: %w", err)
 	}
@@ -43,20 +66,31 @@ func GetAccounts(db *sql.DB) (map[int64]auth.Account, error) {
 
 	for rows.Next() {
 		var account auth.Account
-		var createdAt string
-		if err := rows.Scan(&account.Id, &account.Email, &account.ImapUrl, &account.OAuthAccessToken, &account.OAuthRefreshToken, &account.OAuthExpiry, &account.AppSpecificPassword, &createdAt); err != nil {
+		var connectionSettings string
+		if err := rows.Scan(&account.Id, &account.Email, &account.ImapUrl, &account.OAuthAccessToken, &account.OAuthRefreshToken, &account.OAuthExpiry, &account.AppSpecificPassword, &account.Provider, &account.AuthState, &connectionSettings); err != nil {
 			return nil, fmt.Errorf("error scanning account row: %w", err)
 		}
-		log.Println("Pulled account from DB:", account)
+		account, err = decryptCredentials(vault, account)
+		if err != nil {
+			return nil, fmt.Errorf("error decrypting credentials of account %d: %w", account.Id, err)
+		}
+		account.Connection, err = decryptConnectionSettings(vault, account.Email, connectionSettings)
+		if err != nil {
+			return nil, fmt.Errorf("error reading connection settings of account %d: %w", account.Id, err)
+		}
+		log.Println("Pulled account from DB:", account.Id, account.Email)
 		accounts[account.Id] = account
 	}
 
 	return accounts, nil
 }
 
-func createSchema(db *sql.DB) error {
-	schema := `
-    CREATE TABLE IF NOT EXISTS accounts (
+// tables holds the current definition of every table, in creation order
+var tables = []struct {
+	name       string
+	definition string
+}{
+	{"accounts", `
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         email TEXT UNIQUE NOT NULL,
 		imap_url TEXT NOT NULL,
@@ -64,16 +98,19 @@ func createSchema(db *sql.DB) error {
 		oauth_refresh_token TEXT,
 		oauth_expiry INTEGER,
 		app_specific_password TEXT,
+		provider TEXT,
+		auth_state TEXT NOT NULL DEFAULT 'active',
+		connection_settings TEXT,
         created_at DATETIME DEFAULT CURRENT_TIMESTAMP
-    );
-
-    CREATE TABLE IF NOT EXISTS mailboxes (
+    `},
+	{"mailboxes", `
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		account_id INTEGER NOT NULL,
-		name TEXT NOT NULL UNIQUE
-	);
-
-	CREATE TABLE IF NOT EXISTS messages (
+		name TEXT NOT NULL,
+		role TEXT,
+		UNIQUE(account_id, name)
+	`},
+	{"messages", `
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		mailbox_name TEXT NOT NULL,
 		account_id INTEGER NOT NULL,
@@ -82,11 +119,443 @@ func createSchema(db *sql.DB) error {
 		body_plain TEXT,
 		body_html TEXT,
 		body_raw BLOB,
+		internal_date INTEGER,
+		sent_date TEXT,
+		size INTEGER,
+		date INTEGER,
+		preview TEXT,
+		flagged INTEGER NOT NULL DEFAULT 0,
+		body_accessed_at INTEGER,
 		received_at DATETIME DEFAULT CURRENT_TIMESTAMP,
 		last_updated DATETIME DEFAULT CURRENT_TIMESTAMP,
-		UNIQUE(mailbox_name, uid)
-	);
-    `
-	_, err := db.Exec(schema)
+		UNIQUE(account_id, mailbox_name, uid)
+	`},
+	// vault has a single row describing how the key that encrypts account
+	// credentials is protected
+	{"vault", `
+		id INTEGER PRIMARY KEY CHECK (id = 1),
+		key_source TEXT NOT NULL,
+		key_version INTEGER NOT NULL,
+		salt BLOB,
+		kdf_time INTEGER NOT NULL DEFAULT 0,
+		kdf_memory INTEGER NOT NULL DEFAULT 0,
+		kdf_threads INTEGER NOT NULL DEFAULT 0,
+		wrapped_key BLOB,
+		updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	`},
+	// settings holds app-wide preferences as key/value pairs
+	{"settings", `
+		key TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	`},
+	// sync_intervals overrides how often an account is synced; an empty
+	// mailbox name is the account-wide interval
+	{"sync_intervals", `
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		mailbox_name TEXT NOT NULL DEFAULT '',
+		interval_seconds INTEGER NOT NULL,
+		UNIQUE(account_id, mailbox_name)
+	`},
+	// sync_status records the outcome of the last syncs of each mailbox, and
+	// how far back it has been synced; an empty mailbox name is the
+	// account's mailbox list
+	{"sync_status", `
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		mailbox_name TEXT NOT NULL DEFAULT '',
+		last_success INTEGER,
+		last_error TEXT,
+		last_error_at INTEGER,
+		oldest_uid INTEGER,
+		backfill_complete INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(account_id, mailbox_name)
+	`},
+	// sync_windows overrides how far back the first sync of a mailbox
+	// reaches; an empty mailbox name is the account-wide window
+	{"sync_windows", `
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account_id INTEGER NOT NULL,
+		mailbox_name TEXT NOT NULL DEFAULT '',
+		days INTEGER NOT NULL DEFAULT 0,
+		messages INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(account_id, mailbox_name)
+	`},
+}
+
+// indexes are created after migrations, since rebuilding a table drops its indexes
+var indexes = []string{
+	// replaced by messages_by_page_key, which sorts messages without a date
+	// the way the page queries do
+	"DROP INDEX IF EXISTS messages_by_date",
+	// keyset pagination of a mailbox by date; messages without one sort as
+	// the oldest
+	"CREATE INDEX IF NOT EXISTS messages_by_page_key ON messages(account_id, mailbox_name, COALESCE(date, 0), uid)",
+}
+
+func createSchema(db *sql.DB) error {
+	for _, table := range tables {
+		_, err := db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table.name, table.definition))
+		if err != nil {
+			return fmt.Errorf("error creating table %s: %w", table.name, err)
+		}
+	}
+	return nil
+}
+
+func createIndexes(db *sql.DB) error {
+	for _, index := range indexes {
+		if _, err := db.Exec(index); err != nil {
+			return fmt.Errorf("error creating index: %w", err)
+		}
+	}
+	return nil
+}
+
+// column is a column added to an existing table after its first release
+type column struct {
+	table      string
+	name       string
+	definition string
+}
+
+// addedColumns lists columns that older databases may be missing, in the order
+// they were introduced
+var addedColumns = []column{
+	{"messages", "internal_date", "INTEGER"},
+	{"messages", "sent_date", "TEXT"},
+	{"messages", "size", "INTEGER"},
+	{"messages", "date", "INTEGER"},
+	{"mailboxes", "role", "TEXT"},
+	{"messages", "preview", "TEXT"},
+	{"accounts", "provider", "TEXT"},
+	{"accounts", "auth_state", "TEXT NOT NULL DEFAULT 'active'"},
+	{"accounts", "connection_settings", "TEXT"},
+	{"messages", "flagged", "INTEGER NOT NULL DEFAULT 0"},
+	{"messages", "body_accessed_at", "INTEGER"},
+	{"sync_status", "oldest_uid", "INTEGER"},
+	{"sync_status", "backfill_complete", "INTEGER NOT NULL DEFAULT 0"},
+}
+
+// legacyConstraints are constraints from earlier releases that SQLite can only
+// drop by rebuilding the table
+var legacyConstraints = []struct {
+	table    string
+	fragment string
+}{
+	// mailbox names and UIDs used to be unique across all accounts
+	{"mailboxes", "name TEXT NOT NULL UNIQUE"},
+	{"messages", "UNIQUE(mailbox_name, uid)"},
+}
+
+func migrateSchema(db *sql.DB) error {
+	for _, col := range addedColumns {
+		exists, err := columnExists(db, col.table, col.name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", col.table, col.name, col.definition))
+		if err != nil {
+			return fmt.Errorf("error adding column %s.%s: %w", col.table, col.name, err)
+		}
+	}
+
+	for _, constraint := range legacyConstraints {
+		var tableSQL string
+		err := db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = ?", constraint.table).Scan(&tableSQL)
+		if err != nil {
+			return fmt.Errorf("error reading definition of %s: %w", constraint.table, err)
+		}
+		if !strings.Contains(tableSQL, constraint.fragment) {
+			continue
+		}
+
+		if err := rebuildTable(db, constraint.table); err != nil {
+			return fmt.Errorf("error rebuilding %s: %w", constraint.table, err)
+		}
+	}
+
+	if err := backfillMessageDates(db); err != nil {
+		return fmt.Errorf("error backfilling message dates: %w", err)
+	}
+
+	if err := backfillAccountProviders(db); err != nil {
+		return fmt.Errorf("error backfilling account providers: %w", err)
+	}
+
+	return nil
+}
+
+// rebuildTable recreates a table with its current definition, copying over
+// every row
+func rebuildTable(db *sql.DB, name string) error {
+	var definition string
+	for _, table := range tables {
+		if table.name == name {
+			definition = table.definition
+		}
+	}
+
+	columns, err := tableColumns(db, name)
+	if err != nil {
+		return err
+	}
+	columnList := strings.Join(columns, ", ")
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		fmt.Sprintf("CREATE TABLE %s_new (%s)", name, definition),
+		fmt.Sprintf("INSERT OR IGNORE INTO %s_new (%s) SELECT %s FROM %s", name, columnList, columnList, name),
+		fmt.Sprintf("DROP TABLE %s", name),
+		fmt.Sprintf("ALTER TABLE %s_new RENAME TO %s", name, name),
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Rebuilt table", name)
+
+	return tx.Commit()
+}
+
+func columnExists(db *sql.DB, table, name string) (bool, error) {
+	columns, err := tableColumns(db, table)
+	if err != nil {
+		return false, err
+	}
+	return slices.Contains(columns, name), nil
+}
+
+func tableColumns(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var (
+			cid          int
+			colName      string
+			colType      string
+			notNull      bool
+			defaultValue sql.NullString
+			primaryKey   int
+		)
+		if err := rows.Scan(&cid, &colName, &colType, &notNull, &defaultValue, &primaryKey); err != nil {
+			return nil, err
+		}
+		columns = append(columns, colName)
+	}
+
+	return columns, rows.Err()
+}
+
+// UpdateAccountToken stores a refreshed OAuth token for an account
+func UpdateAccountToken(db *sql.DB, vault *secrets.Vault, accountId int64, email, accessToken, refreshToken string, expiry int64) error {
+	accessToken, err := vault.Encrypt("oauth_access_token", email, accessToken)
+	if err != nil {
+		return err
+	}
+	refreshToken, err = vault.Encrypt("oauth_refresh_token", email, refreshToken)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`
+		UPDATE accounts
+		SET oauth_access_token = ?, oauth_refresh_token = ?, oauth_expiry = ?
+		WHERE id = ?
+	`, accessToken, refreshToken, expiry, accountId)
 	return err
 }
+
+// DeleteAccount removes an account along with its mailboxes and cached
+// messages in one transaction
+func DeleteAccount(db *sql.DB, accountId int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"messages", "mailboxes", "sync_intervals", "sync_status", "sync_windows"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE account_id = ?", accountId); err != nil {
+			return fmt.Errorf("error deleting %s of account %d: %w", table, accountId, err)
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM accounts WHERE id = ?", accountId); err != nil {
+		return fmt.Errorf("error deleting account %d: %w", accountId, err)
+	}
+
+	return tx.Commit()
+}
+
+// IncrementalVacuum returns the pages freed by deletes to the filesystem
+func IncrementalVacuum(db *sql.DB) error {
+	// the pragma frees one page per step, so Exec would only free the first
+	rows, err := db.Query("PRAGMA incremental_vacuum")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+	}
+	return rows.Err()
+}
+
+// enableIncrementalVacuum switches the database to incremental auto-vacuum.
+// That only takes effect right away on a new database; older ones are left
+// to ConvertToIncrementalVacuum so opening them doesn't wait for a VACUUM.
+func enableIncrementalVacuum(db *sql.DB) error {
+	var mode int
+	if err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return fmt.Errorf("error reading auto_vacuum mode: %w", err)
+	}
+
+	// 2 is INCREMENTAL
+	if mode == 2 {
+		return nil
+	}
+
+	if _, err := db.Exec("PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return fmt.Errorf("error enabling incremental vacuum: %w", err)
+	}
+	return nil
+}
+
+// ConvertToIncrementalVacuum switches a database created before incremental
+// auto-vacuum over to it, which takes a full VACUUM. It reports whether the
+// database had to be converted.
+func ConvertToIncrementalVacuum(db *sql.DB) (bool, error) {
+	// the pragma only applies to the connection it was set on
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	var mode int
+	if err := conn.QueryRowContext(context.Background(), "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return false, fmt.Errorf("error reading auto_vacuum mode: %w", err)
+	}
+	if mode == 2 {
+		return false, nil
+	}
+
+	if _, err := conn.ExecContext(context.Background(), "PRAGMA auto_vacuum = INCREMENTAL"); err != nil {
+		return false, fmt.Errorf("error enabling incremental vacuum: %w", err)
+	}
+	if _, err := conn.ExecContext(context.Background(), "VACUUM"); err != nil {
+		return false, fmt.Errorf("error vacuuming database: %w", err)
+	}
+	return true, nil
+}
+
+// SetAccountAuthState records whether an account's credentials still work
+func SetAccountAuthState(db *sql.DB, accountId int64, state auth.AuthState) error {
+	_, err := db.Exec("UPDATE accounts SET auth_state = ? WHERE id = ?", state, accountId)
+	return err
+}
+
+// backfillAccountProviders records the OAuth provider of accounts added
+// before it was stored, going by the provider's IMAP server
+func backfillAccountProviders(db *sql.DB) error {
+	for _, name := range auth.ProviderNames() {
+		provider, err := auth.GetProvider(name)
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Exec(`
+			UPDATE accounts SET provider = ?
+			WHERE provider IS NULL AND imap_url = ? AND COALESCE(oauth_refresh_token, '') != ''
+		`, provider.Name(), provider.ImapUrl())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillMessageDates fills in the Date header columns for messages cached
+// before they existed. INTERNALDATE and size can only come from the server, so
+// those are backfilled during the next sync of each mailbox. Messages without
+// a usable Date header get an empty sent_date, so they aren't looked at again.
+func backfillMessageDates(db *sql.DB) error {
+	rows, err := db.Query("SELECT id, envelope FROM messages WHERE sent_date IS NULL")
+	if err != nil {
+		return err
+	}
+
+	type messageDate struct {
+		id   int64
+		date time.Time
+	}
+
+	var dates []messageDate
+	for rows.Next() {
+		var id int64
+		var envelopeData []byte
+		if err := rows.Scan(&id, &envelopeData); err != nil {
+			rows.Close()
+			return err
+		}
+
+		var date time.Time
+		var envelope imap.Envelope
+		if err := json.Unmarshal(envelopeData, &envelope); err != nil {
+			log.Println("Error unmarshalling envelope for message", id, ":", err)
+		} else {
+			date = envelope.Date
+		}
+		dates = append(dates, messageDate{id, date})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(dates) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare("UPDATE messages SET sent_date = ?, date = COALESCE(internal_date, ?, date) WHERE id = ?")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, d := range dates {
+		var sentDate string
+		var date interface{}
+		if !d.date.IsZero() {
+			sentDate, date = d.date.Format(time.RFC3339), d.date.Unix()
+		}
+		if _, err := stmt.Exec(sentDate, date, d.id); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Backfilled dates for", len(dates), "messages")
+
+	return tx.Commit()
+}
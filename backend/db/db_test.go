@@ -0,0 +1,235 @@
+package db
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func autoVacuumMode(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var mode int
+	if err := db.QueryRow("PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		t.Fatal(err)
+	}
+	return mode
+}
+
+func TestConvertToIncrementalVacuum(t *testing.T) {
+	path := t.TempDir() + "/old.db"
+
+	// a database from before incremental vacuum
+	old, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := old.Exec("CREATE TABLE settings (key TEXT PRIMARY KEY, value TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	old.Close()
+
+	db, err := InitDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// opening it doesn't wait for the conversion
+	if mode := autoVacuumMode(t, db); mode != 0 {
+		t.Fatalf("auto_vacuum is %d after InitDB, want 0 until converted", mode)
+	}
+
+	converted, err := ConvertToIncrementalVacuum(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !converted {
+		t.Fatal("ConvertToIncrementalVacuum didn't convert the database")
+	}
+	if mode := autoVacuumMode(t, db); mode != 2 {
+		t.Fatalf("auto_vacuum is %d after converting, want 2", mode)
+	}
+
+	if converted, err := ConvertToIncrementalVacuum(db); err != nil || converted {
+		t.Fatalf("ConvertToIncrementalVacuum() = %v, %v on a converted database, want false, nil", converted, err)
+	}
+}
+
+func TestNewDatabaseUsesIncrementalVacuum(t *testing.T) {
+	db, err := InitDB(t.TempDir() + "/new.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if mode := autoVacuumMode(t, db); mode != 2 {
+		t.Fatalf("auto_vacuum is %d, want 2", mode)
+	}
+	if converted, err := ConvertToIncrementalVacuum(db); err != nil || converted {
+		t.Fatalf("ConvertToIncrementalVacuum() = %v, %v on a new database, want false, nil", converted, err)
+	}
+}
+
+func TestBackfillMessageDates(t *testing.T) {
+	db, err := InitDB(t.TempDir() + "/backfill.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// messages cached before the date columns
+	envelopes := map[uint32]string{
+		1: `{"Date":"2024-03-01T10:00:00+01:00","Subject":"Dated"}`,
+		2: `{"Subject":"No Date header"}`,
+		3: `not an envelope`,
+	}
+	for uid, envelope := range envelopes {
+		if _, err := db.Exec("INSERT INTO messages (account_id, mailbox_name, uid, envelope) VALUES (1, 'INBOX', ?, ?)", uid, envelope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := backfillMessageDates(db); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[uint32]struct {
+		sentDate string
+		date     sql.NullInt64
+	}{
+		1: {"2024-03-01T10:00:00+01:00", sql.NullInt64{Int64: 1709283600, Valid: true}},
+		2: {"", sql.NullInt64{}},
+		3: {"", sql.NullInt64{}},
+	}
+	for uid, w := range want {
+		var sentDate sql.NullString
+		var date sql.NullInt64
+		if err := db.QueryRow("SELECT sent_date, date FROM messages WHERE uid = ?", uid).Scan(&sentDate, &date); err != nil {
+			t.Fatal(err)
+		}
+		if !sentDate.Valid || sentDate.String != w.sentDate || date != w.date {
+			t.Errorf("message %d has sent_date %v, date %v, want %q, %v", uid, sentDate, date, w.sentDate, w.date)
+		}
+	}
+
+	// nothing is left to look at on the next start
+	var pending int
+	if err := db.QueryRow("SELECT COUNT(*) FROM messages WHERE sent_date IS NULL").Scan(&pending); err != nil {
+		t.Fatal(err)
+	}
+	if pending != 0 {
+		t.Errorf("%d messages are left to backfill, want 0", pending)
+	}
+}
+
+func TestEvictBodies(t *testing.T) {
+	// two bytes a character, so bodies are measured in bytes, not characters
+	body := strings.Repeat("é", 5000)
+	const bodySize = 10000
+
+	now := time.Now()
+	old := now.AddDate(0, 0, -100).Unix()
+	messages := []struct {
+		uid        uint32
+		date       int64
+		accessedAt any
+		flagged    bool
+		noBody     bool
+	}{
+		{uid: 1, date: old, accessedAt: now.Add(-time.Hour).Unix()},
+		{uid: 2, date: old},
+		{uid: 3, date: old, accessedAt: now.Add(-48 * time.Hour).Unix()},
+		// newer than KeepDays
+		{uid: 4, date: now.Unix()},
+		// the oldest, but flagged
+		{uid: 5, date: old - 1, flagged: true},
+		{uid: 6, date: old, noBody: true},
+	}
+
+	setup := func(t *testing.T) *sql.DB {
+		db, err := InitDB(t.TempDir() + "/evict.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+
+		for _, m := range messages {
+			var plain any = body
+			if m.noBody {
+				plain = nil
+			}
+			_, err := db.Exec(`
+				INSERT INTO messages (account_id, mailbox_name, uid, envelope, date, body_plain, flagged, body_accessed_at)
+				VALUES (1, 'INBOX', ?, '{}', ?, ?, ?, ?)
+			`, m.uid, m.date, plain, m.flagged, m.accessedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		return db
+	}
+
+	// evict runs EvictBodies with a limit 1.5 bodies below the current size
+	// and returns the UIDs whose bodies are gone
+	evict := func(t *testing.T, db *sql.DB, policy RetentionPolicy) (int64, int64, []uint32) {
+		size, free, err := DatabaseSize(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		policy.MaxDatabaseBytes = size - free - bodySize*3/2
+
+		evicted, freed, err := EvictBodies(db, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rows, err := db.Query("SELECT uid FROM messages WHERE body_plain IS NULL AND uid != 6 ORDER BY uid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var uids []uint32
+		for rows.Next() {
+			var uid uint32
+			if err := rows.Scan(&uid); err != nil {
+				t.Fatal(err)
+			}
+			uids = append(uids, uid)
+		}
+		return evicted, freed, uids
+	}
+
+	t.Run("least recently used first", func(t *testing.T) {
+		db := setup(t)
+
+		// never opened, then the longest ago opened; two bodies cover the
+		// excess, so the third candidate is kept
+		evicted, freed, uids := evict(t, db, RetentionPolicy{KeepDays: 30, KeepFlagged: true})
+		if evicted != 2 || freed != 2*bodySize || !slices.Equal(uids, []uint32{2, 3}) {
+			t.Errorf("evicted %d bodies of %d bytes, %v, want 2 of %d bytes, [2 3]", evicted, freed, uids, 2*bodySize)
+		}
+	})
+
+	t.Run("flagged unprotected", func(t *testing.T) {
+		db := setup(t)
+
+		evicted, freed, uids := evict(t, db, RetentionPolicy{KeepDays: 30})
+		if evicted != 2 || freed != 2*bodySize || !slices.Equal(uids, []uint32{2, 5}) {
+			t.Errorf("evicted %d bodies of %d bytes, %v, want 2 of %d bytes, [2 5]", evicted, freed, uids, 2*bodySize)
+		}
+	})
+
+	t.Run("under the limit", func(t *testing.T) {
+		db := setup(t)
+
+		size, _, err := DatabaseSize(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if evicted, freed, err := EvictBodies(db, RetentionPolicy{MaxDatabaseBytes: size}); err != nil || evicted != 0 || freed != 0 {
+			t.Errorf("EvictBodies() = %d, %d, %v under the limit, want 0, 0, nil", evicted, freed, err)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// PageKey is the position of the last message of a page in a mailbox's
+// newest-first order
+type PageKey struct {
+	Date int64
+	UID  uint32
+}
+
+// DateRange limits a page to messages dated in [After, Before), in unix
+// seconds. Zero leaves that end open.
+type DateRange struct {
+	After  int64
+	Before int64
+}
+
+// QueryMailboxPage selects the given columns of up to limit messages of a
+// mailbox within dates, newest first, starting after the message at after, or
+// from the newest message if after is nil. Messages without a date sort as
+// the oldest. It walks the messages_by_page_key index, so it takes as long
+// for the last page as for the first.
+func QueryMailboxPage(db *sql.DB, columns string, accountId int64, mailboxName string, dates DateRange, after *PageKey, limit uint32) (*sql.Rows, error) {
+	query := `
+        SELECT ` + columns + ` FROM messages 
+        WHERE account_id = ? AND mailbox_name = ?`
+	args := []interface{}{accountId, mailboxName}
+
+	if after != nil {
+		// SQLite only seeks the index with the first comparison; the row
+		// value one, on an expression, is checked row by row
+		query += ` AND COALESCE(date, 0) <= ? AND (COALESCE(date, 0), uid) < (?, ?)`
+		args = append(args, after.Date, after.Date, after.UID)
+	}
+	if dates.Before != 0 {
+		query += ` AND COALESCE(date, 0) < ?`
+		args = append(args, dates.Before)
+	}
+	if dates.After != 0 {
+		query += ` AND COALESCE(date, 0) >= ?`
+		args = append(args, dates.After)
+	}
+
+	query += `
+        ORDER BY COALESCE(date, 0) DESC, uid DESC 
+        LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying messages from database: %w", err)
+	}
+	return rows, nil
+}
+
+// GetOldestMessageDate returns the date of the oldest cached message of a
+// mailbox, with messages without a date counting as 0. ok is false if the
+// mailbox has no cached messages.
+func GetOldestMessageDate(db *sql.DB, accountId int64, mailboxName string) (date int64, ok bool, err error) {
+	var oldest sql.NullInt64
+	err = db.QueryRow(`
+        SELECT MIN(COALESCE(date, 0)) FROM messages
+        WHERE account_id = ? AND mailbox_name = ?`, accountId, mailboxName).Scan(&oldest)
+	if err != nil {
+		return 0, false, fmt.Errorf("error querying oldest message date: %w", err)
+	}
+	return oldest.Int64, oldest.Valid, nil
+}
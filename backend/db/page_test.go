@@ -0,0 +1,189 @@
+package db
+
+import (
+	"database/sql"
+	"slices"
+	"testing"
+	"time"
+)
+
+const fixtureMessages = 100_000
+
+// newPageFixture creates a database holding fixtureMessages messages in one
+// mailbox, a minute apart, with a few more in another account's mailbox of
+// the same name
+func newPageFixture(b *testing.B) *sql.DB {
+	b.Helper()
+
+	db, err := InitDB(b.TempDir() + "/fixture.db")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	tx, err := db.Begin()
+	if err != nil {
+		b.Fatal(err)
+	}
+	stmt, err := tx.Prepare(`
+		INSERT INTO messages (account_id, mailbox_name, uid, envelope, date, preview)
+		VALUES (?, 'INBOX', ?, '{"Subject":"Fixture message"}', ?, 'Preview text of the fixture message')
+	`)
+	if err != nil {
+		b.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+	for i := 1; i <= fixtureMessages; i++ {
+		if _, err := stmt.Exec(1, i, start+int64(i)*60); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := 1; i <= 1000; i++ {
+		if _, err := stmt.Exec(2, i, start+int64(i)*60); err != nil {
+			b.Fatal(err)
+		}
+	}
+	stmt.Close()
+	if err := tx.Commit(); err != nil {
+		b.Fatal(err)
+	}
+
+	return db
+}
+
+// readPage reads a page of UIDs and returns the key of its last message
+func readPage(b *testing.B, db *sql.DB, after *PageKey, limit uint32) (*PageKey, int) {
+	rows, err := QueryMailboxPage(db, "date, uid", 1, "INBOX", DateRange{}, after, limit)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer rows.Close()
+
+	var last PageKey
+	n := 0
+	for rows.Next() {
+		if err := rows.Scan(&last.Date, &last.UID); err != nil {
+			b.Fatal(err)
+		}
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		b.Fatal(err)
+	}
+	return &last, n
+}
+
+func BenchmarkQueryMailboxPage(b *testing.B) {
+	db := newPageFixture(b)
+	const limit = 50
+
+	// the key of the message 90% of the way down the mailbox
+	deep := &PageKey{UID: fixtureMessages / 10}
+	if err := db.QueryRow("SELECT date FROM messages WHERE account_id = 1 AND uid = ?", deep.UID).Scan(&deep.Date); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("first", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, n := readPage(b, db, nil, limit); n != limit {
+				b.Fatalf("got %d messages, want %d", n, limit)
+			}
+		}
+	})
+
+	b.Run("deep", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			last, n := readPage(b, db, deep, limit)
+			if n != limit || last.UID != deep.UID-limit {
+				b.Fatalf("got %d messages ending at %d, want %d ending at %d", n, last.UID, limit, deep.UID-limit)
+			}
+		}
+	})
+
+	// paging through the whole mailbox sees every message once
+	b.Run("walk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var after *PageKey
+			total := 0
+			for {
+				last, n := readPage(b, db, after, 500)
+				total += n
+				if n < 500 {
+					break
+				}
+				after = last
+			}
+			if total != fixtureMessages {
+				b.Fatalf("walked %d messages, want %d", total, fixtureMessages)
+			}
+		}
+	})
+}
+
+// pageUIDs reads every page of a mailbox within dates, limit messages at a time
+func pageUIDs(t *testing.T, db *sql.DB, dates DateRange, limit uint32) []uint32 {
+	t.Helper()
+
+	var uids []uint32
+	var after *PageKey
+	for {
+		rows, err := QueryMailboxPage(db, "COALESCE(date, 0), uid", 1, "INBOX", dates, after, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var last PageKey
+		n := 0
+		for rows.Next() {
+			if err := rows.Scan(&last.Date, &last.UID); err != nil {
+				t.Fatal(err)
+			}
+			uids = append(uids, last.UID)
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if uint32(n) < limit {
+			return uids
+		}
+		after = &last
+	}
+}
+
+func TestQueryMailboxPage(t *testing.T) {
+	db, err := InitDB(t.TempDir() + "/page.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// UIDs 1 and 2 have no date, 5 is older than 4
+	dates := map[uint32]any{1: nil, 2: nil, 3: 100, 4: 300, 5: 200, 6: 400}
+	for uid, date := range dates {
+		if _, err := db.Exec("INSERT INTO messages (account_id, mailbox_name, uid, envelope, date) VALUES (1, 'INBOX', ?, '{}', ?)", uid, date); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		dates DateRange
+		want  []uint32
+	}{
+		{"all", DateRange{}, []uint32{6, 4, 5, 3, 2, 1}},
+		{"before", DateRange{Before: 300}, []uint32{5, 3, 2, 1}},
+		{"after", DateRange{After: 200}, []uint32{6, 4, 5}},
+		{"between", DateRange{After: 200, Before: 400}, []uint32{4, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// paging a message at a time crosses the messages without a date
+			for _, limit := range []uint32{1, 2, 50} {
+				if got := pageUIDs(t, db, test.dates, limit); !slices.Equal(got, test.want) {
+					t.Errorf("pages of %d gave %v, want %v", limit, got, test.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package db
+
+import (
+	"database/sql"
+	"email_test_app/backend/mail"
+	"fmt"
+	"time"
+)
+
+// GetSetting returns an app setting, or def if it has never been set
+func GetSetting(db *sql.DB, key, def string) (string, error) {
+	var value string
+	err := db.QueryRow("SELECT value FROM settings WHERE key = ?", key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return def, nil
+	}
+	if err != nil {
+		return def, fmt.Errorf("error reading setting %s: %w", key, err)
+	}
+	return value, nil
+}
+
+// SetSetting stores an app setting
+func SetSetting(db *sql.DB, key, value string) error {
+	_, err := db.Exec("INSERT OR REPLACE INTO settings (key, value) VALUES (?, ?)", key, value)
+	if err != nil {
+		return fmt.Errorf("error saving setting %s: %w", key, err)
+	}
+	return nil
+}
+
+// GetSyncIntervals returns the sync intervals configured for an account by
+// mailbox name, with the account-wide interval under ""
+func GetSyncIntervals(db *sql.DB, accountId int64) (map[string]time.Duration, error) {
+	rows, err := db.Query("SELECT mailbox_name, interval_seconds FROM sync_intervals WHERE account_id = ?", accountId)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync intervals: %w", err)
+	}
+	defer rows.Close()
+
+	intervals := make(map[string]time.Duration)
+	for rows.Next() {
+		var mailboxName string
+		var seconds int64
+		if err := rows.Scan(&mailboxName, &seconds); err != nil {
+			return nil, err
+		}
+		intervals[mailboxName] = time.Duration(seconds) * time.Second
+	}
+	return intervals, rows.Err()
+}
+
+// SetSyncInterval sets how often a mailbox, or with an empty name the whole
+// account, is synced. An interval of zero goes back to the default.
+func SetSyncInterval(db *sql.DB, accountId int64, mailboxName string, interval time.Duration) error {
+	var err error
+	if interval == 0 {
+		_, err = db.Exec("DELETE FROM sync_intervals WHERE account_id = ? AND mailbox_name = ?", accountId, mailboxName)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO sync_intervals (account_id, mailbox_name, interval_seconds) VALUES (?, ?, ?)
+			ON CONFLICT(account_id, mailbox_name) DO UPDATE SET interval_seconds = excluded.interval_seconds
+		`, accountId, mailboxName, int64(interval/time.Second))
+	}
+	if err != nil {
+		return fmt.Errorf("error saving sync interval: %w", err)
+	}
+	return nil
+}
+
+// GetSyncWindow returns how far back the first sync of a mailbox reaches: the
+// mailbox's own window, else the account's. ok is false if neither is set.
+func GetSyncWindow(db *sql.DB, accountId int64, mailboxName string) (window mail.SyncWindow, ok bool, err error) {
+	// the mailbox's own window sorts before the account's
+	err = db.QueryRow(`
+		SELECT days, messages FROM sync_windows
+		WHERE account_id = ? AND mailbox_name IN (?, '')
+		ORDER BY mailbox_name = '' LIMIT 1
+	`, accountId, mailboxName).Scan(&window.Days, &window.Messages)
+	if err == sql.ErrNoRows {
+		return window, false, nil
+	}
+	if err != nil {
+		return window, false, fmt.Errorf("error reading sync window: %w", err)
+	}
+	return window, true, nil
+}
+
+// SetSyncWindow sets how far back the first sync of a mailbox, or with an
+// empty name of every mailbox of the account, reaches
+func SetSyncWindow(db *sql.DB, accountId int64, mailboxName string, window mail.SyncWindow) error {
+	_, err := db.Exec(`
+		INSERT INTO sync_windows (account_id, mailbox_name, days, messages) VALUES (?, ?, ?, ?)
+		ON CONFLICT(account_id, mailbox_name) DO UPDATE SET days = excluded.days, messages = excluded.messages
+	`, accountId, mailboxName, window.Days, window.Messages)
+	if err != nil {
+		return fmt.Errorf("error saving sync window: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SyncResult is the stored outcome of the syncs of a mailbox, or with an
+// empty mailbox name of an account's mailbox list. Times are zero if there
+// hasn't been a success or an error yet.
+type SyncResult struct {
+	AccountId   int64
+	MailboxName string
+	LastSuccess time.Time
+	LastError   string
+	LastErrorAt time.Time
+}
+
+// RecordSyncResult saves the outcome of a sync. A success clears the last
+// error.
+func RecordSyncResult(db *sql.DB, accountId int64, mailboxName string, syncErr error) error {
+	now := time.Now().Unix()
+
+	var err error
+	if syncErr == nil {
+		_, err = db.Exec(`
+			INSERT INTO sync_status (account_id, mailbox_name, last_success) VALUES (?, ?, ?)
+			ON CONFLICT(account_id, mailbox_name) DO UPDATE SET
+				last_success = excluded.last_success, last_error = NULL, last_error_at = NULL
+		`, accountId, mailboxName, now)
+	} else {
+		_, err = db.Exec(`
+			INSERT INTO sync_status (account_id, mailbox_name, last_error, last_error_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT(account_id, mailbox_name) DO UPDATE SET
+				last_error = excluded.last_error, last_error_at = excluded.last_error_at
+		`, accountId, mailboxName, syncErr.Error(), now)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving sync status: %w", err)
+	}
+	return nil
+}
+
+// GetSyncResults returns the stored sync outcomes of every account
+func GetSyncResults(db *sql.DB) ([]SyncResult, error) {
+	rows, err := db.Query(`
+		SELECT account_id, mailbox_name, COALESCE(last_success, 0), COALESCE(last_error, ''), COALESCE(last_error_at, 0)
+		FROM sync_status ORDER BY account_id, mailbox_name
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error reading sync status: %w", err)
+	}
+	defer rows.Close()
+
+	var results []SyncResult
+	for rows.Next() {
+		var result SyncResult
+		var lastSuccess, lastErrorAt int64
+		if err := rows.Scan(&result.AccountId, &result.MailboxName, &lastSuccess, &result.LastError, &lastErrorAt); err != nil {
+			return nil, err
+		}
+		if lastSuccess != 0 {
+			result.LastSuccess = time.Unix(lastSuccess, 0)
+		}
+		if lastErrorAt != 0 {
+			result.LastErrorAt = time.Unix(lastErrorAt, 0)
+		}
+		results = append(results, result)
+	}
+	return results, rows.Err()
+}
+
+// GetSyncedRange returns the UID of the oldest message of a mailbox that has
+// been synced, and whether every message before it has been synced too.
+// oldestUID is 0 if the mailbox hasn't been synced since windows were
+// introduced.
+func GetSyncedRange(db *sql.DB, accountId int64, mailboxName string) (oldestUID uint32, complete bool, err error) {
+	err = db.QueryRow(`
+		SELECT COALESCE(oldest_uid, 0), backfill_complete FROM sync_status
+		WHERE account_id = ? AND mailbox_name = ?
+	`, accountId, mailboxName).Scan(&oldestUID, &complete)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error reading synced range: %w", err)
+	}
+	return oldestUID, complete, nil
+}
+
+// SetSyncedRange records the UID of the oldest message of a mailbox that has
+// been synced, and whether every message before it has been synced too
+func SetSyncedRange(db *sql.DB, accountId int64, mailboxName string, oldestUID uint32, complete bool) error {
+	_, err := db.Exec(`
+		INSERT INTO sync_status (account_id, mailbox_name, oldest_uid, backfill_complete) VALUES (?, ?, ?, ?)
+		ON CONFLICT(account_id, mailbox_name) DO UPDATE SET
+			oldest_uid = excluded.oldest_uid, backfill_complete = excluded.backfill_complete
+	`, accountId, mailboxName, oldestUID, complete)
+	if err != nil {
+		return fmt.Errorf("error saving synced range: %w", err)
+	}
+	return nil
+}
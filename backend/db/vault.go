@@ -0,0 +1,241 @@
+package db
+
+import (
+	"database/sql"
+	"email_test_app/backend/auth"
+	"email_test_app/backend/mail"
+	"email_test_app/backend/secrets"
+	"encoding/json"
+	"fmt"
+)
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// GetVaultHeader returns how the credentials' data key is protected, or nil
+// if credential encryption hasn't been set up yet
+func GetVaultHeader(db *sql.DB) (*secrets.Header, error) {
+	var header secrets.Header
+	err := db.QueryRow(`
+		SELECT key_source, key_version, salt, kdf_time, kdf_memory, kdf_threads, wrapped_key
+		FROM vault WHERE id = 1
+	`).Scan(&header.Source, &header.KeyVersion, &header.Salt, &header.Params.Time, &header.Params.Memory, &header.Params.Threads, &header.WrappedKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault header: %w", err)
+	}
+	return &header, nil
+}
+
+// SaveVaultHeader replaces the stored vault header
+func SaveVaultHeader(db execer, header *secrets.Header) error {
+	_, err := db.Exec(`
+		INSERT OR REPLACE INTO vault (id, key_source, key_version, salt, kdf_time, kdf_memory, kdf_threads, wrapped_key, updated_at)
+		VALUES (1, ?, ?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+	`, header.Source, header.KeyVersion, header.Salt, header.Params.Time, header.Params.Memory, header.Params.Threads, header.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("error saving vault header: %w", err)
+	}
+	return nil
+}
+
+// EncryptCredentials returns a copy of the account with its tokens and
+// password sealed for storage, bound to the account's email address
+func EncryptCredentials(vault *secrets.Vault, account auth.Account) (auth.Account, error) {
+	var err error
+	if account.OAuthAccessToken, err = vault.Encrypt("oauth_access_token", account.Email, account.OAuthAccessToken); err != nil {
+		return account, err
+	}
+	if account.OAuthRefreshToken, err = vault.Encrypt("oauth_refresh_token", account.Email, account.OAuthRefreshToken); err != nil {
+		return account, err
+	}
+	if account.AppSpecificPassword, err = vault.Encrypt("app_specific_password", account.Email, account.AppSpecificPassword); err != nil {
+		return account, err
+	}
+	return account, nil
+}
+
+// EncryptConnectionSettings serializes and seals the connection settings of
+// the account with the given email address, which may include a client
+// certificate key. The default settings are stored as an empty string.
+func EncryptConnectionSettings(vault *secrets.Vault, email string, settings mail.ConnectionSettings) (string, error) {
+	if settings == (mail.ConnectionSettings{}) {
+		return "", nil
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return "", err
+	}
+	return vault.Encrypt("connection_settings", email, string(data))
+}
+
+func decryptConnectionSettings(vault *secrets.Vault, email, value string) (mail.ConnectionSettings, error) {
+	var settings mail.ConnectionSettings
+	if value == "" {
+		return settings, nil
+	}
+	data, err := vault.Decrypt("connection_settings", email, value)
+	if err != nil {
+		return settings, err
+	}
+	err = json.Unmarshal([]byte(data), &settings)
+	return settings, err
+}
+
+func decryptCredentials(vault *secrets.Vault, account auth.Account) (auth.Account, error) {
+	var err error
+	if account.OAuthAccessToken, err = vault.Decrypt("oauth_access_token", account.Email, account.OAuthAccessToken); err != nil {
+		return account, err
+	}
+	if account.OAuthRefreshToken, err = vault.Decrypt("oauth_refresh_token", account.Email, account.OAuthRefreshToken); err != nil {
+		return account, err
+	}
+	if account.AppSpecificPassword, err = vault.Decrypt("app_specific_password", account.Email, account.AppSpecificPassword); err != nil {
+		return account, err
+	}
+	return account, nil
+}
+
+// ReencryptAccounts decrypts every account's credentials with from, encrypts
+// them again with to and stores header, all in one transaction. It is used
+// both to encrypt plaintext rows when encryption is first set up and to move
+// to a new data key.
+func ReencryptAccounts(db *sql.DB, from, to *secrets.Vault, header *secrets.Header) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, email, COALESCE(oauth_access_token, ''), COALESCE(oauth_refresh_token, ''), COALESCE(app_specific_password, ''), COALESCE(connection_settings, '')
+		FROM accounts
+	`)
+	if err != nil {
+		return fmt.Errorf("error retrieving accounts: %w", err)
+	}
+
+	type storedAccount struct {
+		auth.Account
+		connectionSettings string
+	}
+	var accounts []storedAccount
+	for rows.Next() {
+		var account storedAccount
+		if err := rows.Scan(&account.Id, &account.Email, &account.OAuthAccessToken, &account.OAuthRefreshToken, &account.AppSpecificPassword, &account.connectionSettings); err != nil {
+			rows.Close()
+			return fmt.Errorf("error scanning account row: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error retrieving accounts: %w", err)
+	}
+
+	for _, stored := range accounts {
+		account, err := decryptCredentials(from, stored.Account)
+		if err != nil {
+			return err
+		}
+		account, err = EncryptCredentials(to, account)
+		if err != nil {
+			return err
+		}
+
+		connectionSettings, err := from.Decrypt("connection_settings", account.Email, stored.connectionSettings)
+		if err != nil {
+			return err
+		}
+		connectionSettings, err = to.Encrypt("connection_settings", account.Email, connectionSettings)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(`
+			UPDATE accounts
+			SET oauth_access_token = ?, oauth_refresh_token = ?, app_specific_password = ?, connection_settings = ?
+			WHERE id = ?
+		`, account.OAuthAccessToken, account.OAuthRefreshToken, account.AppSpecificPassword, connectionSettings, account.Id)
+		if err != nil {
+			return fmt.Errorf("error updating account %d: %w", account.Id, err)
+		}
+	}
+
+	if err := SaveVaultHeader(tx, header); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UpgradeAccountEncryption seals credentials encrypted before they were bound
+// to their account again, so they can be read with Decrypt. It reports how
+// many accounts were upgraded.
+func UpgradeAccountEncryption(db *sql.DB, vault *secrets.Vault) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT id, email, COALESCE(oauth_access_token, ''), COALESCE(oauth_refresh_token, ''), COALESCE(app_specific_password, ''), COALESCE(connection_settings, '')
+		FROM accounts
+	`)
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving accounts: %w", err)
+	}
+
+	type storedValues struct {
+		id     int64
+		email  string
+		values [4]string
+	}
+	var accounts []storedValues
+	for rows.Next() {
+		var account storedValues
+		if err := rows.Scan(&account.id, &account.email, &account.values[0], &account.values[1], &account.values[2], &account.values[3]); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("error scanning account row: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("error retrieving accounts: %w", err)
+	}
+
+	fields := [4]string{"oauth_access_token", "oauth_refresh_token", "app_specific_password", "connection_settings"}
+	upgraded := 0
+	for _, account := range accounts {
+		changed := false
+		for i, field := range fields {
+			value, legacy, err := vault.UpgradeLegacy(field, account.email, account.values[i])
+			if err != nil {
+				return 0, fmt.Errorf("error upgrading account %d: %w", account.id, err)
+			}
+			account.values[i] = value
+			changed = changed || legacy
+		}
+		if !changed {
+			continue
+		}
+
+		_, err = tx.Exec(`
+			UPDATE accounts
+			SET oauth_access_token = ?, oauth_refresh_token = ?, app_specific_password = ?, connection_settings = ?
+			WHERE id = ?
+		`, account.values[0], account.values[1], account.values[2], account.values[3], account.id)
+		if err != nil {
+			return 0, fmt.Errorf("error updating account %d: %w", account.id, err)
+		}
+		upgraded++
+	}
+
+	return upgraded, tx.Commit()
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"email_test_app/backend/secrets"
+)
+
+func newTestVault(t *testing.T) (*secrets.Vault, []byte) {
+	t.Helper()
+
+	key, err := secrets.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault, err := secrets.NewVault(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vault, key
+}
+
+func insertAccount(t *testing.T, db *sql.DB, email, refreshToken, password, connectionSettings string) int64 {
+	t.Helper()
+
+	result, err := db.Exec(`
+		INSERT INTO accounts (email, imap_url, oauth_access_token, oauth_refresh_token, oauth_expiry, app_specific_password, connection_settings)
+		VALUES (?, 'imap.example.com:993', '', ?, 0, ?, ?)
+	`, email, refreshToken, password, connectionSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func storedValue(t *testing.T, db *sql.DB, id int64, column string) string {
+	t.Helper()
+
+	var value string
+	if err := db.QueryRow("SELECT COALESCE("+column+", '') FROM accounts WHERE id = ?", id).Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestReencryptAccounts(t *testing.T) {
+	db, err := InitDB(t.TempDir() + "/vault.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	alice := insertAccount(t, db, "alice@example.com", "alice-refresh", "", `{"security":"starttls"}`)
+	bob := insertAccount(t, db, "bob@example.com", "", "bob-password", "")
+
+	// plaintext rows are encrypted when encryption is set up
+	first, _ := newTestVault(t)
+	if err := ReencryptAccounts(db, first, first, secrets.NewKeystoreHeader(1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, column := range []string{"oauth_refresh_token", "connection_settings"} {
+		if value := storedValue(t, db, alice, column); !secrets.IsEncrypted(value) {
+			t.Errorf("%s is stored as %q, want it encrypted", column, value)
+		}
+	}
+	if value := storedValue(t, db, bob, "connection_settings"); value != "" {
+		t.Errorf("default connection settings are stored as %q, want an empty value", value)
+	}
+
+	// and moved to a new key on rotation
+	second, _ := newTestVault(t)
+	if err := ReencryptAccounts(db, first, second, secrets.NewKeystoreHeader(2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAccounts(db, first); err == nil {
+		t.Error("the old key still reads the accounts after rotation")
+	}
+
+	accounts, err := GetAccounts(db, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := accounts[alice].OAuthRefreshToken; got != "alice-refresh" {
+		t.Errorf("alice's refresh token is %q, want alice-refresh", got)
+	}
+	if got := accounts[alice].Connection.Security; got != "starttls" {
+		t.Errorf("alice's connection security is %q, want starttls", got)
+	}
+	if got := accounts[bob].AppSpecificPassword; got != "bob-password" {
+		t.Errorf("bob's password is %q, want bob-password", got)
+	}
+
+	header, err := GetVaultHeader(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header == nil || header.KeyVersion != 2 {
+		t.Errorf("got header %+v, want key version 2", header)
+	}
+}
+
+func TestCredentialsAreBoundToTheirAccount(t *testing.T) {
+	db, err := InitDB(t.TempDir() + "/vault.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	vault, _ := newTestVault(t)
+	alice := insertAccount(t, db, "alice@example.com", "", "alice-password", "")
+	bob := insertAccount(t, db, "bob@example.com", "", "bob-password", "")
+	if err := ReencryptAccounts(db, vault, vault, secrets.NewKeystoreHeader(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// copying one account's ciphertext over another's doesn't hand it the password
+	if _, err := db.Exec("UPDATE accounts SET app_specific_password = ? WHERE id = ?", storedValue(t, db, alice, "app_specific_password"), bob); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetAccounts(db, vault); err == nil {
+		t.Error("read an account with another account's password, want an error")
+	}
+}
+
+// sealLegacy encrypts a value the way it was stored before values were bound
+// to their account
+func sealLegacy(t *testing.T, key []byte, field, plaintext string) string {
+	t.Helper()
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(field))
+	return "enc:v1:" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestUpgradeAccountEncryption(t *testing.T) {
+	db, err := InitDB(t.TempDir() + "/vault.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	vault, key := newTestVault(t)
+	legacy := insertAccount(t, db, "alice@example.com",
+		sealLegacy(t, key, "oauth_refresh_token", "alice-refresh"), "",
+		sealLegacy(t, key, "connection_settings", `{"security":"tls"}`))
+	current := insertAccount(t, db, "bob@example.com", "", "bob-password", "")
+	if _, err := db.Exec("UPDATE accounts SET app_specific_password = ? WHERE id = ?", mustEncrypt(t, vault, "app_specific_password", "bob@example.com", "bob-password"), current); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := GetAccounts(db, vault); err == nil {
+		t.Fatal("read legacy values without upgrading them, want an error")
+	}
+
+	upgraded, err := UpgradeAccountEncryption(db, vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upgraded != 1 {
+		t.Errorf("upgraded %d accounts, want 1", upgraded)
+	}
+	if value := storedValue(t, db, legacy, "oauth_refresh_token"); strings.HasPrefix(value, "enc:v1:") {
+		t.Errorf("refresh token is still stored as %q", value)
+	}
+
+	accounts, err := GetAccounts(db, vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := accounts[legacy].OAuthRefreshToken; got != "alice-refresh" {
+		t.Errorf("alice's refresh token is %q, want alice-refresh", got)
+	}
+	if got := accounts[legacy].Connection.Security; got != "tls" {
+		t.Errorf("alice's connection security is %q, want tls", got)
+	}
+	if got := accounts[current].AppSpecificPassword; got != "bob-password" {
+		t.Errorf("bob's password is %q, want bob-password", got)
+	}
+
+	if upgraded, err := UpgradeAccountEncryption(db, vault); err != nil || upgraded != 0 {
+		t.Errorf("UpgradeAccountEncryption() = %d, %v on upgraded accounts, want 0, nil", upgraded, err)
+	}
+}
+
+func mustEncrypt(t *testing.T, vault *secrets.Vault, field, owner, plaintext string) string {
+	t.Helper()
+
+	value, err := vault.Encrypt(field, owner, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
@@ -0,0 +1,182 @@
+package discovery
+
+import (
+	"context"
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// maxConfigSize caps how much of an autoconfig response is read
+const maxConfigSize = 1 << 20
+
+// maxRedirects is how many redirects are followed to an autoconfig file, the
+// same as net/http's default
+const maxRedirects = 10
+
+// clientConfig is the Mozilla autoconfig format
+// (https://wiki.mozilla.org/Thunderbird:Autoconfiguration:ConfigFileFormat)
+type clientConfig struct {
+	EmailProvider struct {
+		ID              string         `xml:"id,attr"`
+		Domains         []string       `xml:"domain"`
+		IncomingServers []configServer `xml:"incomingServer"`
+		OutgoingServers []configServer `xml:"outgoingServer"`
+	} `xml:"emailProvider"`
+}
+
+type configServer struct {
+	Type       string `xml:"type,attr"`
+	Hostname   string `xml:"hostname"`
+	Port       int    `xml:"port"`
+	SocketType string `xml:"socketType"`
+	Username   string `xml:"username"`
+}
+
+func parseClientConfig(r io.Reader) (*clientConfig, error) {
+	var config clientConfig
+	if err := xml.NewDecoder(io.LimitReader(r, maxConfigSize)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("error parsing autoconfig: %w", err)
+	}
+	return &config, nil
+}
+
+// servers returns the IMAP and SMTP servers of the config with placeholders
+// filled in for addr, in the order the config lists them. Servers without TLS
+// are left out.
+func (c *clientConfig) servers(addr address, source Source) []Server {
+	var servers []Server
+	add := func(s configServer, protocol Protocol, priority int) {
+		security, ok := map[string]Security{
+			"SSL":      SecurityTLS,
+			"STARTTLS": SecurityStartTLS,
+		}[s.SocketType]
+		if !ok || s.Hostname == "" || s.Port == 0 {
+			return
+		}
+		servers = append(servers, Server{
+			Protocol: protocol,
+			Host:     expandPlaceholders(s.Hostname, addr),
+			Port:     s.Port,
+			Security: security,
+			Username: expandPlaceholders(s.Username, addr),
+			Source:   source,
+			priority: priority,
+		})
+	}
+
+	for i, s := range c.EmailProvider.IncomingServers {
+		if s.Type == "imap" {
+			add(s, ProtocolIMAP, i)
+		}
+	}
+	for i, s := range c.EmailProvider.OutgoingServers {
+		if s.Type == "smtp" {
+			add(s, ProtocolSMTP, i)
+		}
+	}
+	return servers
+}
+
+func expandPlaceholders(s string, addr address) string {
+	return strings.NewReplacer(
+		"%EMAILADDRESS%", addr.email,
+		"%EMAILLOCALPART%", addr.localPart,
+		"%EMAILDOMAIN%", addr.domain,
+	).Replace(s)
+}
+
+// lookupAutoconfig fetches the config the provider publishes on its
+// autoconfig subdomain
+func (d *Discoverer) lookupAutoconfig(ctx context.Context, addr address) ([]Server, error) {
+	u := fmt.Sprintf("https://autoconfig.%s/mail/config-v1.1.xml?emailaddress=%s", addr.domain, url.QueryEscape(addr.email))
+	return d.fetchConfig(ctx, u, addr, SourceAutoconfig)
+}
+
+// lookupWellKnown fetches the config from the domain's .well-known path
+func (d *Discoverer) lookupWellKnown(ctx context.Context, addr address) ([]Server, error) {
+	u := fmt.Sprintf("https://%s/.well-known/autoconfig/mail/config-v1.1.xml?emailaddress=%s", addr.domain, url.QueryEscape(addr.email))
+	return d.fetchConfig(ctx, u, addr, SourceWellKnown)
+}
+
+// fetchConfig only uses HTTPS, since a config fetched in plaintext could
+// point the user's password at any server. Redirects to plain HTTP are
+// refused for the same reason.
+func (d *Discoverer) fetchConfig(ctx context.Context, u string, addr address, source Source) ([]Server, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := *d.Client
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Scheme != "https" {
+			return fmt.Errorf("refusing redirect to insecure %s", req.URL.Redacted())
+		}
+		if len(via) >= maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxRedirects)
+		}
+		return nil
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s: %s", u, resp.Status)
+	}
+
+	config, err := parseClientConfig(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return config.servers(addr, source), nil
+}
+
+//go:embed ispdb/*.xml
+var ispdbFiles embed.FS
+
+var (
+	ispdb     map[string]*clientConfig
+	ispdbOnce sync.Once
+)
+
+// loadISPDB indexes the bundled configs by every domain they list
+func loadISPDB() map[string]*clientConfig {
+	ispdbOnce.Do(func() {
+		ispdb = make(map[string]*clientConfig)
+		entries, _ := ispdbFiles.ReadDir("ispdb")
+		for _, entry := range entries {
+			f, err := ispdbFiles.Open("ispdb/" + entry.Name())
+			if err != nil {
+				continue
+			}
+			config, err := parseClientConfig(f)
+			f.Close()
+			if err != nil {
+				continue
+			}
+			for _, domain := range config.EmailProvider.Domains {
+				ispdb[strings.ToLower(domain)] = config
+			}
+		}
+	})
+	return ispdb
+}
+
+// lookupISPDB looks the email domain up in the bundled ISPDB snapshot
+func lookupISPDB(ctx context.Context, addr address) ([]Server, error) {
+	config, ok := loadISPDB()[addr.domain]
+	if !ok {
+		return nil, nil
+	}
+	return config.servers(addr, SourceISPDB), nil
+}
@@ -0,0 +1,206 @@
+// Package discovery finds the IMAP and SMTP servers for an email address.
+//
+// Candidates are gathered from, in order of trust:
+//   - the provider's own Mozilla-style autoconfig file served over HTTPS
+//   - a bundled snapshot of Thunderbird's ISPDB
+//   - RFC 6186 SRV records
+//   - guesses based on the domain's MX records
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Protocol string
+
+const (
+	ProtocolIMAP Protocol = "imap"
+	ProtocolSMTP Protocol = "smtp"
+)
+
+// Security is how the connection to a server is secured. Servers that only
+// take plaintext connections are never suggested, since logging in to them
+// would send the password in the clear.
+type Security string
+
+const (
+	SecurityTLS      Security = "tls"
+	SecurityStartTLS Security = "starttls"
+)
+
+var (
+	// ErrInvalidAddress is returned for an address without a local part and
+	// a domain
+	ErrInvalidAddress = errors.New("invalid email address")
+	// ErrNotFound is returned when no source produced a server
+	ErrNotFound = errors.New("no servers found")
+)
+
+// Source is where a candidate came from, from most to least trusted
+type Source string
+
+const (
+	SourceAutoconfig Source = "autoconfig"
+	SourceWellKnown  Source = "well-known"
+	SourceISPDB      Source = "ispdb"
+	SourceSRV        Source = "srv"
+	SourceMX         Source = "mx"
+)
+
+var sourceRank = map[Source]int{
+	SourceAutoconfig: 0,
+	SourceWellKnown:  1,
+	SourceISPDB:      2,
+	SourceSRV:        3,
+	SourceMX:         4,
+}
+
+var securityRank = map[Security]int{
+	SecurityTLS:      0,
+	SecurityStartTLS: 1,
+}
+
+// Server is a candidate server for one protocol
+type Server struct {
+	Protocol Protocol `json:"protocol"`
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Security Security `json:"security"`
+	// Username is the login name, which is usually the email address
+	Username string `json:"username"`
+	Source   Source `json:"source"`
+
+	// priority orders candidates from the same source, lowest first
+	priority int
+}
+
+// Addr returns the server's address as host:port
+func (s Server) Addr() string {
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
+// Result holds the ranked candidates, best first
+type Result struct {
+	Imap []Server `json:"imap"`
+	Smtp []Server `json:"smtp"`
+}
+
+// Resolver is the part of *net.Resolver used for DNS lookups
+type Resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+}
+
+// Discoverer looks up server settings. Resolver and Client can be replaced
+// to point it at fake DNS and HTTP servers.
+type Discoverer struct {
+	Resolver Resolver
+	Client   *http.Client
+}
+
+// New returns a Discoverer that uses the system resolver and a plain HTTP
+// client with a timeout
+func New() *Discoverer {
+	return &Discoverer{
+		Resolver: net.DefaultResolver,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Discover queries every source at once and returns the ranked candidates.
+// An error is only returned if no source produced a server.
+func (d *Discoverer) Discover(ctx context.Context, emailAddr string) (*Result, error) {
+	at := strings.LastIndex(emailAddr, "@")
+	if at <= 0 || at == len(emailAddr)-1 {
+		return nil, fmt.Errorf("%w %q", ErrInvalidAddress, emailAddr)
+	}
+	domain := strings.ToLower(emailAddr[at+1:])
+	addr := address{email: emailAddr, localPart: emailAddr[:at], domain: domain}
+
+	lookups := []func(context.Context, address) ([]Server, error){
+		d.lookupAutoconfig,
+		d.lookupWellKnown,
+		lookupISPDB,
+		d.lookupSRV,
+		d.lookupMX,
+	}
+
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		servers []Server
+		errs    []error
+	)
+	for _, lookup := range lookups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			found, err := lookup(ctx, addr)
+			mu.Lock()
+			defer mu.Unlock()
+			servers = append(servers, found...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	result := rank(servers)
+	if len(result.Imap) == 0 && len(result.Smtp) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("%w for %s: %w", ErrNotFound, domain, errors.Join(errs...))
+		}
+		return nil, fmt.Errorf("%w for %s", ErrNotFound, domain)
+	}
+	return result, nil
+}
+
+// address is an email address split into the parts autoconfig files refer to
+type address struct {
+	email     string
+	localPart string
+	domain    string
+}
+
+// rank sorts candidates by source, then by their order within the source,
+// then by security, and drops duplicates of the same host and port
+func rank(servers []Server) *Result {
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if sourceRank[a.Source] != sourceRank[b.Source] {
+			return sourceRank[a.Source] < sourceRank[b.Source]
+		}
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return securityRank[a.Security] < securityRank[b.Security]
+	})
+
+	result := &Result{Imap: []Server{}, Smtp: []Server{}}
+	seen := make(map[string]bool)
+	for _, s := range servers {
+		key := string(s.Protocol) + " " + strings.ToLower(s.Addr())
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		switch s.Protocol {
+		case ProtocolIMAP:
+			result.Imap = append(result.Imap, s)
+		case ProtocolSMTP:
+			result.Smtp = append(result.Smtp, s)
+		}
+	}
+	return result
+}
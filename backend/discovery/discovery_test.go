@@ -0,0 +1,361 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeResolver answers SRV lookups by service label and MX lookups from mx;
+// anything else isn't found
+type fakeResolver struct {
+	srv map[string][]*net.SRV
+	mx  []*net.MX
+}
+
+func (r *fakeResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	records, ok := r.srv[service]
+	if !ok {
+		return "", nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return fmt.Sprintf("_%s._%s.%s.", service, proto, name), records, nil
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.mx == nil {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return r.mx, nil
+}
+
+// fakeWeb serves pages by host and path, over HTTPS for https URLs and over
+// plain HTTP for http ones, whatever host the URL names
+type fakeWeb struct {
+	pages map[string]http.HandlerFunc
+	// plainRequests counts requests made over plain HTTP
+	plainRequests atomic.Int32
+}
+
+func newFakeWeb(t *testing.T, pages map[string]http.HandlerFunc) (*fakeWeb, *http.Client) {
+	web := &fakeWeb{pages: pages}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := web.pages[r.Host+r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		page(w, r)
+	})
+
+	secure := httptest.NewTLSServer(handler)
+	t.Cleanup(secure.Close)
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		web.plainRequests.Add(1)
+		handler(w, r)
+	}))
+	t.Cleanup(plain.Close)
+
+	transport := secure.Client().Transport.(*http.Transport).Clone()
+	// the test certificate is only valid for example.com
+	transport.TLSClientConfig.ServerName = "example.com"
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		_, port, _ := net.SplitHostPort(addr)
+		target := secure.Listener.Addr().String()
+		if port == "80" {
+			target = plain.Listener.Addr().String()
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, target)
+	}
+
+	return web, &http.Client{Transport: transport}
+}
+
+// serveConfig serves an autoconfig file
+func serveConfig(config string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, config)
+	}
+}
+
+func redirectTo(url string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, url, http.StatusFound)
+	}
+}
+
+const exampleConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<clientConfig version="1.1">
+  <emailProvider id="example.org">
+    <domain>example.org</domain>
+    <incomingServer type="imap">
+      <hostname>imap.example.org</hostname>
+      <port>143</port>
+      <socketType>STARTTLS</socketType>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+    <incomingServer type="imap">
+      <hostname>imap.example.org</hostname>
+      <port>993</port>
+      <socketType>SSL</socketType>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+    <incomingServer type="imap">
+      <hostname>legacy.example.org</hostname>
+      <port>143</port>
+      <socketType>plain</socketType>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+    <incomingServer type="pop3">
+      <hostname>pop.example.org</hostname>
+      <port>995</port>
+      <socketType>SSL</socketType>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+    <outgoingServer type="smtp">
+      <hostname>smtp.example.org</hostname>
+      <port>587</port>
+      <socketType>STARTTLS</socketType>
+      <username>%EMAILLOCALPART%</username>
+    </outgoingServer>
+    <outgoingServer type="smtp">
+      <hostname>legacy.example.org</hostname>
+      <port>25</port>
+      <socketType>plain</socketType>
+      <username>%EMAILLOCALPART%</username>
+    </outgoingServer>
+  </emailProvider>
+</clientConfig>`
+
+// a config that only offers plaintext connections
+const plainConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<clientConfig version="1.1">
+  <emailProvider id="example.org">
+    <incomingServer type="imap">
+      <hostname>imap.example.org</hostname>
+      <port>143</port>
+      <socketType>plain</socketType>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+    <outgoingServer type="smtp">
+      <hostname>smtp.example.org</hostname>
+      <port>25</port>
+      <socketType>plain</socketType>
+      <username>%EMAILADDRESS%</username>
+    </outgoingServer>
+  </emailProvider>
+</clientConfig>`
+
+// a config pointing somewhere the user's password shouldn't go
+const attackerConfig = `<?xml version="1.0" encoding="UTF-8"?>
+<clientConfig version="1.1">
+  <emailProvider id="example.net">
+    <incomingServer type="imap">
+      <hostname>imap.attacker.example</hostname>
+      <port>993</port>
+      <socketType>SSL</socketType>
+      <username>%EMAILADDRESS%</username>
+    </incomingServer>
+  </emailProvider>
+</clientConfig>`
+
+// describe lists servers as "source host:port security username" to compare
+// them easily
+func describe(servers []Server) []string {
+	described := []string{}
+	for _, s := range servers {
+		described = append(described, fmt.Sprintf("%s %s %s %s", s.Source, s.Addr(), s.Security, s.Username))
+	}
+	return described
+}
+
+func discover(t *testing.T, resolver *fakeResolver, client *http.Client, emailAddr string) (*Result, error) {
+	t.Helper()
+	d := &Discoverer{Resolver: resolver, Client: client}
+	return d.Discover(context.Background(), emailAddr)
+}
+
+func assertServers(t *testing.T, name string, got []Server, want []string) {
+	t.Helper()
+	if described := describe(got); !reflect.DeepEqual(described, want) {
+		t.Errorf("got %s servers\n\t%q\nwant\n\t%q", name, described, want)
+	}
+}
+
+func TestDiscoverRanking(t *testing.T) {
+	_, client := newFakeWeb(t, map[string]http.HandlerFunc{
+		"autoconfig.example.org/mail/config-v1.1.xml": serveConfig(exampleConfig),
+		"example.org/.well-known/autoconfig/mail/config-v1.1.xml": serveConfig(`<clientConfig><emailProvider>
+			<incomingServer type="imap"><hostname>mail.example.org</hostname><port>993</port><socketType>SSL</socketType><username>%EMAILADDRESS%</username></incomingServer>
+		</emailProvider></clientConfig>`),
+	})
+	resolver := &fakeResolver{
+		srv: map[string][]*net.SRV{
+			"imaps": {
+				{Target: "imap.example.org.", Port: 993},
+				{Target: "srv.example.org.", Port: 993},
+			},
+			"submission":  {{Target: "smtp.example.org.", Port: 587}},
+			"submissions": {{Target: ".", Port: 0}},
+		},
+		mx: []*net.MX{{Host: "mx.example.org.", Pref: 10}},
+	}
+
+	result, err := discover(t, resolver, client, "user@Example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the autoconfig file's own order wins over security, the plaintext
+	// server is dropped, and hosts found again by a less trusted source keep
+	// their first place
+	assertServers(t, "IMAP", result.Imap, []string{
+		"autoconfig imap.example.org:143 starttls user@Example.org",
+		"autoconfig imap.example.org:993 tls user@Example.org",
+		"well-known mail.example.org:993 tls user@Example.org",
+		"srv srv.example.org:993 tls user@Example.org",
+	})
+	assertServers(t, "SMTP", result.Smtp, []string{
+		"autoconfig smtp.example.org:587 starttls user",
+		"mx smtp.example.org:465 tls user@Example.org",
+		"mx mail.example.org:465 tls user@Example.org",
+	})
+}
+
+func TestDiscoverFallback(t *testing.T) {
+	t.Run("ispdb", func(t *testing.T) {
+		_, client := newFakeWeb(t, nil)
+
+		result, err := discover(t, &fakeResolver{}, client, "user@gmail.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServers(t, "IMAP", result.Imap, []string{"ispdb imap.gmail.com:993 tls user@gmail.com"})
+		assertServers(t, "SMTP", result.Smtp, []string{"ispdb smtp.gmail.com:465 tls user@gmail.com"})
+	})
+
+	t.Run("broken autoconfig", func(t *testing.T) {
+		_, client := newFakeWeb(t, map[string]http.HandlerFunc{
+			"autoconfig.example.org/mail/config-v1.1.xml": serveConfig("<clientConfig><emailProvider>"),
+			"example.org/.well-known/autoconfig/mail/config-v1.1.xml": func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "oops", http.StatusInternalServerError)
+			},
+		})
+		resolver := &fakeResolver{srv: map[string][]*net.SRV{
+			"imaps":       {{Target: "imap.example.org.", Port: 993}},
+			"submissions": {{Target: "smtp.example.org.", Port: 465}},
+		}}
+
+		result, err := discover(t, resolver, client, "user@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServers(t, "IMAP", result.Imap, []string{"srv imap.example.org:993 tls user@example.org"})
+		assertServers(t, "SMTP", result.Smtp, []string{"srv smtp.example.org:465 tls user@example.org"})
+	})
+
+	t.Run("mx guesses", func(t *testing.T) {
+		_, client := newFakeWeb(t, nil)
+		resolver := &fakeResolver{mx: []*net.MX{{Host: "mx1.example.net.", Pref: 10}}}
+
+		result, err := discover(t, resolver, client, "user@example.net")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServers(t, "IMAP", result.Imap, []string{
+			"mx imap.example.net:993 tls user@example.net",
+			"mx mail.example.net:993 tls user@example.net",
+		})
+		assertServers(t, "SMTP", result.Smtp, []string{
+			"mx smtp.example.net:465 tls user@example.net",
+			"mx smtp.example.net:587 starttls user@example.net",
+			"mx mail.example.net:465 tls user@example.net",
+		})
+	})
+
+	t.Run("mx at known provider", func(t *testing.T) {
+		_, client := newFakeWeb(t, nil)
+		resolver := &fakeResolver{mx: []*net.MX{
+			{Host: "mx.example.net.", Pref: 5},
+			{Host: "aspmx.l.google.com.", Pref: 10},
+		}}
+
+		result, err := discover(t, resolver, client, "user@example.net")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServers(t, "IMAP", result.Imap, []string{"mx imap.gmail.com:993 tls user@example.net"})
+	})
+
+	t.Run("nothing found", func(t *testing.T) {
+		_, client := newFakeWeb(t, nil)
+
+		if result, err := discover(t, &fakeResolver{}, client, "user@example.net"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("got %+v, %v, want ErrNotFound", result, err)
+		}
+	})
+
+	t.Run("invalid address", func(t *testing.T) {
+		_, client := newFakeWeb(t, nil)
+
+		for _, emailAddr := range []string{"", "user", "@example.net", "user@"} {
+			if _, err := discover(t, &fakeResolver{}, client, emailAddr); !errors.Is(err, ErrInvalidAddress) {
+				t.Errorf("Discover(%q) got %v, want ErrInvalidAddress", emailAddr, err)
+			}
+		}
+	})
+}
+
+func TestDiscoverRejectsInsecure(t *testing.T) {
+	mx := []*net.MX{{Host: "mx.example.org.", Pref: 10}}
+
+	t.Run("redirect to http", func(t *testing.T) {
+		web, client := newFakeWeb(t, map[string]http.HandlerFunc{
+			"autoconfig.example.org/mail/config-v1.1.xml": redirectTo("http://autoconfig.example.org/config.xml"),
+			"autoconfig.example.org/config.xml":           serveConfig(attackerConfig),
+		})
+
+		result, err := discover(t, &fakeResolver{mx: mx}, client, "user@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertServers(t, "IMAP", result.Imap, []string{
+			"mx imap.example.org:993 tls user@example.org",
+			"mx mail.example.org:993 tls user@example.org",
+		})
+		if n := web.plainRequests.Load(); n != 0 {
+			t.Errorf("made %d requests over plain HTTP, want none", n)
+		}
+	})
+
+	t.Run("redirect to https", func(t *testing.T) {
+		_, client := newFakeWeb(t, map[string]http.HandlerFunc{
+			"autoconfig.example.org/mail/config-v1.1.xml": redirectTo("https://config.example.org/config.xml"),
+			"config.example.org/config.xml":               serveConfig(exampleConfig),
+		})
+
+		result, err := discover(t, &fakeResolver{}, client, "user@example.org")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Imap) == 0 || result.Imap[0].Source != SourceAutoconfig {
+			t.Errorf("got IMAP servers %q, want the redirected config's first", describe(result.Imap))
+		}
+	})
+
+	t.Run("plaintext servers", func(t *testing.T) {
+		_, client := newFakeWeb(t, map[string]http.HandlerFunc{
+			"autoconfig.example.org/mail/config-v1.1.xml": serveConfig(plainConfig),
+		})
+
+		if result, err := discover(t, &fakeResolver{}, client, "user@example.org"); err == nil {
+			t.Fatalf("got %+v, want an error since no server offers TLS", result)
+		}
+	})
+}
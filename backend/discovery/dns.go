@@ -0,0 +1,101 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// srvServices are the RFC 6186 and RFC 8314 service labels
+var srvServices = []struct {
+	service  string
+	protocol Protocol
+	security Security
+}{
+	{"imaps", ProtocolIMAP, SecurityTLS},
+	{"imap", ProtocolIMAP, SecurityStartTLS},
+	{"submissions", ProtocolSMTP, SecurityTLS},
+	{"submission", ProtocolSMTP, SecurityStartTLS},
+}
+
+// lookupSRV finds servers published in SRV records
+func (d *Discoverer) lookupSRV(ctx context.Context, addr address) ([]Server, error) {
+	var servers []Server
+	for _, svc := range srvServices {
+		// net.LookupSRV already sorts by priority and randomizes by weight
+		_, records, err := d.Resolver.LookupSRV(ctx, svc.service, "tcp", addr.domain)
+		if err != nil {
+			continue
+		}
+		for i, record := range records {
+			host := strings.TrimSuffix(record.Target, ".")
+			// a target of "." means the service is not offered
+			if host == "" {
+				continue
+			}
+			servers = append(servers, Server{
+				Protocol: svc.protocol,
+				Host:     host,
+				Port:     int(record.Port),
+				Security: svc.security,
+				Username: addr.email,
+				Source:   SourceSRV,
+				priority: i,
+			})
+		}
+	}
+	return servers, nil
+}
+
+// lookupMX guesses servers from the domain's mail exchangers. Domains hosted
+// by a known provider (such as Google Workspace or Microsoft 365) are found by
+// looking the MX host's domain up in the ISPDB; otherwise the usual host
+// names under the email domain are suggested.
+func (d *Discoverer) lookupMX(ctx context.Context, addr address) ([]Server, error) {
+	records, err := d.Resolver.LookupMX(ctx, addr.domain)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up MX records for %s: %w", addr.domain, err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+
+	db := loadISPDB()
+	for _, record := range records {
+		host := strings.ToLower(strings.TrimSuffix(record.Host, "."))
+		if config, ok := db[baseDomain(host)]; ok {
+			return config.servers(addr, SourceMX), nil
+		}
+	}
+
+	var servers []Server
+	guess := func(protocol Protocol, host string, port int, security Security, priority int) {
+		servers = append(servers, Server{
+			Protocol: protocol,
+			Host:     host,
+			Port:     port,
+			Security: security,
+			Username: addr.email,
+			Source:   SourceMX,
+			priority: priority,
+		})
+	}
+	guess(ProtocolIMAP, "imap."+addr.domain, 993, SecurityTLS, 0)
+	guess(ProtocolIMAP, "mail."+addr.domain, 993, SecurityTLS, 1)
+	guess(ProtocolSMTP, "smtp."+addr.domain, 465, SecurityTLS, 0)
+	guess(ProtocolSMTP, "smtp."+addr.domain, 587, SecurityStartTLS, 0)
+	guess(ProtocolSMTP, "mail."+addr.domain, 465, SecurityTLS, 1)
+
+	return servers, nil
+}
+
+// baseDomain returns the last two labels of a host name. It is only used to
+// match MX hosts against the ISPDB, so public suffixes like co.uk don't
+// matter much.
+func baseDomain(host string) string {
+	labels := strings.Split(host, ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
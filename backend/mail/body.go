@@ -2,19 +2,33 @@ package mail
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"mime"
-	"mime/multipart"
 	"mime/quotedprintable"
-	"net/mail"
-	"net/textproto"
+	"os"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// BODY_CHUNK_SIZE is how much of a part is fetched per command. go-imap
+	// reads every response into memory whole, so large parts are fetched in
+	// pieces to keep only one piece in memory at a time.
+	BODY_CHUNK_SIZE = 1 << 20
+	// BODY_MEMORY_LIMIT is how much of a decoded part is buffered in memory
+	// while it is fetched; the rest is spooled to a temporary file
+	BODY_MEMORY_LIMIT = 1 << 20
+	// BODY_MAX_TEXT is the longest text kept of a part; longer parts are cut
+	// off and the rest isn't fetched
+	BODY_MAX_TEXT = 16 << 20
 )
 
 type EmailBody struct {
@@ -22,16 +36,54 @@ type EmailBody struct {
 	HTML  string `json:"html"`
 }
 
-func FetchEmailBody(c *client.Client, uid uint32) (EmailBody, error) {
+// BodyLimits bound the memory used to fetch a message body. The zero value of
+// a field means its default.
+type BodyLimits struct {
+	ChunkSize   int
+	MemoryLimit int64
+	MaxText     int64
+}
+
+func (l BodyLimits) withDefaults() BodyLimits {
+	if l.ChunkSize <= 0 {
+		l.ChunkSize = BODY_CHUNK_SIZE
+	}
+	if l.MemoryLimit <= 0 {
+		l.MemoryLimit = BODY_MEMORY_LIMIT
+	}
+	if l.MaxText <= 0 {
+		l.MaxText = BODY_MAX_TEXT
+	}
+	return l
+}
+
+// FetchEmailBody fetches and decodes the body of a message in the selected
+// mailbox with the default limits
+func FetchEmailBody(ctx context.Context, c *client.Client, uid uint32) (EmailBody, error) {
+	return FetchEmailBodyWithLimits(ctx, c, uid, BodyLimits{})
+}
+
+// FetchEmailBodyWithLimits fetches and decodes the body of a message in the
+// selected mailbox. Only the first text/plain and text/html parts are
+// fetched, as found in the message's BODYSTRUCTURE, so attachments are never
+// downloaded. Parts are fetched in chunks and decoded as they stream in.
+func FetchEmailBodyWithLimits(ctx context.Context, c *client.Client, uid uint32, limits BodyLimits) (EmailBody, error) {
+	var body EmailBody
+	err := interruptible(ctx, c, func() error {
+		var err error
+		body, err = fetchEmailBody(c, uid, limits.withDefaults())
+		return err
+	})
+	return body, err
+}
+
+func fetchEmailBody(c *client.Client, uid uint32, limits BodyLimits) (EmailBody, error) {
 	log.Println("Fetching email body for UID:", uid)
 	seqSet := new(imap.SeqSet)
 	seqSet.AddNum(uid)
 
-	section := &imap.BodySectionName{}
-	items := []imap.FetchItem{section.FetchItem()}
-
 	messages := make(chan *imap.Message, 1)
-	err := c.UidFetch(seqSet, items, messages)
+	err := c.UidFetch(seqSet, []imap.FetchItem{imap.FetchBodyStructure}, messages)
 	if err != nil {
 		log.Printf("UidFetch error: %v\n", err)
 		return EmailBody{}, err
@@ -40,121 +92,396 @@ func FetchEmailBody(c *client.Client, uid uint32) (EmailBody, error) {
 	msg := <-messages
 	if msg == nil {
 		log.Println("Server didn't return message")
-		return EmailBody{}, fmt.Errorf("server didn't return message")
+		// the message was deleted or moved since it was listed
+		return EmailBody{}, NewError(ErrorNotFound, fmt.Errorf("server didn't return message %d", uid))
 	}
-
-	r := msg.GetBody(section)
-	if r == nil {
-		return EmailBody{}, fmt.Errorf("server didn't return message body")
+	if msg.BodyStructure == nil {
+		return EmailBody{}, fmt.Errorf("server didn't return the structure of message %d", uid)
 	}
 
-	emailMsg, err := mail.ReadMessage(r)
-	if err != nil {
-		log.Println("Error parsing email message:", err)
-		return EmailBody{}, err
-	}
+	plain, htmlPart := findTextParts(msg.BodyStructure)
 
-	body, err := extractEmailBody(emailMsg)
-	if err != nil {
-		log.Println("Error extracting email body:", err)
-		return EmailBody{}, err
+	var body EmailBody
+	if plain != nil {
+		if body.Plain, err = fetchTextPart(c, uid, *plain, false, limits); err != nil {
+			return EmailBody{}, err
+		}
+	}
+	if htmlPart != nil {
+		if body.HTML, err = fetchTextPart(c, uid, *htmlPart, false, limits); err != nil {
+			return EmailBody{}, err
+		}
 	}
 
 	return body, nil
 }
 
-func extractEmailBody(msg *mail.Message) (EmailBody, error) {
-	contentType := msg.Header.Get("Content-Type")
-	mediaType, params, err := mime.ParseMediaType(contentType)
-	if err != nil {
-		log.Printf("Error parsing media type: %v\n", err)
-		// Default to text/plain if Content-Type is missing or invalid
-		mediaType = "text/plain"
-	}
+// FetchEmailBodies fetches the bodies of several messages in the selected
+// mailbox without marking them as read. The structures of all of them are
+// fetched in one UID FETCH, then the text parts of all messages with the same
+// layout in another; parts larger than a chunk are fetched on their own like
+// FetchEmailBody does. Messages the server doesn't return are left out.
+func FetchEmailBodies(ctx context.Context, c *client.Client, uids []uint32, limits BodyLimits) (map[uint32]EmailBody, error) {
+	var bodies map[uint32]EmailBody
+	err := interruptible(ctx, c, func() error {
+		var err error
+		bodies, err = fetchEmailBodies(c, uids, limits.withDefaults())
+		return err
+	})
+	return bodies, err
+}
 
-	log.Println("Extracting Email Body")
+// bodyPart is a text part to fetch for EmailBody.Plain or, if html is set,
+// EmailBody.HTML
+type bodyPart struct {
+	textPart
+	html bool
+}
 
-	var emailBody EmailBody
+func fetchEmailBodies(c *client.Client, uids []uint32, limits BodyLimits) (map[uint32]EmailBody, error) {
+	bodies := make(map[uint32]EmailBody)
+	if len(uids) == 0 {
+		return bodies, nil
+	}
 
-	if strings.HasPrefix(mediaType, "multipart/") {
-		log.Println("Multipart message found: ", mediaType)
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
 
-		boundary := params["boundary"]
-		if boundary == "" {
-			return EmailBody{}, fmt.Errorf("no boundary found for multipart message")
+	structures := make(map[uint32]*imap.BodyStructure)
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchBodyStructure}, messages)
+	}()
+	for msg := range messages {
+		if msg.BodyStructure != nil {
+			structures[msg.Uid] = msg.BodyStructure
 		}
-		mr := multipart.NewReader(msg.Body, boundary)
-		for {
-			p, err := mr.NextPart()
-			if err == io.EOF {
-				break
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	// messages whose small text parts are at the same paths are fetched
+	// together; each message's parts line up with the group's sections
+	type group struct {
+		sections []*imap.BodySectionName
+		uids     []uint32
+		parts    map[uint32][]bodyPart
+	}
+	groups := make(map[string]*group)
+	large := make(map[uint32][]bodyPart)
+
+	for uid, bs := range structures {
+		bodies[uid] = EmailBody{}
+
+		var small []bodyPart
+		addPart := func(found *textPart, html bool) {
+			if found == nil {
+				return
 			}
-			if err != nil {
-				return EmailBody{}, err
+			part := bodyPart{*found, html}
+			if int64(found.structure.Size) > int64(limits.ChunkSize) {
+				large[uid] = append(large[uid], part)
+			} else {
+				small = append(small, part)
 			}
+		}
+		plain, htmlPart := findTextParts(bs)
+		addPart(plain, false)
+		addPart(htmlPart, true)
+		if len(small) == 0 {
+			continue
+		}
 
-			partMediaType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
-			content, err := decodeEmailPart(p)
-			if err != nil {
+		var sections []*imap.BodySectionName
+		var key []string
+		for _, part := range small {
+			section := &imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: part.path}, Peek: true}
+			sections = append(sections, section)
+			key = append(key, string(section.FetchItem()))
+		}
+		g, ok := groups[strings.Join(key, " ")]
+		if !ok {
+			g = &group{sections: sections, parts: make(map[uint32][]bodyPart)}
+			groups[strings.Join(key, " ")] = g
+		}
+		g.uids = append(g.uids, uid)
+		g.parts[uid] = small
+	}
+
+	setPart := func(uid uint32, part bodyPart, text string) {
+		body := bodies[uid]
+		if part.html {
+			body.HTML = text
+		} else {
+			body.Plain = text
+		}
+		bodies[uid] = body
+	}
+
+	for _, g := range groups {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(g.uids...)
+
+		items := []imap.FetchItem{imap.FetchUid}
+		for _, section := range g.sections {
+			items = append(items, section.FetchItem())
+		}
+
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqSet, items, messages)
+		}()
+
+		for msg := range messages {
+			parts, ok := g.parts[msg.Uid]
+			if !ok {
 				continue
 			}
-
-			switch {
-			case strings.Contains(partMediaType, "text/html"):
-				emailBody.HTML = content
-			case strings.Contains(partMediaType, "text/plain"):
-				emailBody.Plain = content
+			for i, section := range g.sections {
+				r := msg.GetBody(section)
+				if r == nil {
+					continue
+				}
+				text, err := decodeTextPart(r, parts[i].structure, limits)
+				if err != nil {
+					log.Println("Error decoding part", parts[i].path, "of UID", msg.Uid, ":", err)
+					continue
+				}
+				setPart(msg.Uid, parts[i], text)
 			}
 		}
-	} else {
-		// Single-part message
-		content, err := decodeEmailPart(msg.Body)
-		if err != nil {
-			return EmailBody{}, err
+
+		if err := <-done; err != nil {
+			return bodies, err
 		}
-		if mediaType == "text/html" {
-			emailBody.HTML = content
-		} else {
-			emailBody.Plain = content
+	}
+
+	for uid, parts := range large {
+		for _, part := range parts {
+			text, err := fetchTextPart(c, uid, part.textPart, true, limits)
+			if err != nil {
+				return bodies, err
+			}
+			setPart(uid, part, text)
 		}
 	}
 
-	return emailBody, nil
+	return bodies, nil
+}
+
+// fetchTextPart streams a text part from the server in chunks and decodes it.
+// A part that can't be decoded is logged and returned empty; errors talking
+// to the server are returned. Unless peek is set, fetching it marks the
+// message as read.
+func fetchTextPart(c *client.Client, uid uint32, part textPart, peek bool, limits BodyLimits) (string, error) {
+	r := &partReader{
+		c:         c,
+		uid:       uid,
+		section:   imap.BodySectionName{BodyPartName: imap.BodyPartName{Path: part.path}, Peek: peek},
+		size:      int(part.structure.Size),
+		chunkSize: limits.ChunkSize,
+	}
+
+	text, err := decodeTextPart(r, part.structure, limits)
+	if r.err != nil {
+		return "", r.err
+	}
+	if err != nil {
+		log.Println("Error decoding part", part.path, "of UID", uid, ":", err)
+		return "", nil
+	}
+	return text, nil
 }
 
-func decodeEmailPart(part io.Reader) (string, error) {
-	var buf bytes.Buffer
-	_, err := buf.ReadFrom(part)
+// decodeTextPart streams the raw content of a text part through its transfer
+// encoding and charset decoders into a spool, and returns at most
+// limits.MaxText bytes of it
+func decodeTextPart(r io.Reader, part *imap.BodyStructure, limits BodyLimits) (string, error) {
+	decoded := transferDecoder(r, part.Encoding)
+	if cs := part.Params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") && !strings.EqualFold(cs, "us-ascii") {
+		if cr, err := charset.NewReaderLabel(cs, decoded); err == nil {
+			decoded = cr
+		} else {
+			log.Println("Unknown charset", cs, ":", err)
+		}
+	}
+
+	s := &spool{limit: limits.MemoryLimit}
+	defer s.Close()
+
+	// one byte more than is kept tells whether the part was cut off
+	n, err := io.Copy(s, io.LimitReader(decoded, limits.MaxText+1))
 	if err != nil {
 		return "", err
 	}
 
-	content := buf.Bytes()
+	text, err := s.String(limits.MaxText)
+	if err != nil {
+		return "", fmt.Errorf("error reading spooled part: %w", err)
+	}
+	if n > limits.MaxText {
+		log.Println("Text part cut off at", limits.MaxText, "bytes")
+		text = trimPartialRune(text)
+	}
+	return text, nil
+}
+
+// partReader reads a body part from the server in chunks of at most
+// chunkSize bytes, fetching the next chunk once the previous one is used up
+type partReader struct {
+	c         *client.Client
+	uid       uint32
+	section   imap.BodySectionName
+	size      int // from BODYSTRUCTURE; 0 if unknown
+	chunkSize int
 
-	// Handle Content-Transfer-Encoding
-	var decodedContent []byte
+	offset int
+	chunk  []byte
+	eof    bool
+	// err is the error fetching a chunk, kept apart from decoding errors
+	err error
+}
 
-	encoding := "7bit" // Default encoding
-	if header, ok := part.(interface{ Header() textproto.MIMEHeader }); ok {
-		encoding = header.Header().Get("Content-Transfer-Encoding")
+func (r *partReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		if r.err = r.fetch(); r.err != nil {
+			return 0, r.err
+		}
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *partReader) fetch() error {
+	section := r.section
+	section.Partial = []int{r.offset, r.chunkSize}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(r.uid)
+
+	messages := make(chan *imap.Message, 1)
+	if err := r.c.UidFetch(seqSet, []imap.FetchItem{section.FetchItem()}, messages); err != nil {
+		return err
+	}
+
+	msg := <-messages
+	if msg == nil {
+		return NewError(ErrorNotFound, fmt.Errorf("server didn't return message %d", r.uid))
+	}
+
+	literal := msg.GetBody(&section)
+	if literal == nil {
+		r.eof = true
+		return nil
+	}
+	chunk := make([]byte, literal.Len())
+	if _, err := io.ReadFull(literal, chunk); err != nil {
+		return err
 	}
 
+	r.offset += len(chunk)
+	r.chunk = chunk
+	if len(chunk) < r.chunkSize || (r.size > 0 && r.offset >= r.size) {
+		r.eof = true
+	}
+	return nil
+}
+
+// transferDecoder undoes a Content-Transfer-Encoding as the content is read
+func transferDecoder(r io.Reader, encoding string) io.Reader {
 	switch strings.ToLower(encoding) {
 	case "base64":
-		decodedContent, err = base64.StdEncoding.DecodeString(string(content))
-		if err != nil {
-			return "", err
-		}
+		// the decoder skips the line breaks itself
+		return base64.NewDecoder(base64.StdEncoding, r)
 	case "quoted-printable":
-		reader := quotedprintable.NewReader(bytes.NewReader(content))
-		decodedContent, err = io.ReadAll(reader)
-		if err != nil {
-			return "", err
-		}
+		return quotedprintable.NewReader(r)
 	default:
 		// 7bit, 8bit, binary, or unknown encodings
-		decodedContent = content
+		return r
+	}
+}
+
+// spool buffers what is written to it in memory up to limit bytes, then moves
+// it to a temporary file, so decoding a large part doesn't hold every
+// intermediate copy in memory at once
+type spool struct {
+	limit int64
+	buf   bytes.Buffer
+	file  *os.File
+	size  int64
+}
+
+func (s *spool) Write(p []byte) (int, error) {
+	if s.file == nil && int64(s.buf.Len()+len(p)) > s.limit {
+		file, err := os.CreateTemp("", "mail-part-*")
+		if err != nil {
+			return 0, err
+		}
+		s.file = file
+		if _, err := s.buf.WriteTo(s.file); err != nil {
+			return 0, err
+		}
+		s.buf = bytes.Buffer{}
+	}
+
+	var n int
+	var err error
+	if s.file != nil {
+		n, err = s.file.Write(p)
+	} else {
+		n, err = s.buf.Write(p)
+	}
+	s.size += int64(n)
+	return n, err
+}
+
+// String returns up to max bytes of what was written, allocating the result
+// once
+func (s *spool) String(max int64) (string, error) {
+	size := min(s.size, max)
+	if s.file == nil {
+		return string(s.buf.Bytes()[:size]), nil
+	}
+
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return "", err
 	}
+	var sb strings.Builder
+	sb.Grow(int(size))
+	if _, err := io.Copy(&sb, io.LimitReader(s.file, size)); err != nil {
+		return "", err
+	}
+	return sb.String(), nil
+}
+
+// Close removes the temporary file, if any
+func (s *spool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	name := s.file.Name()
+	err := errors.Join(s.file.Close(), os.Remove(name))
+	s.file = nil
+	return err
+}
 
-	return string(decodedContent), nil
+// trimPartialRune drops the incomplete UTF-8 sequence that cutting text off
+// may leave at its end
+func trimPartialRune(s string) string {
+	for i := 0; i < utf8.UTFMax-1 && len(s) > 0; i++ {
+		r, size := utf8.DecodeLastRuneInString(s)
+		if r != utf8.RuneError || size != 1 {
+			break
+		}
+		s = s[:len(s)-1]
+	}
+	return s
 }
@@ -0,0 +1,318 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+)
+
+// imapServerEnv makes the test binary run an in-memory IMAP server instead of
+// the tests, so the server's allocations don't count towards the client's
+const imapServerEnv = "MAIL_TEST_IMAP_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(imapServerEnv) != "" {
+		serveMemoryIMAP()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// serveMemoryIMAP prints the address of an in-memory IMAP server and serves
+// it until the parent test closes stdin
+func serveMemoryIMAP() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	s := server.New(memory.New())
+	s.AllowInsecureAuth = true
+	go s.Serve(l)
+
+	fmt.Println(l.Addr())
+	bufio.NewReader(os.Stdin).ReadString('\n')
+}
+
+// dialMemoryIMAP starts an in-memory IMAP server in a child process and
+// returns a client logged in to it
+func dialMemoryIMAP(t *testing.T) *client.Client {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), imapServerEnv+"=1")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := client.Dial(strings.TrimSpace(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout() })
+	if err := c.Login("username", "password"); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// appendLargeMessage adds a message with a text part of textSize bytes and a
+// base64 attachment of attachmentSize bytes to INBOX, selects INBOX and
+// returns the message's UID
+func appendLargeMessage(t *testing.T, c *client.Client, textSize, attachmentSize int) (uint32, string) {
+	t.Helper()
+
+	line := "The quick brown fox jumps over the lazy dog.\r\n"
+	text := strings.Repeat(line, textSize/len(line))
+
+	encoded := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{0xAB}, attachmentSize))
+	var attachment strings.Builder
+	for i := 0; i < len(encoded); i += 76 {
+		attachment.WriteString(encoded[i:min(i+76, len(encoded))] + "\r\n")
+	}
+
+	msg := "Subject: Large message\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/mixed; boundary=BOUNDARY\r\n" +
+		"\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		text + "\r\n" +
+		"--BOUNDARY\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"\r\n" +
+		attachment.String() +
+		"--BOUNDARY--\r\n"
+
+	if err := c.Append("INBOX", nil, time.Now(), strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	mbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mbox.UidNext - 1, text
+}
+
+// allocatedBytes returns how many bytes fn allocates
+func allocatedBytes(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// TestFetchEmailBodyBoundedMemory checks that fetching the text of a large
+// message allocates in proportion to the text kept, not to the size of the
+// message or of the text part
+func TestFetchEmailBodyBoundedMemory(t *testing.T) {
+	c := dialMemoryIMAP(t)
+
+	const (
+		textSize       = 4 << 20
+		attachmentSize = 20 << 20
+	)
+	uid, text := appendLargeMessage(t, c, textSize, attachmentSize)
+
+	t.Run("whole text", func(t *testing.T) {
+		limits := BodyLimits{ChunkSize: 256 << 10, MemoryLimit: 256 << 10}
+
+		var body EmailBody
+		var err error
+		allocated := allocatedBytes(func() {
+			body, err = FetchEmailBodyWithLimits(context.Background(), c, uid, limits)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Plain != text {
+			t.Fatalf("got %d bytes of text, want %d", len(body.Plain), len(text))
+		}
+
+		t.Logf("allocated %d KiB", allocated>>10)
+
+		// the text itself, the spool file read back, and the chunks
+		if max := uint64(3*textSize + 16*limits.ChunkSize); allocated > max {
+			t.Errorf("allocated %d KiB for a %d KiB text part, want at most %d KiB", allocated>>10, textSize>>10, max>>10)
+		}
+	})
+
+	t.Run("cut off", func(t *testing.T) {
+		limits := BodyLimits{ChunkSize: 256 << 10, MemoryLimit: 256 << 10, MaxText: 512 << 10}
+
+		var body EmailBody
+		var err error
+		allocated := allocatedBytes(func() {
+			body, err = FetchEmailBodyWithLimits(context.Background(), c, uid, limits)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(len(body.Plain)) != limits.MaxText {
+			t.Fatalf("got %d bytes of text, want %d", len(body.Plain), limits.MaxText)
+		}
+
+		t.Logf("allocated %d KiB", allocated>>10)
+
+		// only the chunks up to MaxText are fetched, each read once by the
+		// IMAP client and copied once, whatever the size of the part
+		if max := uint64(2*limits.MaxText + 8*int64(limits.ChunkSize)); allocated > max {
+			t.Errorf("allocated %d KiB keeping %d KiB of text, want at most %d KiB", allocated>>10, limits.MaxText>>10, max>>10)
+		}
+	})
+}
+
+func TestFetchEmailBodies(t *testing.T) {
+	c := dialMemoryIMAP(t)
+
+	large := strings.Repeat("A line of a long message.\r\n", 100)
+	messages := []struct {
+		flags []string
+		raw   string
+		want  EmailBody
+	}{
+		{
+			raw: "Subject: Plain\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"Just text.",
+			want: EmailBody{Plain: "Just text."},
+		},
+		{
+			flags: []string{imap.SeenFlag},
+			raw: "Subject: Alternative\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/alternative; boundary=ALT\r\n" +
+				"\r\n" +
+				"--ALT\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"Caf=C3=A9 at noon\r\n" +
+				"--ALT\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"\r\n" +
+				"<p>Café at noon</p>\r\n" +
+				"--ALT--\r\n",
+			want: EmailBody{Plain: "Café at noon", HTML: "<p>Café at noon</p>"},
+		},
+		{
+			raw: "Subject: Mixed\r\n" +
+				"MIME-Version: 1.0\r\n" +
+				"Content-Type: multipart/mixed; boundary=MIX\r\n" +
+				"\r\n" +
+				"--MIX\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				"See attached.\r\n" +
+				"--MIX\r\n" +
+				"Content-Type: application/octet-stream\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				"q6urq6urq6urq6ur\r\n" +
+				"--MIX--\r\n",
+			want: EmailBody{Plain: "See attached."},
+		},
+		{
+			// larger than a chunk, so fetched on its own
+			raw: "Subject: Long\r\n" +
+				"Content-Type: text/plain; charset=utf-8\r\n" +
+				"\r\n" +
+				large,
+			want: EmailBody{Plain: large},
+		},
+	}
+	for _, msg := range messages {
+		if err := c.Append("INBOX", msg.flags, time.Now(), strings.NewReader(msg.raw)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mbox, err := c.Select("INBOX", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstUID := mbox.UidNext - uint32(len(messages))
+
+	uids := []uint32{mbox.UidNext} // not in the mailbox
+	for i := range messages {
+		uids = append(uids, firstUID+uint32(i))
+	}
+	var traffic bytes.Buffer
+	c.SetDebug(&traffic)
+	bodies, err := FetchEmailBodies(context.Background(), c, uids, BodyLimits{ChunkSize: 1024})
+	c.SetDebug(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bodies) != len(messages) {
+		t.Errorf("got %d bodies, want %d", len(bodies), len(messages))
+	}
+	for i, msg := range messages {
+		body, ok := bodies[firstUID+uint32(i)]
+		if !ok {
+			t.Errorf("message %d: no body", i)
+			continue
+		}
+		if body.Plain != msg.want.Plain || body.HTML != msg.want.HTML {
+			t.Errorf("message %d: got %+v, want %+v", i, body, msg.want)
+		}
+	}
+
+	// fetching doesn't mark anything as read. The in-memory server never sets
+	// \Seen by itself, so the commands are checked to only peek as well.
+	for _, line := range strings.Split(traffic.String(), "\r\n") {
+		if strings.Contains(line, " UID FETCH ") && strings.Contains(line, "BODY[") {
+			t.Errorf("fetched a section without peeking: %s", line)
+		}
+	}
+	seqSet := new(imap.SeqSet)
+	seqSet.AddRange(firstUID, firstUID+uint32(len(messages))-1)
+	fetched := make(chan *imap.Message, len(messages))
+	if err := c.UidFetch(seqSet, []imap.FetchItem{imap.FetchUid, imap.FetchFlags}, fetched); err != nil {
+		t.Fatal(err)
+	}
+	for m := range fetched {
+		i := m.Uid - firstUID
+		seen := slices.Contains(m.Flags, imap.SeenFlag)
+		if wantSeen := slices.Contains(messages[i].flags, imap.SeenFlag); seen != wantSeen {
+			t.Errorf("message %d: seen is %v after fetching its body, want %v", i, seen, wantSeen)
+		}
+	}
+}
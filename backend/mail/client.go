@@ -4,19 +4,60 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
+	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
-	"golang.org/x/oauth2"
 )
 
+const (
+	// DIAL_TIMEOUT bounds connecting, the TLS handshake and waiting for the
+	// server's greeting
+	DIAL_TIMEOUT = 30 * time.Second
+	// COMMAND_TIMEOUT bounds a single IMAP command, so a server that stops
+	// answering can't block forever. The deadline of the last command stays
+	// on the socket, so it is also how long a connection can sit idle; it
+	// matches POOL_IDLE_TIMEOUT.
+	COMMAND_TIMEOUT = 5 * time.Minute
+)
+
+// ErrAuthFailed is returned when the server rejects an account's credentials,
+// as opposed to the connection failing
+var ErrAuthFailed = errors.New("authentication failed")
+
+// authError marks err as an authentication failure if the server answered
+// the login command instead of dropping the connection
+func authError(c *client.Client, err error) error {
+	if c.State() == imap.LogoutState {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrAuthFailed, err)
+}
+
+// interruptible runs fn, which uses c, and closes the connection if ctx is
+// done first so the command in progress fails. The context's error is
+// returned in that case; the connection can't be used anymore.
+func interruptible(ctx context.Context, c *client.Client, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+
+	stop := context.AfterFunc(ctx, func() { c.Terminate() })
+	err := fn()
+	if !stop() {
+		return context.Cause(ctx)
+	}
+	return err
+}
+
 // WithClient is a wrapper function that creates a new IMAP client and executes the provided function
-func WithClient(imapUrl, emailAddr, emailAppPassword string, fn func(c *client.Client) error) error {
-	c, err := GetClient(imapUrl, emailAddr, emailAppPassword)
+func WithClient(ctx context.Context, imapUrl string, settings ConnectionSettings, emailAddr, emailAppPassword string, fn func(c *client.Client) error) error {
+	c, err := GetClient(ctx, imapUrl, settings, emailAddr, emailAppPassword)
 	if err != nil {
 		return err
 	}
 	defer c.Logout()
-	return fn(c)
+	return interruptible(ctx, c, func() error { return fn(c) })
 }
 
 // Custom XOAUTH2 SASL client implementation
@@ -40,56 +81,41 @@ func (a *XOAuth2Client) Next(challenge []byte) (response []byte, err error) {
 	return nil, nil
 }
 
-func WithOAuthClient(imapUrl, emailAddr string, token *oauth2.Token, oauthConfig *oauth2.Config, fn func(c *client.Client) error) (*oauth2.Token, error) {
-	// Create a token source
-	tokenSource := oauthConfig.TokenSource(context.Background(), token)
-
-	// Obtain a new token (this will refresh the token if needed)
-	newToken, err := tokenSource.Token()
+// GetClient connects to the IMAP server and logs in
+func GetClient(ctx context.Context, imapUrl string, settings ConnectionSettings, emailAddr string, emailAppPassword string) (*client.Client, error) {
+	c, err := Dial(ctx, imapUrl, settings)
 	if err != nil {
 		return nil, err
 	}
 
-	// Update the token if it has been refreshed
-	if newToken.AccessToken != token.AccessToken {
-		token = newToken
-	}
-
-	// Dial the IMAP server
-	c, err := client.DialTLS(imapUrl, nil)
-	if err != nil {
-		return token, err
-	}
-	defer c.Logout()
-
-	// Create the XOAUTH2 authentication mechanism
-	auth := &XOAuth2Client{
-		username:    emailAddr,
-		accessToken: token.AccessToken,
-	}
-
-	// Authenticate
-	if err := c.Authenticate(auth); err != nil {
-		return token, err
+	if err := Login(ctx, c, emailAddr, emailAppPassword); err != nil {
+		c.Logout()
+		return nil, err
 	}
 
-	// Execute the provided function
-	err = fn(c)
-
-	return token, err
+	return c, nil
 }
 
-// GetClient connects to the IMAP server and logs in
-func GetClient(imapUrl string, emailAddr string, emailAppPassword string) (*client.Client, error) {
-	c, err := client.DialTLS(imapUrl, nil)
-	if err != nil {
-		return nil, err
-	}
+// Login authenticates a connection with a password
+func Login(ctx context.Context, c *client.Client, emailAddr, emailAppPassword string) error {
+	return interruptible(ctx, c, func() error {
+		if err := c.Login(emailAddr, emailAppPassword); err != nil {
+			return authError(c, err)
+		}
+		return nil
+	})
+}
 
-	// Login
-	if err := c.Login(emailAddr, emailAppPassword); err != nil {
-		return nil, err
+// LoginOAuth authenticates a connection with an OAuth access token using XOAUTH2
+func LoginOAuth(ctx context.Context, c *client.Client, emailAddr, accessToken string) error {
+	auth := &XOAuth2Client{
+		username:    emailAddr,
+		accessToken: accessToken,
 	}
-
-	return c, nil
+	return interruptible(ctx, c, func() error {
+		if err := c.Authenticate(auth); err != nil {
+			return authError(c, err)
+		}
+		return nil
+	})
 }
@@ -0,0 +1,184 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"syscall"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// ErrorCode says what kind of failure an Error is, so the frontend can tell
+// a wrong password from an unreachable server
+type ErrorCode string
+
+const (
+	// ErrorAuthFailed means the server or provider rejected the credentials
+	ErrorAuthFailed ErrorCode = "auth_failed"
+	// ErrorAuthRequired means the account has to sign in again before it can
+	// be used; its stored credentials are kept until then
+	ErrorAuthRequired ErrorCode = "auth_required"
+	// ErrorNetwork covers DNS failures, refused connections, timeouts and
+	// dropped connections
+	ErrorNetwork ErrorCode = "network"
+	// ErrorTLS means the TLS handshake failed, usually because the
+	// certificate couldn't be verified
+	ErrorTLS ErrorCode = "tls"
+	// ErrorServerRefused means the server answered but wouldn't do what was
+	// asked
+	ErrorServerRefused ErrorCode = "server_refused"
+	ErrorNotFound      ErrorCode = "not_found"
+	ErrorQuota         ErrorCode = "quota"
+	ErrorRateLimited   ErrorCode = "rate_limited"
+	// ErrorCancelled means the operation was abandoned, by the user or
+	// because the account was logged out or the app is closing
+	ErrorCancelled ErrorCode = "cancelled"
+	// ErrorInvalidArgument means the request itself can't be done, such as a
+	// negative limit, so retrying it won't help
+	ErrorInvalidArgument ErrorCode = "invalid_argument"
+	// ErrorInternal is anything else, such as a database error
+	ErrorInternal ErrorCode = "internal"
+)
+
+// Error is an error with a code the frontend can act on. Bindings return it
+// and the frontend receives it as a rejected promise with code and message.
+type Error struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Err     error     `json:"-"`
+}
+
+// NewError wraps err with a code
+func NewError(code ErrorCode, err error) *Error {
+	return &Error{Code: code, Message: err.Error(), Err: err}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ClassifyError turns err into an *Error, working out its code from the
+// network, TLS, IMAP or SMTP error inside it. Errors that already carry a
+// code keep it, along with the context added around them. Errors that match
+// nothing are internal. nil stays nil.
+func ClassifyError(err error) error {
+	return classifyError(err, ErrorInternal)
+}
+
+// ServerError is ClassifyError for errors from talking to a mail server, where
+// an error that matches nothing else is the server's answer, such as an IMAP
+// NO response go-imap returns as plain text
+func ServerError(err error) error {
+	return classifyError(err, ErrorServerRefused)
+}
+
+func classifyError(err error, fallback ErrorCode) error {
+	if err == nil {
+		return nil
+	}
+
+	var coded *Error
+	if errors.As(err, &coded) {
+		return &Error{Code: coded.Code, Message: err.Error(), Err: err}
+	}
+
+	return NewError(errorCode(err, fallback), err)
+}
+
+func errorCode(err error, fallback ErrorCode) ErrorCode {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorCancelled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorNetwork
+	case errors.Is(err, ErrAuthFailed):
+		return ErrorAuthFailed
+	case isTLSError(err):
+		return ErrorTLS
+	}
+
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return smtpErrorCode(protoErr)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, client.ErrAlreadyLoggedOut) {
+		return ErrorNetwork
+	}
+
+	return responseErrorCode(err.Error(), fallback)
+}
+
+func isTLSError(err error) bool {
+	var (
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) || errors.As(err, &alertErr) || errors.As(err, &verifyErr) ||
+		errors.As(err, &authorityErr) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
+
+// smtpErrorCode maps SMTP reply codes (RFC 5321 and the enhanced status codes
+// of RFC 3463 that servers put in the message)
+func smtpErrorCode(err *textproto.Error) ErrorCode {
+	switch {
+	case err.Code == 535 || err.Code == 534 || err.Code == 530:
+		return ErrorAuthFailed
+	case err.Code == 452 || err.Code == 552:
+		return ErrorQuota
+	case err.Code == 421 || err.Code == 454 || strings.HasPrefix(err.Msg, "4.7."):
+		return ErrorRateLimited
+	case err.Code == 550 && strings.HasPrefix(err.Msg, "5.1.1"):
+		return ErrorNotFound
+	default:
+		return responseErrorCode(err.Msg, ErrorServerRefused)
+	}
+}
+
+// responseErrorCode classifies an IMAP NO or BAD response by its text. go-imap
+// drops the response code, such as [OVERQUOTA], before returning the error,
+// so the wording servers use for it is matched instead. Text that matches
+// nothing gets the fallback code.
+func responseErrorCode(msg string, fallback ErrorCode) ErrorCode {
+	msg = strings.ToLower(msg)
+
+	contains := func(substrs ...string) bool {
+		for _, s := range substrs {
+			if strings.Contains(msg, s) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case contains("connection closed", "broken pipe", "connection reset"):
+		return ErrorNetwork
+	case contains("quota", "mailbox full", "over limit", "storage limit"):
+		return ErrorQuota
+	case contains("too many", "throttl", "rate limit", "try again later", "bandwidth"):
+		return ErrorRateLimited
+	case contains("doesn't exist", "does not exist", "no such", "nonexistent", "not found", "unknown mailbox"):
+		return ErrorNotFound
+	case contains("invalid credentials", "authentication failed", "authenticationfailed", "login failed", "password"):
+		return ErrorAuthFailed
+	default:
+		return fallback
+	}
+}
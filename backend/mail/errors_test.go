@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		local  ErrorCode
+		server ErrorCode
+	}{
+		{"unmatched", errors.New("[CANNOT] Invalid mailbox name"), ErrorInternal, ErrorServerRefused},
+		{"response text", errors.New("Mailbox doesn't exist: Archive"), ErrorNotFound, ErrorNotFound},
+		{"cancelled", fmt.Errorf("error fetching: %w", context.Canceled), ErrorCancelled, ErrorCancelled},
+		{"coded", fmt.Errorf("error syncing: %w", NewError(ErrorQuota, errors.New("over quota"))), ErrorQuota, ErrorQuota},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var local, server *Error
+			if !errors.As(ClassifyError(tt.err), &local) || local.Code != tt.local {
+				t.Errorf("ClassifyError(%q) = %v, want code %q", tt.err, local, tt.local)
+			}
+			if !errors.As(ServerError(tt.err), &server) || server.Code != tt.server {
+				t.Errorf("ServerError(%q) = %v, want code %q", tt.err, server, tt.server)
+			}
+			if !errors.Is(server, tt.err) {
+				t.Errorf("ServerError(%q) doesn't wrap the error", tt.err)
+			}
+		})
+	}
+
+	if ClassifyError(nil) != nil || ServerError(nil) != nil {
+		t.Error("nil errors should stay nil")
+	}
+}
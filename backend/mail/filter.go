@@ -0,0 +1,56 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// DateFilter limits messages to those dated in [After, Before). A zero time
+// leaves that end open.
+type DateFilter struct {
+	After  time.Time
+	Before time.Time
+}
+
+// filterDateLayouts are the date formats accepted by before: and after:
+var filterDateLayouts = []string{"2006-01-02", "2006/01/02"}
+
+// ParseDateFilter parses the before:DATE and after:DATE terms of a query
+// coming from the frontend. Dates are days in local time; before: excludes
+// the day itself and after: includes it.
+func ParseDateFilter(query string) (DateFilter, error) {
+	var filter DateFilter
+	for _, term := range strings.Fields(query) {
+		name, value, ok := strings.Cut(term, ":")
+		if !ok {
+			return DateFilter{}, fmt.Errorf("unsupported filter: %s", term)
+		}
+
+		date, err := parseFilterDate(value)
+		if err != nil {
+			return DateFilter{}, fmt.Errorf("invalid date in filter %s: %w", term, err)
+		}
+
+		switch strings.ToLower(name) {
+		case "before":
+			filter.Before = date
+		case "after":
+			filter.After = date
+		default:
+			return DateFilter{}, fmt.Errorf("unsupported filter: %s", term)
+		}
+	}
+	return filter, nil
+}
+
+func parseFilterDate(value string) (time.Time, error) {
+	var err error
+	for _, layout := range filterDateLayouts {
+		var date time.Time
+		if date, err = time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, err
+}
@@ -0,0 +1,38 @@
+package mail
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDateFilter(t *testing.T) {
+	day := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.Local)
+	}
+
+	tests := []struct {
+		query string
+		want  DateFilter
+	}{
+		{"", DateFilter{}},
+		{"before:2024-03-01", DateFilter{Before: day(2024, 3, 1)}},
+		{"after:2024/02/15", DateFilter{After: day(2024, 2, 15)}},
+		{"  After:2024-01-01   BEFORE:2024-02-01 ", DateFilter{After: day(2024, 1, 1), Before: day(2024, 2, 1)}},
+	}
+	for _, test := range tests {
+		got, err := ParseDateFilter(test.query)
+		if err != nil {
+			t.Errorf("ParseDateFilter(%q): %v", test.query, err)
+			continue
+		}
+		if !got.After.Equal(test.want.After) || !got.Before.Equal(test.want.Before) {
+			t.Errorf("ParseDateFilter(%q) = %+v, want %+v", test.query, got, test.want)
+		}
+	}
+
+	for _, query := range []string{"invoice", "from:alice@example.com", "before:", "after:2024-13-01", "before:01/02/2024"} {
+		if _, err := ParseDateFilter(query); err == nil {
+			t.Errorf("ParseDateFilter(%q) succeeded, want an error", query)
+		}
+	}
+}
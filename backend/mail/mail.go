@@ -1,8 +1,11 @@
 package mail
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"slices"
+	"time"
 
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/client"
@@ -10,16 +13,56 @@ import (
 
 // SerializableMessage represents an email message that can be serialized
 type SerializableMessage struct {
-	UID         uint32         `json:"uid"`
-	Envelope    *imap.Envelope `json:"envelope"`
-	Body        EmailBody      `json:"body"`
-	MailboxName string         `json:"mailbox_name"`
+	AccountId    int64          `json:"account_id"`
+	UID          uint32         `json:"uid"`
+	Envelope     *imap.Envelope `json:"envelope"`
+	Body         EmailBody      `json:"body"`
+	MailboxName  string         `json:"mailbox_name"`
+	InternalDate time.Time      `json:"internal_date"`
+	Size         uint32         `json:"size"`
+	Preview      string         `json:"preview"`
 }
 
+// Date returns the date the message should be ordered by: when the server
+// received it, falling back to the Date header
+func (m *SerializableMessage) Date() time.Time {
+	if !m.InternalDate.IsZero() {
+		return m.InternalDate
+	}
+	if m.Envelope != nil {
+		return m.Envelope.Date
+	}
+	return time.Time{}
+}
+
+// NewSerializableMessage converts a fetched message into its serializable form
+func NewSerializableMessage(msg *imap.Message, mailboxName string) SerializableMessage {
+	return SerializableMessage{
+		UID:          msg.Uid,
+		Envelope:     msg.Envelope,
+		MailboxName:  mailboxName,
+		InternalDate: msg.InternalDate,
+		Size:         msg.Size,
+	}
+}
+
+// MessageFetchItems are the items fetched for each message during a sync
+var MessageFetchItems = []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size}
+
 const DEFAULT_EMAIL_COUNT = 10
 
 // FetchMailboxes fetches the list of mailboxes
-func FetchMailboxes(c *client.Client) ([]*imap.MailboxInfo, error) {
+func FetchMailboxes(ctx context.Context, c *client.Client) ([]*imap.MailboxInfo, error) {
+	var mailboxes []*imap.MailboxInfo
+	err := interruptible(ctx, c, func() error {
+		var err error
+		mailboxes, err = fetchMailboxes(c)
+		return err
+	})
+	return mailboxes, err
+}
+
+func fetchMailboxes(c *client.Client) ([]*imap.MailboxInfo, error) {
 	var mailboxes []*imap.MailboxInfo
 	mboxes := make(chan *imap.MailboxInfo)
 
@@ -42,7 +85,29 @@ func FetchMailboxes(c *client.Client) ([]*imap.MailboxInfo, error) {
 }
 
 // FetchEmailsForMailbox fetches the emails in the specified mailbox
-func FetchEmailsForMailbox(c *client.Client, mailboxName string, start, limit uint32) ([]SerializableMessage, error) {
+func FetchEmailsForMailbox(ctx context.Context, c *client.Client, mailboxName string, start, limit uint32) ([]SerializableMessage, error) {
+	var messages []SerializableMessage
+	err := interruptible(ctx, c, func() error {
+		var err error
+		messages, err = fetchEmailsForMailbox(c, mailboxName, start, limit)
+		return err
+	})
+	return messages, err
+}
+
+// FetchFlaggedUIDs returns the UIDs of the selected mailbox's flagged
+// (starred) messages
+func FetchFlaggedUIDs(c *client.Client) ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.WithFlags = []string{imap.FlaggedFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching flagged messages: %w", err)
+	}
+	return uids, nil
+}
+
+func fetchEmailsForMailbox(c *client.Client, mailboxName string, start, limit uint32) ([]SerializableMessage, error) {
 	// Select the mailbox
 	_, err := c.Select(mailboxName, false)
 	if err != nil {
@@ -85,7 +150,7 @@ func FetchEmailsForMailbox(c *client.Client, mailboxName string, start, limit ui
 	seqSet.AddNum(uidsToFetch...)
 
 	// Fetch envelopes using UIDs
-	items := []imap.FetchItem{imap.FetchEnvelope, imap.FetchUid}
+	items := MessageFetchItems
 	messages := make(chan *imap.Message, len(uidsToFetch))
 	done := make(chan error, 1)
 	go func() {
@@ -98,13 +163,7 @@ func FetchEmailsForMailbox(c *client.Client, mailboxName string, start, limit ui
 			continue
 		}
 
-		serializableMsg := SerializableMessage{
-			UID:         msg.Uid,
-			Envelope:    msg.Envelope,
-			Body:        EmailBody{},
-			MailboxName: mailboxName,
-		}
-		result = append(result, serializableMsg)
+		result = append(result, NewSerializableMessage(msg, mailboxName))
 	}
 
 	if err := <-done; err != nil {
@@ -115,3 +174,62 @@ func FetchEmailsForMailbox(c *client.Client, mailboxName string, start, limit ui
 
 	return result, nil
 }
+
+// FetchEnvelopes fetches the envelopes for the given UIDs in the selected mailbox
+func FetchEnvelopes(c *client.Client, mailboxName string, uids []uint32) ([]SerializableMessage, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, MessageFetchItems, messages)
+	}()
+
+	var result []SerializableMessage
+	for msg := range messages {
+		if msg == nil || msg.Envelope == nil {
+			continue
+		}
+		result = append(result, NewSerializableMessage(msg, mailboxName))
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// FetchDatesAndSizes fetches INTERNALDATE and RFC822.SIZE for the given UIDs in
+// the selected mailbox, for backfilling messages cached without them
+func FetchDatesAndSizes(c *client.Client, mailboxName string, uids []uint32) ([]SerializableMessage, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+
+	items := []imap.FetchItem{imap.FetchUid, imap.FetchInternalDate, imap.FetchRFC822Size}
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, items, messages)
+	}()
+
+	var result []SerializableMessage
+	for msg := range messages {
+		result = append(result, NewSerializableMessage(msg, mailboxName))
+	}
+
+	if err := <-done; err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
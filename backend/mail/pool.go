@@ -0,0 +1,356 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+const (
+	// POOL_MAX_CONNS is how many connections each account may have open at
+	// once. Gmail allows 15 per account and other servers fewer, and the app
+	// shares them with the user's other mail clients.
+	POOL_MAX_CONNS = 3
+	// POOL_IDLE_TIMEOUT is how long an unused connection is kept open. Servers
+	// may log out idle clients after 30 minutes, many do so much sooner.
+	POOL_IDLE_TIMEOUT = 5 * time.Minute
+	// POOL_CHECK_AFTER is how long a connection can sit idle before it is
+	// checked with a NOOP before being handed out again
+	POOL_CHECK_AFTER = 30 * time.Second
+	// POOL_CHECK_TIMEOUT bounds the health check, so a connection whose peer
+	// silently disappeared doesn't hang the caller
+	POOL_CHECK_TIMEOUT = 10 * time.Second
+	// POOL_EXPIRY_MARGIN retires connections authenticated with a token this
+	// long before the token expires, as some servers drop them at expiry
+	POOL_EXPIRY_MARGIN = time.Minute
+)
+
+// ErrPoolClosed is returned when borrowing a connection after the pool was closed
+var ErrPoolClosed = errors.New("connection pool closed")
+
+// DialFunc opens and authenticates a new connection. expires is when the
+// credentials it logged in with stop being valid, or zero if they don't.
+type DialFunc func(ctx context.Context) (c *client.Client, expires time.Time, err error)
+
+// Conn is an authenticated connection borrowed from a Pool. It must not be
+// used after it has been returned.
+type Conn struct {
+	*client.Client
+
+	account  *accountConns
+	expires  time.Time
+	lastUsed time.Time
+	reused   bool
+
+	// the mailbox this connection last selected and how, so selecting it
+	// again can be skipped. expunged is set when the server reports that
+	// messages were removed, which the client's mailbox status doesn't track.
+	selected         string
+	selectedReadOnly bool
+	expunged         atomic.Bool
+}
+
+// Select selects a mailbox unless the connection already has it selected in
+// a mode that will do, in which case a NOOP picks up new messages instead. A
+// read-write selection does for a read-only request too, so callers that
+// only read don't make the connection switch back and forth.
+func (c *Conn) Select(name string, readOnly bool) (*imap.MailboxStatus, error) {
+	if mbox := c.Client.Mailbox(); mbox != nil && mbox.Name == name &&
+		c.selected == name && (readOnly || !c.selectedReadOnly) {
+		err := c.Client.Noop()
+		if err != nil {
+			return nil, err
+		}
+		if !c.expunged.Load() {
+			return c.Client.Mailbox(), nil
+		}
+	}
+
+	c.selected = ""
+	c.expunged.Store(false)
+	mbox, err := c.Client.Select(name, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	c.selected, c.selectedReadOnly = name, readOnly
+	return mbox, nil
+}
+
+// watchUpdates consumes the server's unsolicited responses until the
+// connection closes
+func (c *Conn) watchUpdates(updates <-chan client.Update) {
+	for {
+		select {
+		case update := <-updates:
+			if _, ok := update.(*client.ExpungeUpdate); ok {
+				c.expunged.Store(true)
+			}
+		case <-c.Client.LoggedOut():
+			return
+		}
+	}
+}
+
+func (c *Conn) closed() bool {
+	select {
+	case <-c.Client.LoggedOut():
+		return true
+	default:
+		return false
+	}
+}
+
+// close logs out in the background; a dead connection may take a while to
+// notice
+func (c *Conn) close() {
+	go c.Client.Logout()
+}
+
+// accountConns is the set of connections of a single account
+type accountConns struct {
+	id int64
+	// slots holds a token for every connection handed out or being dialed
+	slots chan struct{}
+	idle  []*Conn
+}
+
+// Pool keeps a few authenticated IMAP connections per account open between
+// operations, so each one doesn't pay for a TLS handshake and a login.
+// Connections are checked with a NOOP before reuse when they've been idle for
+// a while, closed after sitting idle too long and replaced when the server
+// has dropped them.
+type Pool struct {
+	MaxConns    int
+	IdleTimeout time.Duration
+	CheckAfter  time.Duration
+
+	mu       sync.Mutex
+	accounts map[int64]*accountConns
+	done     chan struct{}
+	closed   bool
+}
+
+// NewPool creates a pool with the default limits and starts closing idle
+// connections
+func NewPool() *Pool {
+	p := &Pool{
+		MaxConns:    POOL_MAX_CONNS,
+		IdleTimeout: POOL_IDLE_TIMEOUT,
+		CheckAfter:  POOL_CHECK_AFTER,
+		accounts:    make(map[int64]*accountConns),
+		done:        make(chan struct{}),
+	}
+	go p.reapIdle()
+	return p
+}
+
+// With borrows a connection to the account, dialing a new one if none is
+// idle, and runs fn with it. If a reused connection turns out to have been
+// dropped by the server, fn is run again once on a fresh connection. If ctx
+// is done before fn returns, the connection is closed to abort the command in
+// progress.
+func (p *Pool) With(ctx context.Context, accountId int64, dial DialFunc, fn func(c *Conn) error) error {
+	c, err := p.Get(ctx, accountId, dial)
+	if err != nil {
+		return err
+	}
+
+	run := func() error { return fn(c) }
+	err = interruptible(ctx, c.Client, run)
+	if err != nil && ctx.Err() == nil && c.reused && c.closed() {
+		p.Put(c)
+		if c, err = p.Get(ctx, accountId, dial); err != nil {
+			return err
+		}
+		err = interruptible(ctx, c.Client, run)
+	}
+
+	p.Put(c)
+	return err
+}
+
+// Get borrows a connection to the account, waiting while the account has as
+// many open as it is allowed. It must be returned with Put.
+func (p *Pool) Get(ctx context.Context, accountId int64, dial DialFunc) (*Conn, error) {
+	account, err := p.account(accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case account.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		c := p.popIdle(account)
+		if c == nil {
+			break
+		}
+		if p.healthy(ctx, c) {
+			c.reused = true
+			return c, nil
+		}
+		c.close()
+	}
+
+	cl, expires, err := dial(ctx)
+	if err != nil {
+		<-account.slots
+		return nil, err
+	}
+
+	updates := make(chan client.Update, 16)
+	cl.Updates = updates
+	c := &Conn{Client: cl, account: account, expires: expires}
+	go c.watchUpdates(updates)
+
+	return c, nil
+}
+
+// Put returns a borrowed connection. Connections that were closed, or whose
+// account was closed while they were borrowed, are discarded.
+func (p *Pool) Put(c *Conn) {
+	defer func() { <-c.account.slots }()
+
+	p.mu.Lock()
+	keep := !p.closed && p.accounts[c.account.id] == c.account && !c.closed()
+	if keep {
+		c.lastUsed = time.Now()
+		c.reused = false
+		c.account.idle = append(c.account.idle, c)
+	}
+	p.mu.Unlock()
+
+	if !keep {
+		c.close()
+	}
+}
+
+// CloseAccount closes the account's idle connections and makes sure the ones
+// in use aren't reused, for when its credentials or settings change. The
+// connections in use keep their slots until they are returned, so the account
+// still has no more than MaxConns open.
+func (p *Pool) CloseAccount(accountId int64) {
+	p.mu.Lock()
+	account := p.accounts[accountId]
+	if account != nil {
+		p.accounts[accountId] = &accountConns{id: accountId, slots: account.slots}
+	}
+	p.mu.Unlock()
+
+	if account != nil {
+		closeAll(account.idle)
+	}
+}
+
+// Close closes every idle connection and stops the pool; connections still
+// borrowed are closed when they are returned
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	accounts := p.accounts
+	p.accounts = make(map[int64]*accountConns)
+	p.mu.Unlock()
+
+	close(p.done)
+	for _, account := range accounts {
+		closeAll(account.idle)
+	}
+}
+
+func (p *Pool) account(accountId int64) (*accountConns, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrPoolClosed
+	}
+
+	account, ok := p.accounts[accountId]
+	if !ok {
+		account = &accountConns{id: accountId, slots: make(chan struct{}, p.MaxConns)}
+		p.accounts[accountId] = account
+	}
+	return account, nil
+}
+
+// popIdle takes the most recently used idle connection, which is the most
+// likely to still be alive
+func (p *Pool) popIdle(account *accountConns) *Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := len(account.idle)
+	if n == 0 {
+		return nil
+	}
+	c := account.idle[n-1]
+	account.idle = account.idle[:n-1]
+	return c
+}
+
+// healthy reports whether an idle connection can be handed out again
+func (p *Pool) healthy(ctx context.Context, c *Conn) bool {
+	if c.closed() || time.Since(c.lastUsed) > p.IdleTimeout {
+		return false
+	}
+	if !c.expires.IsZero() && time.Now().After(c.expires.Add(-POOL_EXPIRY_MARGIN)) {
+		return false
+	}
+	if time.Since(c.lastUsed) < p.CheckAfter {
+		return true
+	}
+
+	c.Client.Timeout = POOL_CHECK_TIMEOUT
+	err := interruptible(ctx, c.Client, c.Client.Noop)
+	c.Client.Timeout = COMMAND_TIMEOUT
+	return err == nil
+}
+
+// reapIdle periodically closes connections that have been idle too long
+func (p *Pool) reapIdle() {
+	ticker := time.NewTicker(p.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		}
+
+		var expired []*Conn
+		p.mu.Lock()
+		for _, account := range p.accounts {
+			kept := account.idle[:0]
+			for _, c := range account.idle {
+				if time.Since(c.lastUsed) > p.IdleTimeout || c.closed() {
+					expired = append(expired, c)
+				} else {
+					kept = append(kept, c)
+				}
+			}
+			account.idle = kept
+		}
+		p.mu.Unlock()
+
+		closeAll(expired)
+	}
+}
+
+func closeAll(conns []*Conn) {
+	for _, c := range conns {
+		c.close()
+	}
+}
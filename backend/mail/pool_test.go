@@ -0,0 +1,84 @@
+package mail
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+func TestConnSelect(t *testing.T) {
+	p := NewPool()
+	defer p.Close()
+
+	cl := dialMemoryIMAP(t)
+	c, err := p.Get(context.Background(), 1, func(ctx context.Context) (*client.Client, time.Time, error) {
+		return cl, time.Time{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(c)
+
+	steps := []struct {
+		readOnly     bool
+		wantReadOnly bool
+	}{
+		{readOnly: true, wantReadOnly: true},
+		// a read-only selection won't do for writing
+		{readOnly: false, wantReadOnly: false},
+		// a read-write selection does for reading, so it is kept
+		{readOnly: true, wantReadOnly: false},
+		{readOnly: false, wantReadOnly: false},
+	}
+	for i, step := range steps {
+		mbox, err := c.Select("INBOX", step.readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mbox.ReadOnly != step.wantReadOnly {
+			t.Errorf("step %d: Select(INBOX, %v) left the mailbox read-only=%v, want %v", i, step.readOnly, mbox.ReadOnly, step.wantReadOnly)
+		}
+	}
+}
+
+func TestCloseAccountKeepsBorrowedSlots(t *testing.T) {
+	p := NewPool()
+	p.MaxConns = 1
+	defer p.Close()
+
+	dial := func(ctx context.Context) (*client.Client, time.Time, error) {
+		return dialMemoryIMAP(t), time.Time{}, nil
+	}
+	borrowed, err := p.Get(context.Background(), 1, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.CloseAccount(1)
+
+	// the borrowed connection still counts against the limit
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if c, err := p.Get(ctx, 1, dial); err == nil {
+		p.Put(c)
+		t.Fatal("borrowed a second connection while the first is in use")
+	}
+
+	// and once it is returned, it is closed rather than reused
+	p.Put(borrowed)
+	c, err := p.Get(context.Background(), 1, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Put(c)
+	if c == borrowed {
+		t.Error("reused a connection borrowed before the account was closed")
+	}
+	select {
+	case <-borrowed.Client.LoggedOut():
+	case <-time.After(time.Second):
+		t.Error("the connection borrowed before the account was closed is still open")
+	}
+}
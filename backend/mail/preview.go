@@ -0,0 +1,265 @@
+package mail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"mime/quotedprintable"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// PreviewLength is the maximum number of characters in a message preview
+const PreviewLength = 200
+
+// previewFetchBytes is how much of the preview part is fetched from the
+// server; encoded text and HTML markup need more than PreviewLength bytes
+const previewFetchBytes = 2048
+
+var (
+	whitespace  = regexp.MustCompile(`\s+`)
+	attribution = regexp.MustCompile(`(?i)^(on .+ wrote:|-+\s*original message\s*-+|from: .+)$`)
+)
+
+// textPart is a displayable text part of a message
+type textPart struct {
+	path      []int
+	structure *imap.BodyStructure
+}
+
+// findTextParts finds the first text/plain and the first text/html part of a
+// message. Attachments are skipped.
+func findTextParts(bs *imap.BodyStructure) (plain, htmlPart *textPart) {
+	bs.Walk(func(path []int, part *imap.BodyStructure) bool {
+		if !strings.EqualFold(part.MIMEType, "text") || strings.EqualFold(part.Disposition, "attachment") {
+			return true
+		}
+
+		switch strings.ToLower(part.MIMESubType) {
+		case "plain":
+			if plain == nil {
+				plain = &textPart{path, part}
+			}
+		case "html":
+			if htmlPart == nil {
+				htmlPart = &textPart{path, part}
+			}
+		}
+		return true
+	})
+	return plain, htmlPart
+}
+
+// findPreviewPart finds the first text/plain part of a message, falling back
+// to the first text/html part
+func findPreviewPart(bs *imap.BodyStructure) (textPart, bool) {
+	plain, htmlPart := findTextParts(bs)
+	if plain != nil {
+		return *plain, true
+	}
+	if htmlPart != nil {
+		return *htmlPart, true
+	}
+	return textPart{}, false
+}
+
+// FetchPreviews fetches the start of the displayable text of each message in
+// the selected mailbox and returns a short preview for each, keyed by UID.
+// Messages with the same part layout are fetched together in one UID FETCH.
+func FetchPreviews(c *client.Client, structures map[uint32]*imap.BodyStructure) (map[uint32]string, error) {
+	type group struct {
+		section *imap.BodySectionName
+		uids    []uint32
+		parts   map[uint32]*imap.BodyStructure
+	}
+
+	groups := make(map[string]*group)
+	for uid, bs := range structures {
+		if bs == nil {
+			continue
+		}
+		part, ok := findPreviewPart(bs)
+		if !ok {
+			continue
+		}
+
+		section := &imap.BodySectionName{
+			BodyPartName: imap.BodyPartName{Path: part.path},
+			Peek:         true,
+			Partial:      []int{0, previewFetchBytes},
+		}
+		key := string(section.FetchItem())
+		g, ok := groups[key]
+		if !ok {
+			g = &group{section: section, parts: make(map[uint32]*imap.BodyStructure)}
+			groups[key] = g
+		}
+		g.uids = append(g.uids, uid)
+		g.parts[uid] = part.structure
+	}
+
+	previews := make(map[uint32]string)
+	for _, g := range groups {
+		seqSet := new(imap.SeqSet)
+		seqSet.AddNum(g.uids...)
+
+		items := []imap.FetchItem{imap.FetchUid, g.section.FetchItem()}
+		messages := make(chan *imap.Message, 10)
+		done := make(chan error, 1)
+		go func() {
+			done <- c.UidFetch(seqSet, items, messages)
+		}()
+
+		for msg := range messages {
+			r := msg.GetBody(g.section)
+			part := g.parts[msg.Uid]
+			if r == nil || part == nil {
+				continue
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				log.Println("Error reading preview for UID", msg.Uid, ":", err)
+				continue
+			}
+			previews[msg.Uid] = MakePreview(content, part)
+		}
+
+		if err := <-done; err != nil {
+			return previews, err
+		}
+	}
+
+	return previews, nil
+}
+
+// MakePreview turns the (possibly truncated) raw content of a text part into
+// a single line of at most PreviewLength characters, with HTML, quoted text
+// and signatures removed
+func MakePreview(content []byte, part *imap.BodyStructure) string {
+	text := decodePartialContent(content, part.Encoding)
+
+	if cs := part.Params["charset"]; cs != "" && !strings.EqualFold(cs, "utf-8") && !strings.EqualFold(cs, "us-ascii") {
+		if r, err := charset.NewReaderLabel(cs, bytes.NewReader(text)); err == nil {
+			if decoded, err := io.ReadAll(r); err == nil {
+				text = decoded
+			}
+		}
+	}
+
+	var s string
+	if strings.EqualFold(part.MIMESubType, "html") {
+		s = htmlToText(text)
+	} else {
+		s = string(text)
+	}
+
+	return truncatePreview(stripQuotesAndSignature(s))
+}
+
+// decodePartialContent decodes a Content-Transfer-Encoding that may have been
+// cut off partway through
+func decodePartialContent(content []byte, encoding string) []byte {
+	switch strings.ToLower(encoding) {
+	case "base64":
+		cleaned := bytes.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, content)
+		// drop a trailing incomplete quantum
+		cleaned = cleaned[:len(cleaned)-len(cleaned)%4]
+		decoded, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(cleaned)))
+		if err != nil && len(decoded) == 0 {
+			return content
+		}
+		return decoded
+	case "quoted-printable":
+		// the reader passes a cut off escape through as is, so drop it
+		if i := bytes.LastIndexByte(content, '='); i >= 0 && i >= len(content)-2 {
+			content = content[:i]
+		}
+		// a truncated soft line break makes the reader fail at the end, so
+		// keep whatever was decoded before that
+		decoded, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(content)))
+		return decoded
+	default:
+		return content
+	}
+}
+
+// htmlToText extracts the visible text of an HTML fragment
+func htmlToText(content []byte) string {
+	var sb strings.Builder
+	z := html.NewTokenizer(bytes.NewReader(content))
+	skip := 0
+
+	for {
+		switch token := z.Next(); token {
+		case html.ErrorToken:
+			return sb.String()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "style", "script", "head", "title", "blockquote":
+				// <style/> has no content to skip
+				if token == html.StartTagToken {
+					skip++
+				}
+			case "br", "p", "div", "tr", "li":
+				sb.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "style", "script", "head", "title", "blockquote":
+				if skip > 0 {
+					skip--
+				}
+			case "p", "div", "tr", "li":
+				sb.WriteString("\n")
+			}
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(z.Text())
+			}
+		}
+	}
+}
+
+// stripQuotesAndSignature removes quoted replies, reply attributions and
+// anything after a signature separator
+func stripQuotesAndSignature(s string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n") {
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || trimmed == "--" || trimmed == "__" {
+			break
+		}
+		if attribution.MatchString(trimmed) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		lines = append(lines, trimmed)
+	}
+
+	return strings.TrimSpace(whitespace.ReplaceAllString(strings.Join(lines, " "), " "))
+}
+
+func truncatePreview(s string) string {
+	if utf8.RuneCountInString(s) <= PreviewLength {
+		return s
+	}
+
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:PreviewLength]))
+}
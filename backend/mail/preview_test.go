@@ -0,0 +1,111 @@
+package mail
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestDecodePartialContent(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		encoding string
+		want     string
+	}{
+		{"7bit", "Hello =41", "7bit", "Hello =41"},
+		{"base64", "SGVsbG8gV29ybGQ=", "base64", "Hello World"},
+		{"base64 with line breaks", "SGVs\r\nbG8g\r\nV29y\r\nbGQ=", "BASE64", "Hello World"},
+		{"base64 cut off", "SGVsbG8gV29yb", "base64", "Hello Wor"},
+		{"base64 garbage", "!!!!", "base64", "!!!!"},
+		{"quoted-printable", "caf=C3=A9 au=\r\n lait", "quoted-printable", "café au lait"},
+		{"quoted-printable cut off in an escape", "caf=C", "quoted-printable", "caf"},
+		{"quoted-printable cut off in a soft break", "caf=", "quoted-printable", "caf"},
+		{"quoted-printable cut off in a CRLF", "caf=\r", "quoted-printable", "caf"},
+		{"quoted-printable ending in an escape", "1+1=3D2", "quoted-printable", "1+1=2"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := string(decodePartialContent([]byte(test.content), test.encoding)); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html string
+		want string
+	}{
+		{"Hello<br>World", "Hello\nWorld"},
+		{"Hello<br/>World", "Hello\nWorld"},
+		{"Hello<br />World", "Hello\nWorld"},
+		{"<p>Hello</p><p>World</p>", "\nHello\n\nWorld\n"},
+		{"<html><head><title>Subject</title><style>p { color: red }</style></head><body>Text</body></html>", "Text"},
+		{"<style/>Text", "Text"},
+		{"<script>alert(1)</script>Text", "Text"},
+		{"Reply<blockquote>Quoted <b>text</b></blockquote>", "Reply"},
+		{"Fish &amp; chips", "Fish & chips"},
+	}
+	for _, test := range tests {
+		if got := htmlToText([]byte(test.html)); got != test.want {
+			t.Errorf("htmlToText(%q) = %q, want %q", test.html, got, test.want)
+		}
+	}
+}
+
+func TestStripQuotesAndSignature(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"whitespace", "  lots   of\tspace \r\n\r\n here ", "lots of space here"},
+		{"quoted lines", "Hi Bob,\n> your text\n>> older text\nThanks", "Hi Bob, Thanks"},
+		{"signature", "Thanks\n-- \nAlice\nExample Corp", "Thanks"},
+		{"signature without trailing space", "Thanks\r\n--\r\nAlice", "Thanks"},
+		{"underscores", "Thanks\n__\nSent from my phone", "Thanks"},
+		{"attribution", "Sure\nOn Mon, 1 Jan 2024, Bob wrote:\nquoted without markers", "Sure"},
+		{"forwarded", "FYI\n----- Original Message -----\nFrom: bob@example.com", "FYI"},
+		{"dashes in text", "Pages 1--3 attached", "Pages 1--3 attached"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := stripQuotesAndSignature(test.text); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMakePreview(t *testing.T) {
+	part := func(subType, encoding, charset string) *imap.BodyStructure {
+		return &imap.BodyStructure{
+			MIMEType:    "text",
+			MIMESubType: subType,
+			Encoding:    encoding,
+			Params:      map[string]string{"charset": charset},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		content string
+		part    *imap.BodyStructure
+		want    string
+	}{
+		{"plain", "Hello,\n\nsee you tomorrow.\n-- \nAlice", part("plain", "7bit", "utf-8"), "Hello, see you tomorrow."},
+		{"html", "<p>Caf=C3=A9</p><p>Line=\r\n two<br/>three</p>", part("html", "quoted-printable", "utf-8"), "Café Line two three"},
+		{"charset", "caf\xe9", part("plain", "8bit", "iso-8859-1"), "café"},
+		{"long", strings.Repeat("é", PreviewLength+50), part("plain", "8bit", "utf-8"), strings.Repeat("é", PreviewLength)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := MakePreview([]byte(test.content), test.part); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
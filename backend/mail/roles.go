@@ -0,0 +1,110 @@
+package mail
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-imap"
+)
+
+// MailboxRole is the special-use role of a mailbox (RFC 6154), used to line
+// up equivalent mailboxes across accounts
+type MailboxRole string
+
+const (
+	RoleNone    MailboxRole = ""
+	RoleInbox   MailboxRole = "inbox"
+	RoleSent    MailboxRole = "sent"
+	RoleDrafts  MailboxRole = "drafts"
+	RoleArchive MailboxRole = "archive"
+	RoleTrash   MailboxRole = "trash"
+)
+
+var roleAttributes = map[string]MailboxRole{
+	imap.SentAttr:    RoleSent,
+	imap.DraftsAttr:  RoleDrafts,
+	imap.ArchiveAttr: RoleArchive,
+	imap.TrashAttr:   RoleTrash,
+}
+
+// Names used by servers that don't advertise SPECIAL-USE, compared case-insensitively
+// against the last path segment of the mailbox
+var roleNames = map[string]MailboxRole{
+	"sent":             RoleSent,
+	"sent items":       RoleSent,
+	"sent messages":    RoleSent,
+	"sent mail":        RoleSent,
+	"drafts":           RoleDrafts,
+	"draft":            RoleDrafts,
+	"archive":          RoleArchive,
+	"archives":         RoleArchive,
+	"trash":            RoleTrash,
+	"deleted items":    RoleTrash,
+	"deleted messages": RoleTrash,
+	"bin":              RoleTrash,
+}
+
+// ParseMailboxRole validates a role coming from the frontend
+func ParseMailboxRole(name string) (MailboxRole, error) {
+	switch role := MailboxRole(name); role {
+	case RoleInbox, RoleSent, RoleDrafts, RoleArchive, RoleTrash:
+		return role, nil
+	default:
+		return RoleNone, fmt.Errorf("unsupported mailbox role: %s", name)
+	}
+}
+
+// mailboxRoleFor works out the role of a mailbox from its special-use
+// attributes, falling back to well-known names. It reports whether the role
+// comes from an attribute.
+func mailboxRoleFor(info *imap.MailboxInfo) (MailboxRole, bool) {
+	if strings.EqualFold(info.Name, imap.InboxName) {
+		return RoleInbox, true
+	}
+
+	for _, attr := range info.Attributes {
+		if role, ok := roleAttributes[attr]; ok {
+			return role, true
+		}
+	}
+
+	name := info.Name
+	if info.Delimiter != "" {
+		if i := strings.LastIndex(name, info.Delimiter); i >= 0 {
+			name = name[i+len(info.Delimiter):]
+		}
+	}
+
+	return roleNames[strings.ToLower(name)], false
+}
+
+// MailboxRoles works out the roles of an account's mailboxes, keyed by name.
+// Each role goes to one mailbox at most: a special-use attribute beats a
+// well-known name, and otherwise the first name in sort order wins, so a
+// server with both "Sent" and "[Gmail]/Sent Mail" has one sent mailbox.
+func MailboxRoles(infos []*imap.MailboxInfo) map[string]MailboxRole {
+	type claim struct {
+		name      string
+		attribute bool
+	}
+	claims := make(map[MailboxRole]claim)
+
+	roles := make(map[string]MailboxRole, len(infos))
+	for _, info := range infos {
+		roles[info.Name] = RoleNone
+
+		role, attribute := mailboxRoleFor(info)
+		if role == RoleNone {
+			continue
+		}
+		if c, ok := claims[role]; ok && (c.attribute && !attribute || c.attribute == attribute && c.name < info.Name) {
+			continue
+		}
+		claims[role] = claim{info.Name, attribute}
+	}
+
+	for role, c := range claims {
+		roles[c.name] = role
+	}
+	return roles
+}
@@ -0,0 +1,69 @@
+package mail
+
+import (
+	"maps"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+func TestMailboxRoles(t *testing.T) {
+	mailbox := func(name string, attributes ...string) *imap.MailboxInfo {
+		return &imap.MailboxInfo{Name: name, Delimiter: "/", Attributes: attributes}
+	}
+
+	tests := []struct {
+		name      string
+		mailboxes []*imap.MailboxInfo
+		want      map[string]MailboxRole
+	}{
+		{
+			name: "special-use beats name",
+			mailboxes: []*imap.MailboxInfo{
+				mailbox("INBOX"),
+				mailbox("Sent"),
+				mailbox("[Gmail]/Sent Mail", imap.SentAttr),
+				mailbox("Trash"),
+				mailbox("[Gmail]/Bin", imap.TrashAttr),
+			},
+			want: map[string]MailboxRole{
+				"INBOX":             RoleInbox,
+				"Sent":              RoleNone,
+				"[Gmail]/Sent Mail": RoleSent,
+				"Trash":             RoleNone,
+				"[Gmail]/Bin":       RoleTrash,
+			},
+		},
+		{
+			name: "first name wins",
+			mailboxes: []*imap.MailboxInfo{
+				mailbox("Sent Items"),
+				mailbox("Sent"),
+				mailbox("Archive"),
+			},
+			want: map[string]MailboxRole{
+				"Sent Items": RoleNone,
+				"Sent":       RoleSent,
+				"Archive":    RoleArchive,
+			},
+		},
+		{
+			name: "first attribute wins",
+			mailboxes: []*imap.MailboxInfo{
+				mailbox("Sent", imap.SentAttr),
+				mailbox("Outbox/Sent", imap.SentAttr),
+			},
+			want: map[string]MailboxRole{
+				"Sent":        RoleNone,
+				"Outbox/Sent": RoleSent,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := MailboxRoles(test.mailboxes); !maps.Equal(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package mail
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+)
+
+// ConnectionSecurity is how the connection to the IMAP server is secured
+type ConnectionSecurity string
+
+const (
+	// SecurityTLS is implicit TLS, usually on port 993. It is the default.
+	SecurityTLS ConnectionSecurity = "tls"
+	// SecurityStartTLS connects in plaintext, usually on port 143, and
+	// refuses to log in unless the server upgrades the connection
+	SecurityStartTLS ConnectionSecurity = "starttls"
+	// SecurityNone doesn't encrypt the connection at all. It is only allowed
+	// for servers on the loopback interface, such as local test servers and
+	// bridges.
+	SecurityNone ConnectionSecurity = "none"
+)
+
+// ConnectionSettings configure how an account connects to its IMAP server.
+// The zero value is implicit TLS verified against the system roots.
+type ConnectionSettings struct {
+	Security ConnectionSecurity `json:"security"`
+	// CACertPEM is a PEM bundle of extra certificate authorities to trust,
+	// for servers with certificates from a private CA
+	CACertPEM string `json:"ca_cert_pem"`
+	// MinTLSVersion is "1.2" or "1.3"; empty means 1.2
+	MinTLSVersion string `json:"min_tls_version"`
+	// ClientCertPEM and ClientKeyPEM are an optional client certificate
+	ClientCertPEM string `json:"client_cert_pem"`
+	ClientKeyPEM  string `json:"client_key_pem"`
+}
+
+// TLSConfig builds the TLS configuration for connecting to host
+func (s ConnectionSettings) TLSConfig(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+
+	switch s.MinTLSVersion {
+	case "", "1.2":
+	case "1.3":
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported minimum TLS version %q", s.MinTLSVersion)
+	}
+
+	if s.CACertPEM != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM([]byte(s.CACertPEM)) {
+			return nil, fmt.Errorf("no certificates found in CA bundle")
+		}
+		config.RootCAs = pool
+	}
+
+	if s.ClientCertPEM != "" || s.ClientKeyPEM != "" {
+		cert, err := tls.X509KeyPair([]byte(s.ClientCertPEM), []byte(s.ClientKeyPEM))
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Dial connects to the IMAP server at imapUrl (host:port) as the settings
+// say. The returned client is not logged in yet.
+func Dial(ctx context.Context, imapUrl string, settings ConnectionSettings) (*client.Client, error) {
+	host, _, err := net.SplitHostPort(imapUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IMAP address %q: %w", imapUrl, err)
+	}
+
+	switch settings.Security {
+	case "", SecurityTLS:
+		config, err := settings.TLSConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		return dial(ctx, imapUrl, config)
+
+	case SecurityStartTLS:
+		config, err := settings.TLSConfig(host)
+		if err != nil {
+			return nil, err
+		}
+		c, err := dial(ctx, imapUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		err = interruptible(ctx, c, func() error {
+			if ok, err := c.SupportStartTLS(); err != nil || !ok {
+				if err == nil {
+					err = fmt.Errorf("server does not support STARTTLS")
+				}
+				return err
+			}
+			if err := c.StartTLS(config); err != nil {
+				return fmt.Errorf("error starting TLS: %w", err)
+			}
+			return nil
+		})
+		if err != nil {
+			c.Logout()
+			return nil, err
+		}
+		return c, nil
+
+	case SecurityNone:
+		if !isLoopback(host) {
+			return nil, fmt.Errorf("unencrypted connections are only allowed to localhost, not %s", host)
+		}
+		return dial(ctx, imapUrl, nil)
+
+	default:
+		return nil, fmt.Errorf("unknown connection security %q", settings.Security)
+	}
+}
+
+// dial connects, performs the TLS handshake unless config is nil and reads
+// the server's greeting, all within DIAL_TIMEOUT. Commands on the returned
+// client time out after COMMAND_TIMEOUT.
+func dial(ctx context.Context, imapUrl string, config *tls.Config) (*client.Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, DIAL_TIMEOUT)
+	defer cancel()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", imapUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if config != nil {
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	// client.New blocks until the greeting arrives
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, err := client.New(conn)
+	if !stop() {
+		if err == nil {
+			c.Terminate()
+		}
+		return nil, context.Cause(ctx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	c.Timeout = COMMAND_TIMEOUT
+	return c, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
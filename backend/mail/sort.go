@@ -0,0 +1,256 @@
+package mail
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/commands"
+	"github.com/emersion/go-imap/responses"
+)
+
+// SortField is a SORT key as defined in RFC 5256 section 3
+type SortField string
+
+const (
+	SortArrival SortField = "ARRIVAL"
+	SortDate    SortField = "DATE"
+	SortFrom    SortField = "FROM"
+	SortSubject SortField = "SUBJECT"
+	SortSize    SortField = "SIZE"
+)
+
+// ThreadReferences is the THREAD=REFERENCES algorithm from RFC 5256
+const ThreadReferences = "REFERENCES"
+
+// SortCriterion is a single SORT key, optionally reversed
+type SortCriterion struct {
+	Field   SortField
+	Reverse bool
+}
+
+// Thread is a node in a THREAD response. A UID of 0 marks a placeholder for a
+// message the server knows is missing from the mailbox.
+type Thread struct {
+	UID      uint32    `json:"uid"`
+	Children []*Thread `json:"children"`
+}
+
+// ParseSortField validates a sort key coming from the frontend
+func ParseSortField(name string) (SortField, error) {
+	switch field := SortField(name); field {
+	case SortArrival, SortDate, SortFrom, SortSubject, SortSize:
+		return field, nil
+	default:
+		return "", fmt.Errorf("unsupported sort field: %s", name)
+	}
+}
+
+// SupportsSort reports whether the server advertises the SORT extension
+func SupportsSort(c *client.Client) bool {
+	ok, err := c.Support("SORT")
+	return err == nil && ok
+}
+
+// SupportsThread reports whether the server advertises the given THREAD algorithm
+func SupportsThread(c *client.Client, algorithm string) bool {
+	ok, err := c.Support("THREAD=" + algorithm)
+	return err == nil && ok
+}
+
+// UidSort runs UID SORT on the selected mailbox and returns the matching UIDs
+// in server order
+func UidSort(c *client.Client, sortCriteria []SortCriterion, searchCriteria *imap.SearchCriteria) ([]uint32, error) {
+	if c.State() != imap.SelectedState {
+		return nil, client.ErrNoMailboxSelected
+	}
+	if !SupportsSort(c) {
+		return nil, client.ErrExtensionUnsupported
+	}
+
+	cmd := &commands.Uid{Cmd: &sortCommand{SortCriteria: sortCriteria, SearchCriteria: searchCriteria}}
+	res := new(sortResponse)
+
+	status, err := c.Execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	return res.Ids, nil
+}
+
+// UidThread runs UID THREAD on the selected mailbox and returns the thread
+// forest, newest thread first
+func UidThread(c *client.Client, algorithm string, searchCriteria *imap.SearchCriteria) ([]*Thread, error) {
+	if c.State() != imap.SelectedState {
+		return nil, client.ErrNoMailboxSelected
+	}
+	if !SupportsThread(c, algorithm) {
+		return nil, client.ErrExtensionUnsupported
+	}
+
+	cmd := &commands.Uid{Cmd: &threadCommand{Algorithm: algorithm, SearchCriteria: searchCriteria}}
+	res := new(threadResponse)
+
+	status, err := c.Execute(cmd, res)
+	if err != nil {
+		return nil, err
+	}
+	if err := status.Err(); err != nil {
+		return nil, err
+	}
+
+	// RFC 5256 orders threads oldest first
+	slices.Reverse(res.Threads)
+
+	return res.Threads, nil
+}
+
+// ThreadUIDs flattens a thread into its UIDs, parents before children
+func ThreadUIDs(t *Thread) []uint32 {
+	var uids []uint32
+	if t.UID != 0 {
+		uids = append(uids, t.UID)
+	}
+	for _, child := range t.Children {
+		uids = append(uids, ThreadUIDs(child)...)
+	}
+	return uids
+}
+
+type sortCommand struct {
+	SortCriteria   []SortCriterion
+	SearchCriteria *imap.SearchCriteria
+}
+
+func (cmd *sortCommand) Command() *imap.Command {
+	var keys []interface{}
+	for _, criterion := range cmd.SortCriteria {
+		if criterion.Reverse {
+			keys = append(keys, imap.RawString("REVERSE"))
+		}
+		keys = append(keys, imap.RawString(criterion.Field))
+	}
+
+	searchCriteria := cmd.SearchCriteria
+	if searchCriteria == nil {
+		searchCriteria = imap.NewSearchCriteria()
+	}
+
+	args := []interface{}{keys, imap.RawString("UTF-8")}
+	args = append(args, searchCriteria.Format()...)
+
+	return &imap.Command{
+		Name:      "SORT",
+		Arguments: args,
+	}
+}
+
+type sortResponse struct {
+	Ids []uint32
+}
+
+func (r *sortResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "SORT" {
+		return responses.ErrUnhandled
+	}
+
+	for _, f := range fields {
+		id, err := imap.ParseNumber(f)
+		if err != nil {
+			return err
+		}
+		r.Ids = append(r.Ids, id)
+	}
+
+	return nil
+}
+
+type threadCommand struct {
+	Algorithm      string
+	SearchCriteria *imap.SearchCriteria
+}
+
+func (cmd *threadCommand) Command() *imap.Command {
+	searchCriteria := cmd.SearchCriteria
+	if searchCriteria == nil {
+		searchCriteria = imap.NewSearchCriteria()
+	}
+
+	args := []interface{}{imap.RawString(cmd.Algorithm), imap.RawString("UTF-8")}
+	args = append(args, searchCriteria.Format()...)
+
+	return &imap.Command{
+		Name:      "THREAD",
+		Arguments: args,
+	}
+}
+
+type threadResponse struct {
+	Threads []*Thread
+}
+
+func (r *threadResponse) Handle(resp imap.Resp) error {
+	name, fields, ok := imap.ParseNamedResp(resp)
+	if !ok || name != "THREAD" {
+		return responses.ErrUnhandled
+	}
+
+	for _, f := range fields {
+		list, ok := f.([]interface{})
+		if !ok {
+			return fmt.Errorf("malformed THREAD response: expected a list")
+		}
+		thread, err := parseThread(list)
+		if err != nil {
+			return err
+		}
+		r.Threads = append(r.Threads, thread)
+	}
+
+	return nil
+}
+
+// parseThread converts one parenthesized thread, e.g. "3 6 (4 23)(44 7 96)",
+// into a chain of parents ending in the nested sub-threads
+func parseThread(fields []interface{}) (*Thread, error) {
+	root := &Thread{}
+	current := root
+	first := true
+
+	for _, f := range fields {
+		if sub, ok := f.([]interface{}); ok {
+			child, err := parseThread(sub)
+			if err != nil {
+				return nil, err
+			}
+			current.Children = append(current.Children, child)
+			continue
+		}
+
+		uid, err := imap.ParseNumber(f)
+		if err != nil {
+			return nil, err
+		}
+		if first {
+			root.UID = uid
+		} else {
+			next := &Thread{UID: uid}
+			current.Children = append(current.Children, next)
+			current = next
+		}
+		first = false
+	}
+
+	// A thread made only of sub-threads has no known root message
+	if first && len(root.Children) == 1 {
+		return root.Children[0], nil
+	}
+
+	return root, nil
+}
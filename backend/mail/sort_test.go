@@ -0,0 +1,133 @@
+package mail
+
+import (
+	"bufio"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-imap"
+)
+
+// readResp parses one untagged server response line
+func readResp(t *testing.T, line string) imap.Resp {
+	t.Helper()
+
+	resp, err := imap.ReadResp(imap.NewReader(bufio.NewReader(strings.NewReader(line + "\r\n"))))
+	if err != nil {
+		t.Fatalf("reading %q: %v", line, err)
+	}
+	return resp
+}
+
+func TestThreadResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		want []*Thread
+	}{
+		{
+			name: "flat",
+			line: "* THREAD (1)(2)(3)",
+			want: []*Thread{{UID: 1}, {UID: 2}, {UID: 3}},
+		},
+		{
+			name: "empty",
+			line: "* THREAD",
+			want: nil,
+		},
+		{
+			// the example from RFC 5256 section 4
+			name: "nested",
+			line: "* THREAD (2)(3 6 (4 23)(44 7 96))",
+			want: []*Thread{
+				{UID: 2},
+				{UID: 3, Children: []*Thread{
+					{UID: 6, Children: []*Thread{
+						{UID: 4, Children: []*Thread{{UID: 23}}},
+						{UID: 44, Children: []*Thread{
+							{UID: 7, Children: []*Thread{{UID: 96}}},
+						}},
+					}},
+				}},
+			},
+		},
+		{
+			name: "missing root",
+			line: "* THREAD ((3)(5))",
+			want: []*Thread{{Children: []*Thread{{UID: 3}, {UID: 5}}}},
+		},
+		{
+			name: "single sub-thread",
+			line: "* THREAD ((3 4))",
+			want: []*Thread{{UID: 3, Children: []*Thread{{UID: 4}}}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := new(threadResponse)
+			if err := res.Handle(readResp(t, test.line)); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res.Threads, test.want) {
+				t.Errorf("got %s, want %s", formatThreads(res.Threads), formatThreads(test.want))
+			}
+		})
+	}
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, line := range []string{"* THREAD 1 2", "* THREAD (1 x)"} {
+			if err := new(threadResponse).Handle(readResp(t, line)); err == nil {
+				t.Errorf("%q parsed, want an error", line)
+			}
+		}
+	})
+}
+
+func TestThreadUIDs(t *testing.T) {
+	res := new(threadResponse)
+	if err := res.Handle(readResp(t, "* THREAD (3 6 (4 23)(44 7 96))")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ThreadUIDs(res.Threads[0]), []uint32{3, 6, 4, 23, 44, 7, 96}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSortResponse(t *testing.T) {
+	res := new(sortResponse)
+	if err := res.Handle(readResp(t, "* SORT 5 3 4 1 2")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint32{5, 3, 4, 1, 2}; !slices.Equal(res.Ids, want) {
+		t.Errorf("got %v, want %v", res.Ids, want)
+	}
+
+	if err := new(sortResponse).Handle(readResp(t, "* SEARCH 1 2")); err == nil {
+		t.Error("a SEARCH response was handled as SORT")
+	}
+}
+
+// formatThreads writes threads the way THREAD responses do, with 0 for a
+// missing root
+func formatThreads(threads []*Thread) string {
+	var parts []string
+	for _, t := range threads {
+		parts = append(parts, "("+formatThread(t)+")")
+	}
+	return strings.Join(parts, "")
+}
+
+func formatThread(t *Thread) string {
+	s := strconv.FormatUint(uint64(t.UID), 10)
+	switch len(t.Children) {
+	case 0:
+		return s
+	case 1:
+		return s + " " + formatThread(t.Children[0])
+	default:
+		return s + " " + formatThreads(t.Children)
+	}
+}
@@ -0,0 +1,126 @@
+package mail
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// SyncWindow limits the first sync of a mailbox to its recent messages, so a
+// huge mailbox isn't listed and fetched in one go. Older messages are fetched
+// later, as the user scrolls to them. A zero field doesn't limit; with both
+// set, the window reaches back as far as either does.
+type SyncWindow struct {
+	// Days is how many days of messages are synced
+	Days int `json:"days"`
+	// Messages is how many of the newest messages are synced
+	Messages int `json:"messages"`
+}
+
+// WindowStart returns the lowest UID of the selected mailbox's messages in the
+// window, so the window is that UID and every higher one, and whether that
+// covers the whole mailbox. start is 0 if the mailbox is empty.
+func WindowStart(c *client.Client, window SyncWindow) (start uint32, all bool, err error) {
+	mbox := c.Mailbox()
+	if mbox == nil || mbox.Messages == 0 {
+		return 0, true, nil
+	}
+
+	first, err := uidAt(c, 1)
+	if err != nil {
+		return 0, false, err
+	}
+	if window.Days <= 0 && window.Messages <= 0 {
+		return first, true, nil
+	}
+
+	last, err := uidAt(c, mbox.Messages)
+	if err != nil {
+		return 0, false, err
+	}
+	// with only a day limit and nothing that recent, the window starts past
+	// the newest message
+	start = last + 1
+
+	if window.Messages > 0 {
+		if uint32(window.Messages) >= mbox.Messages {
+			return first, true, nil
+		}
+		uid, err := uidAt(c, mbox.Messages-uint32(window.Messages)+1)
+		if err != nil {
+			return 0, false, err
+		}
+		start = min(start, uid)
+	}
+
+	if window.Days > 0 {
+		criteria := imap.NewSearchCriteria()
+		criteria.Since = time.Now().AddDate(0, 0, -window.Days)
+		uids, err := c.UidSearch(criteria)
+		if err != nil {
+			return 0, false, fmt.Errorf("error searching recent messages: %w", err)
+		}
+		if len(uids) > 0 {
+			start = min(start, slices.Min(uids))
+		}
+	}
+
+	return start, start <= first, nil
+}
+
+// UIDsBefore returns the UIDs of the selected mailbox's messages older than
+// uid, in ascending order
+func UIDsBefore(c *client.Client, uid uint32) ([]uint32, error) {
+	if uid <= 1 {
+		return nil, nil
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(1, uid-1)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching older messages: %w", err)
+	}
+
+	uids = slices.DeleteFunc(uids, func(u uint32) bool { return u >= uid })
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// UIDsFrom returns the UIDs of the selected mailbox's messages from uid on, in
+// ascending order
+func UIDsFrom(c *client.Client, uid uint32) ([]uint32, error) {
+	criteria := imap.NewSearchCriteria()
+	criteria.Uid = new(imap.SeqSet)
+	criteria.Uid.AddRange(max(uid, 1), 0)
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		return nil, fmt.Errorf("error searching messages: %w", err)
+	}
+
+	// uid:* always matches the newest message, even if its UID is lower
+	uids = slices.DeleteFunc(uids, func(u uint32) bool { return u < uid })
+	slices.Sort(uids)
+	return uids, nil
+}
+
+// uidAt returns the UID of the selected mailbox's message with the given
+// sequence number
+func uidAt(c *client.Client, seqNum uint32) (uint32, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(seqNum)
+
+	messages := make(chan *imap.Message, 1)
+	if err := c.Fetch(seqSet, []imap.FetchItem{imap.FetchUid}, messages); err != nil {
+		return 0, fmt.Errorf("error fetching UID of message %d: %w", seqNum, err)
+	}
+	msg, ok := <-messages
+	if !ok {
+		return 0, fmt.Errorf("message %d not found", seqNum)
+	}
+	return msg.Uid, nil
+}
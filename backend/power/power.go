@@ -0,0 +1,23 @@
+package power
+
+import "time"
+
+// PROBE_TIMEOUT bounds how long asking the system for its power or network
+// state may take, so a hung helper doesn't stall syncing
+const PROBE_TIMEOUT = 2 * time.Second
+
+// Status is the state of the machine's power supply and network connection.
+// Anything that can't be determined is reported as false, so background work
+// isn't paused on machines where it can't be detected.
+type Status struct {
+	OnBattery bool `json:"on_battery"`
+	Metered   bool `json:"metered"`
+}
+
+// Current returns the current power and network status
+func Current() Status {
+	return Status{
+		OnBattery: onBattery(),
+		Metered:   metered(),
+	}
+}
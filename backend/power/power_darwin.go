@@ -0,0 +1,26 @@
+package power
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+)
+
+// onBattery reads the power source pmset reports, e.g.
+// "Now drawing from 'Battery Power'"
+func onBattery() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), PROBE_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "pmset", "-g", "batt").Output()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(string(out), "'Battery Power'")
+}
+
+// metered is always false; macOS only exposes whether a connection is
+// expensive through the Network framework
+func metered() bool {
+	return false
+}
@@ -0,0 +1,64 @@
+package power
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const powerSupplyDir = "/sys/class/power_supply"
+
+// onBattery reports whether the machine has an external power supply that is
+// unplugged. Desktops without one are never on battery.
+func onBattery() bool {
+	supplies, err := os.ReadDir(powerSupplyDir)
+	if err != nil {
+		return false
+	}
+
+	hasMains := false
+	for _, supply := range supplies {
+		dir := filepath.Join(powerSupplyDir, supply.Name())
+		if readAttr(dir, "type") != "Mains" {
+			continue
+		}
+		hasMains = true
+		if readAttr(dir, "online") == "1" {
+			return false
+		}
+	}
+	return hasMains
+}
+
+// metered asks NetworkManager whether the primary connection is metered,
+// either because the user said so or because NetworkManager guessed it, as
+// it does for mobile broadband and phone hotspots
+func metered() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), PROBE_TIMEOUT)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, "busctl", "--system", "get-property",
+		"org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered").Output()
+	if err != nil {
+		return false
+	}
+
+	// NMMetered: 1 yes, 3 guess yes
+	switch strings.TrimSpace(string(out)) {
+	case "u 1", "u 3":
+		return true
+	default:
+		return false
+	}
+}
+
+func readAttr(dir, name string) string {
+	value, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(value))
+}
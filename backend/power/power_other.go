@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package power
+
+// onBattery and metered are always false on platforms where they aren't
+// detected, so background syncing is never paused there
+func onBattery() bool {
+	return false
+}
+
+func metered() bool {
+	return false
+}
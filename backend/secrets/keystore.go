@@ -0,0 +1,21 @@
+package secrets
+
+import "fmt"
+
+// keystoreService is the service name entries are stored under in the
+// system keystore
+const keystoreService = "EmailTestApp"
+
+// Keystore stores small secrets in the operating system's credential store
+type Keystore interface {
+	Get(name string) ([]byte, error)
+	Set(name string, secret []byte) error
+	Delete(name string) error
+}
+
+// KeystoreKeyName is the name the data key with the given version is stored
+// under. Every rotation uses a new name so the old key stays readable until
+// the re-encrypted data has been committed.
+func KeystoreKeyName(keyVersion int64) string {
+	return fmt.Sprintf("data-key-%d", keyVersion)
+}
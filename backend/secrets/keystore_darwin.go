@@ -0,0 +1,52 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// keychainKeystore uses the login keychain through the security tool
+type keychainKeystore struct {
+	path string
+}
+
+// SystemKeystore returns the macOS keychain, or nil if the security tool
+// can't be found
+func SystemKeystore() Keystore {
+	path, err := exec.LookPath("security")
+	if err != nil {
+		return nil
+	}
+	return &keychainKeystore{path: path}
+}
+
+func (k *keychainKeystore) Get(name string) ([]byte, error) {
+	out, err := exec.Command(k.path, "find-generic-password", "-s", keystoreService, "-a", name, "-w").Output()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from keychain: %w", name, err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (k *keychainKeystore) Set(name string, secret []byte) error {
+	// -U updates the entry if it already exists. -w without a value, which
+	// has to come last, makes security prompt for the secret on stdin, so it
+	// never shows up in the process list; the prompt asks for it twice.
+	cmd := exec.Command(k.path, "add-generic-password", "-U", "-s", keystoreService, "-a", name, "-w")
+	encoded := base64.StdEncoding.EncodeToString(secret)
+	cmd.Stdin = strings.NewReader(encoded + "\n" + encoded + "\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error writing %s to keychain: %w: %s", name, err, out)
+	}
+	return nil
+}
+
+func (k *keychainKeystore) Delete(name string) error {
+	out, err := exec.Command(k.path, "delete-generic-password", "-s", keystoreService, "-a", name).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error deleting %s from keychain: %w: %s", name, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// secretToolKeystore uses the freedesktop Secret Service (GNOME Keyring,
+// KWallet) through libsecret's secret-tool
+type secretToolKeystore struct {
+	path string
+}
+
+// SystemKeystore returns the Secret Service keystore, or nil if secret-tool
+// isn't installed or there is no session bus to reach the service on
+func SystemKeystore() Keystore {
+	if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+		return nil
+	}
+	path, err := exec.LookPath("secret-tool")
+	if err != nil {
+		return nil
+	}
+	return &secretToolKeystore{path: path}
+}
+
+func (k *secretToolKeystore) Get(name string) ([]byte, error) {
+	out, err := exec.Command(k.path, "lookup", "service", keystoreService, "account", name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s from keystore: %w", name, err)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+}
+
+func (k *secretToolKeystore) Set(name string, secret []byte) error {
+	cmd := exec.Command(k.path, "store", "--label", keystoreService+" "+name, "service", keystoreService, "account", name)
+	cmd.Stdin = bytes.NewBufferString(base64.StdEncoding.EncodeToString(secret))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("error writing %s to keystore: %w: %s", name, err, out)
+	}
+	return nil
+}
+
+func (k *secretToolKeystore) Delete(name string) error {
+	if out, err := exec.Command(k.path, "clear", "service", keystoreService, "account", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("error deleting %s from keystore: %w: %s", name, err, out)
+	}
+	return nil
+}
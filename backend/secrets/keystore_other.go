@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package secrets
+
+// SystemKeystore returns nil on platforms without a supported keystore, so
+// the data key is always protected by a passphrase
+func SystemKeystore() Keystore {
+	return nil
+}
@@ -0,0 +1,106 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeySource is where the data key is kept between runs
+type KeySource string
+
+const (
+	KeySourcePassphrase KeySource = "passphrase"
+	KeySourceKeystore   KeySource = "keystore"
+)
+
+// KDFParams are the Argon2id cost parameters used to derive a key from a
+// passphrase. They are stored with the header so they can be raised later
+// without breaking existing databases.
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32 // KiB
+	Threads uint8
+}
+
+// DefaultKDFParams follow the second recommended option of RFC 9106
+var DefaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+const saltSize = 16
+
+// Header describes how the data key is protected. It is stored in the
+// database next to the data it protects.
+type Header struct {
+	Source KeySource
+	// KeyVersion goes up every time the data key is rotated. Keystore
+	// entries are named after it.
+	KeyVersion int64
+	// Salt, Params and WrappedKey are only set for KeySourcePassphrase
+	Salt       []byte
+	Params     KDFParams
+	WrappedKey []byte
+}
+
+// NewPassphraseHeader wraps key with a key derived from passphrase
+func NewPassphraseHeader(passphrase string, key []byte, keyVersion int64) (*Header, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase must not be empty")
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	header := &Header{
+		Source:     KeySourcePassphrase,
+		KeyVersion: keyVersion,
+		Salt:       salt,
+		Params:     DefaultKDFParams,
+	}
+
+	aead, err := newAEAD(deriveKey(passphrase, salt, header.Params))
+	if err != nil {
+		return nil, err
+	}
+	header.WrappedKey, err = seal(aead, key, header.wrapAD())
+	if err != nil {
+		return nil, err
+	}
+
+	return header, nil
+}
+
+// NewKeystoreHeader describes a data key kept in the system keystore
+func NewKeystoreHeader(keyVersion int64) *Header {
+	return &Header{Source: KeySourceKeystore, KeyVersion: keyVersion}
+}
+
+// UnwrapKey recovers the data key from a passphrase header. It returns
+// ErrWrongPassphrase if the passphrase doesn't match.
+func (h *Header) UnwrapKey(passphrase string) ([]byte, error) {
+	if h.Source != KeySourcePassphrase {
+		return nil, fmt.Errorf("data key is not protected by a passphrase")
+	}
+
+	aead, err := newAEAD(deriveKey(passphrase, h.Salt, h.Params))
+	if err != nil {
+		return nil, err
+	}
+	key, err := open(aead, h.WrappedKey, h.wrapAD())
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// wrapAD binds the wrapped key to its version
+func (h *Header) wrapAD() []byte {
+	return []byte(fmt.Sprintf("data-key-%d", h.KeyVersion))
+}
+
+func deriveKey(passphrase string, salt []byte, params KDFParams) []byte {
+	return argon2.IDKey([]byte(passphrase), salt, params.Time, params.Memory, params.Threads, KeySize)
+}
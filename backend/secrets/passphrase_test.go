@@ -0,0 +1,92 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the real parameters take 64 MiB and a noticeable fraction of a second
+	// for every key derivation
+	DefaultKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+	os.Exit(m.Run())
+}
+
+func TestPassphraseHeader(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := NewPassphraseHeader("correct horse", key, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Source != KeySourcePassphrase || header.KeyVersion != 3 || header.Params != DefaultKDFParams {
+		t.Errorf("got header %+v, want a version 3 passphrase header with the default parameters", header)
+	}
+	if bytes.Contains(header.WrappedKey, key) {
+		t.Error("the wrapped key contains the data key")
+	}
+
+	unwrapped, err := header.UnwrapKey("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Error("unwrapped a different key")
+	}
+
+	if _, err := header.UnwrapKey("wrong horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("wrong passphrase: got %v, want ErrWrongPassphrase", err)
+	}
+
+	// the wrapped key is bound to its version
+	moved := *header
+	moved.KeyVersion = 4
+	if _, err := moved.UnwrapKey("correct horse"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("changed version: got %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestPassphraseHeaderKeepsParams(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := NewPassphraseHeader("correct horse", key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// raising the defaults later doesn't break existing headers
+	defaults := DefaultKDFParams
+	DefaultKDFParams = KDFParams{Time: 2, Memory: 128, Threads: 1}
+	defer func() { DefaultKDFParams = defaults }()
+
+	if unwrapped, err := header.UnwrapKey("correct horse"); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Errorf("UnwrapKey = %v, want the data key", err)
+	}
+}
+
+func TestNewPassphraseHeaderRejectsEmpty(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewPassphraseHeader("", key, 1); err == nil {
+		t.Error("accepted an empty passphrase")
+	}
+}
+
+func TestKeystoreHeader(t *testing.T) {
+	header := NewKeystoreHeader(2)
+	if header.Source != KeySourceKeystore || header.KeyVersion != 2 {
+		t.Errorf("got header %+v, want a version 2 keystore header", header)
+	}
+	if _, err := header.UnwrapKey("anything"); err == nil {
+		t.Error("unwrapped a keystore header with a passphrase")
+	}
+}
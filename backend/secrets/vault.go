@@ -0,0 +1,204 @@
+// Package secrets encrypts account credentials before they are written to the
+// database.
+//
+// Credentials are sealed with AES-256-GCM under a random data key. The data
+// key itself is either kept in the operating system's keystore or wrapped with
+// a key derived from the user's passphrase with Argon2id, and is only held in
+// memory while the vault is unlocked.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// KeySize is the size of data keys in bytes (AES-256)
+const KeySize = 32
+
+// sealedPrefix marks a value encrypted by a Vault. Values without it are
+// plaintext left over from before encryption was set up.
+const sealedPrefix = "enc:v2:"
+
+// legacyPrefix marks a value sealed before values were bound to their owner.
+// Such values are only opened by UpgradeLegacy.
+const legacyPrefix = "enc:v1:"
+
+var (
+	ErrLocked          = errors.New("credentials are locked")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrNoKeystore      = errors.New("no system keystore available")
+	ErrLegacyValue     = errors.New("value was encrypted by an older version and needs upgrading")
+	errMalformedValue  = errors.New("malformed encrypted value")
+)
+
+// Vault holds the data key while the credentials are unlocked
+type Vault struct {
+	mu   sync.RWMutex
+	aead cipher.AEAD
+}
+
+// NewKey generates a random data key
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// NewVault returns a vault unlocked with the given data key
+func NewVault(key []byte) (*Vault, error) {
+	v := &Vault{}
+	if err := v.Unlock(key); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Unlock makes the vault use key for encryption and decryption
+func (v *Vault) Unlock(key []byte) error {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.aead = aead
+	return nil
+}
+
+// Lock forgets the data key
+func (v *Vault) Lock() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.aead = nil
+}
+
+func (v *Vault) Unlocked() bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.aead != nil
+}
+
+// Encrypt seals a value for storage. field and owner, such as the column and
+// the account the value belongs to, are bound to the ciphertext so a value
+// can't be moved to a different column or row. Empty values are stored as-is.
+func (v *Vault) Encrypt(field, owner, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.aead == nil {
+		return "", ErrLocked
+	}
+
+	sealed, err := seal(v.aead, []byte(plaintext), valueAD(field, owner))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt with the same field and owner.
+// Plaintext values are returned unchanged so rows written before encryption
+// was set up can still be read. Values from before owners were bound give
+// ErrLegacyValue until they are upgraded.
+func (v *Vault) Decrypt(field, owner, value string) (string, error) {
+	if strings.HasPrefix(value, legacyPrefix) {
+		return "", ErrLegacyValue
+	}
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.aead == nil {
+		return "", ErrLocked
+	}
+
+	plaintext, err := openValue(v.aead, strings.TrimPrefix(value, sealedPrefix), valueAD(field, owner))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting %s: %w", field, err)
+	}
+	return string(plaintext), nil
+}
+
+// UpgradeLegacy seals a value from before owners were bound again, bound to
+// owner. It reports whether the value was a legacy one; other values are
+// returned unchanged.
+func (v *Vault) UpgradeLegacy(field, owner, value string) (string, bool, error) {
+	if !strings.HasPrefix(value, legacyPrefix) {
+		return value, false, nil
+	}
+
+	v.mu.RLock()
+	aead := v.aead
+	v.mu.RUnlock()
+	if aead == nil {
+		return "", false, ErrLocked
+	}
+
+	plaintext, err := openValue(aead, strings.TrimPrefix(value, legacyPrefix), []byte(field))
+	if err != nil {
+		return "", false, fmt.Errorf("error decrypting %s: %w", field, err)
+	}
+	upgraded, err := v.Encrypt(field, owner, string(plaintext))
+	return upgraded, true, err
+}
+
+// IsEncrypted reports whether a stored value was sealed by a Vault
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix) || strings.HasPrefix(value, legacyPrefix)
+}
+
+// valueAD is the additional data binding a value to its field and owner.
+// Neither contains a NUL, so different pairs can't give the same bytes.
+func valueAD(field, owner string) []byte {
+	return []byte(field + "\x00" + owner)
+}
+
+func openValue(aead cipher.AEAD, encoded string, additionalData []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errMalformedValue
+	}
+	return open(aead, sealed, additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which is prepended to the result
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errMalformedValue
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
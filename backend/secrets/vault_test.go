@@ -0,0 +1,179 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestVault(t *testing.T) *Vault {
+	t.Helper()
+
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewVault(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+// sealLegacy encrypts a value the way vaults did before owners were bound
+func sealLegacy(t *testing.T, v *Vault, field, plaintext string) string {
+	t.Helper()
+
+	sealed, err := seal(v.aead, []byte(plaintext), []byte(field))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return legacyPrefix + base64.StdEncoding.EncodeToString(sealed)
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	v := newTestVault(t)
+
+	sealed, err := v.Encrypt("oauth_refresh_token", "alice@example.com", "refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(sealed) || strings.Contains(sealed, "refresh-token") {
+		t.Fatalf("got %q, want an encrypted value", sealed)
+	}
+
+	again, err := v.Encrypt("oauth_refresh_token", "alice@example.com", "refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == sealed {
+		t.Error("encrypting twice gave the same value, want a fresh nonce each time")
+	}
+
+	plaintext, err := v.Decrypt("oauth_refresh_token", "alice@example.com", sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "refresh-token" {
+		t.Errorf("got %q, want refresh-token", plaintext)
+	}
+}
+
+func TestVaultBindsFieldAndOwner(t *testing.T) {
+	v := newTestVault(t)
+
+	sealed, err := v.Encrypt("oauth_refresh_token", "alice@example.com", "refresh-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, field, owner string
+	}{
+		{"other column", "oauth_access_token", "alice@example.com"},
+		{"other account", "oauth_refresh_token", "bob@example.com"},
+		{"shifted separator", "oauth_refresh_token\x00alice", "@example.com"},
+	}
+	for _, test := range tests {
+		if _, err := v.Decrypt(test.field, test.owner, sealed); err == nil {
+			t.Errorf("%s: the value decrypted, want an error", test.name)
+		}
+	}
+}
+
+func TestVaultDecrypt(t *testing.T) {
+	v := newTestVault(t)
+
+	t.Run("plaintext", func(t *testing.T) {
+		for _, value := range []string{"", "app-password", "enc:v3:not ours"} {
+			got, err := v.Decrypt("app_specific_password", "alice@example.com", value)
+			if err != nil || got != value {
+				t.Errorf("Decrypt(%q) = %q, %v, want it unchanged", value, got, err)
+			}
+		}
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		sealed, err := v.Encrypt("app_specific_password", "alice@example.com", "")
+		if err != nil || sealed != "" {
+			t.Errorf("Encrypt(\"\") = %q, %v, want an empty value", sealed, err)
+		}
+	})
+
+	t.Run("other key", func(t *testing.T) {
+		sealed, err := newTestVault(t).Encrypt("app_specific_password", "alice@example.com", "app-password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := v.Decrypt("app_specific_password", "alice@example.com", sealed); err == nil {
+			t.Error("a value from another key decrypted, want an error")
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, value := range []string{sealedPrefix + "not base64!", sealedPrefix + "c2hvcnQ="} {
+			if _, err := v.Decrypt("app_specific_password", "alice@example.com", value); err == nil {
+				t.Errorf("Decrypt(%q) succeeded, want an error", value)
+			}
+		}
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		legacy := sealLegacy(t, v, "app_specific_password", "app-password")
+		if _, err := v.Decrypt("app_specific_password", "alice@example.com", legacy); !errors.Is(err, ErrLegacyValue) {
+			t.Errorf("got %v, want ErrLegacyValue", err)
+		}
+	})
+}
+
+func TestVaultLocked(t *testing.T) {
+	v := newTestVault(t)
+	sealed, err := v.Encrypt("app_specific_password", "alice@example.com", "app-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	v.Lock()
+	if v.Unlocked() {
+		t.Fatal("vault is unlocked after Lock")
+	}
+	if _, err := v.Encrypt("app_specific_password", "alice@example.com", "app-password"); !errors.Is(err, ErrLocked) {
+		t.Errorf("Encrypt got %v, want ErrLocked", err)
+	}
+	if _, err := v.Decrypt("app_specific_password", "alice@example.com", sealed); !errors.Is(err, ErrLocked) {
+		t.Errorf("Decrypt got %v, want ErrLocked", err)
+	}
+	// plaintext doesn't need the key
+	if got, err := v.Decrypt("app_specific_password", "alice@example.com", "app-password"); err != nil || got != "app-password" {
+		t.Errorf("Decrypt of plaintext = %q, %v, want it unchanged", got, err)
+	}
+}
+
+func TestUpgradeLegacy(t *testing.T) {
+	v := newTestVault(t)
+	legacy := sealLegacy(t, v, "oauth_refresh_token", "refresh-token")
+
+	upgraded, ok, err := v.UpgradeLegacy("oauth_refresh_token", "alice@example.com", legacy)
+	if err != nil || !ok {
+		t.Fatalf("UpgradeLegacy = %v, %v, want an upgraded value", ok, err)
+	}
+	if got, err := v.Decrypt("oauth_refresh_token", "alice@example.com", upgraded); err != nil || got != "refresh-token" {
+		t.Errorf("upgraded value decrypts to %q, %v, want refresh-token", got, err)
+	}
+	if _, err := v.Decrypt("oauth_refresh_token", "bob@example.com", upgraded); err == nil {
+		t.Error("upgraded value decrypts for another account, want an error")
+	}
+
+	// current and plaintext values are left alone
+	for _, value := range []string{upgraded, "plaintext", ""} {
+		if got, ok, err := v.UpgradeLegacy("oauth_refresh_token", "alice@example.com", value); err != nil || ok || got != value {
+			t.Errorf("UpgradeLegacy(%q) = %q, %v, %v, want it unchanged", value, got, ok, err)
+		}
+	}
+
+	// a legacy value of another column doesn't open
+	if _, _, err := v.UpgradeLegacy("oauth_access_token", "alice@example.com", legacy); err == nil {
+		t.Error("upgraded a value of another column, want an error")
+	}
+}
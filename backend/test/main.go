@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"email_test_app/backend/mail"
 	"fmt"
 	"os"
@@ -10,11 +11,12 @@ import (
 
 func main() {
 	godotenv.Load("../../.env")
-	client, err := mail.GetClient("imap.mail.me.com:993", "kade.angell@icloud.com", os.Getenv("APPLE_APP_SPECIFIC_PASSWORD"))
+	ctx := context.Background()
+	client, err := mail.GetClient(ctx, "imap.mail.me.com:993", mail.ConnectionSettings{}, "kade.angell@icloud.com", os.Getenv("APPLE_APP_SPECIFIC_PASSWORD"))
 	if err != nil {
 		panic(err)
 	}
-	mailboxes, err := mail.FetchMailboxes(client)
+	mailboxes, err := mail.FetchMailboxes(ctx, client)
 	if err != nil {
 		fmt.Printf("Error fetching mailboxes: %v", err)
 		os.Exit(1)
@@ -22,14 +24,14 @@ func main() {
 	for m := range mailboxes {
 		if mailboxes[m].Name == "INBOX" {
 			fmt.Println("Reading from Mailbox:", mailboxes[m].Name)
-			messages, err := mail.FetchEmailsForMailbox(client, mailboxes[m].Name, 1, 4)
+			messages, err := mail.FetchEmailsForMailbox(ctx, client, mailboxes[m].Name, 1, 4)
 			if err != nil {
 				fmt.Printf("Error fetching messages: %v", err)
 				os.Exit(1)
 			}
 			for msg := range messages {
 				fmt.Println("Message Subject:", messages[msg].Envelope.Subject)
-				messageBody, err := mail.FetchEmailBody(client, messages[msg].UID)
+				messageBody, err := mail.FetchEmailBody(ctx, client, messages[msg].UID)
 				if err != nil {
 					fmt.Printf("Error fetching email body: %v", err)
 					os.Exit(1)
@@ -4,34 +4,91 @@ import (
 	"context"
 	"database/sql"
 	"email_test_app/backend/auth"
+	"email_test_app/backend/db"
 	"email_test_app/backend/mail"
+	"email_test_app/backend/power"
+	"email_test_app/backend/secrets"
 	"fmt"
 	"log"
-	"net/http"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-imap/client"
 	"github.com/wailsapp/wails/v2/pkg/runtime"
+	"golang.org/x/oauth2"
 )
 
-type EmailBodyCacheEntry struct {
-	Body      string
-	CacheTime time.Time
-}
+// emitEvent sends an event to the frontend. Tests replace it, since the Wails
+// runtime only exists while the app runs.
+var emitEvent = runtime.EventsEmit
 
 // App struct
 type App struct {
-	ctx      context.Context
-	accounts map[int64]auth.Account
-
-	oauthState       string
-	oauthCodeChannel chan string
-	httpServer       *http.Server
-
-	mailboxUpdateTicker *time.Ticker
-	emailUpdateTicker   *time.Ticker
+	ctx           context.Context
+	accounts      map[int64]auth.Account
+	accountsMutex sync.RWMutex
+
+	// tokenMutex serializes OAuth token refreshes so that a rotated refresh
+	// token is never used twice
+	tokenMutex sync.Mutex
+
+	oauthFlow  *oauthFlow
+	oauthMutex sync.Mutex
+
+	// pool keeps connections to each account's IMAP server open between calls
+	pool *mail.Pool
+
+	// opsCtx is cancelled at shutdown to abort all IMAP operations;
+	// accountOps holds a context per account derived from it
+	opsCtx          context.Context
+	cancelOps       context.CancelFunc
+	accountOps      map[int64]accountOperations
+	accountOpsMutex sync.Mutex
+
+	// bodyFetch is the message body being fetched for the reader, if any
+	bodyFetch      *bodyFetch
+	bodyFetchMutex sync.Mutex
+
+	// prefetchers fetch message bodies into the cache in the background
+	prefetchers      map[int64]*bodyPrefetcher
+	prefetchersMutex sync.Mutex
+
+	// syncWorkers runs each account's mailbox and message syncing
+	syncWorkers      map[int64]*syncWorker
+	syncWorkersMutex sync.Mutex
+
+	// syncProgress tracks the syncs in progress for GetSyncStatus
+	syncProgress      map[syncProgressKey]*trackedProgress
+	syncProgressMutex sync.Mutex
+
+	// schedule holds when each mailbox is next synced in the background
+	schedule      map[scheduleKey]*scheduleEntry
+	schedulerStop chan struct{}
+	scheduleMutex sync.Mutex
+
+	// syncSettings and powerStatus cache what IsSyncPaused goes by between
+	// scheduler ticks; syncSettings is nil until read
+	syncSettings   *SyncSettings
+	powerStatus    power.Status
+	powerCheckedAt time.Time
+	syncPauseMutex sync.Mutex
+
+	// cacheStop stops the cache maintenance loop; cacheMaintenanceMutex
+	// keeps evictions and vacuums from overlapping
+	cacheStop             chan struct{}
+	cacheMutex            sync.Mutex
+	cacheMaintenanceMutex sync.Mutex
+
+	mailboxOrders     map[mailboxOrderKey]mailboxOrder
+	mailboxOrderMutex sync.Mutex
 
 	db *sql.DB
+
+	// vault holds the key account credentials are encrypted with while they
+	// are unlocked. vaultMutex serializes setup, unlock and key rotation.
+	vault      *secrets.Vault
+	keystore   secrets.Keystore
+	vaultMutex sync.Mutex
 }
 
 // NewApp creates a new App application struct
@@ -39,28 +96,40 @@ func NewApp() *App {
 	return &App{}
 }
 
-func (a *App) LoginUserWithOAuth(providerName string) bool {
+func (a *App) LoginUserWithOAuth(providerName string) error {
 	err := a.StartOAuth(providerName)
 	if err != nil {
 		log.Println("OAuth login failed:", err)
-		return false
+		return err
 	}
 
 	a.startUpdateLoops()
 
-	return true
+	return nil
 }
 
-func (a *App) LoginUser(imapUrl, emailAddr, emailAppPassword string) int64 {
+// LoginUser signs in with a password and returns the new account's ID.
+// Signing in to an existing account again keeps its connection settings.
+func (a *App) LoginUser(imapUrl, emailAddr, emailAppPassword string) (int64, error) {
+	var settings mail.ConnectionSettings
+	if account, ok := a.getAccountByEmail(emailAddr); ok {
+		settings = account.Connection
+	}
+	return a.LoginUserWithSettings(imapUrl, emailAddr, emailAppPassword, settings)
+}
+
+// LoginUserWithSettings logs in like LoginUser, using STARTTLS, a custom CA,
+// a client certificate or other connection settings
+func (a *App) LoginUserWithSettings(imapUrl, emailAddr, emailAppPassword string, settings mail.ConnectionSettings) (int64, error) {
 	// Attempt to connect and login with the provided credentials
-	err := mail.WithClient(imapUrl, emailAddr, emailAppPassword, func(c *client.Client) error {
+	err := mail.WithClient(a.opsCtx, imapUrl, settings, emailAddr, emailAppPassword, func(c *client.Client) error {
 		// Connection and login successful
 		return nil
 	})
 
 	if err != nil {
 		log.Println("Login failed:", err)
-		return -1
+		return 0, mail.ServerError(err)
 	}
 
 	// Store the credentials in the App struct
@@ -68,73 +137,198 @@ func (a *App) LoginUser(imapUrl, emailAddr, emailAppPassword string) int64 {
 		Email:               emailAddr,
 		ImapUrl:             imapUrl,
 		AppSpecificPassword: emailAppPassword,
+		AuthState:           auth.AuthStateActive,
+		Connection:          settings,
 	}
 
 	err = a.updateAccounts(&newAccount)
 	if err != nil {
 		log.Println("Error updating accounts:", err)
-		return -1
+		return 0, internalError(err)
 	}
 
 	a.startUpdateLoops()
 
-	return newAccount.Id
+	return newAccount.Id, nil
+}
+
+// GetConnectionSettings returns the account's IMAP connection settings with
+// the client key left out
+func (a *App) GetConnectionSettings(accountId int64) (mail.ConnectionSettings, error) {
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		return mail.ConnectionSettings{}, errAccountNotFound(accountId)
+	}
+
+	settings := account.Connection
+	settings.ClientKeyPEM = ""
+	return settings, nil
 }
 
+// SetConnectionSettings changes how the account connects to its server. The
+// new settings are tried before they are saved. An empty client key keeps
+// the current one.
+func (a *App) SetConnectionSettings(accountId int64, settings mail.ConnectionSettings) error {
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		log.Println("Account not found for ID:", accountId)
+		return errAccountNotFound(accountId)
+	}
+
+	if settings.ClientKeyPEM == "" && settings.ClientCertPEM != "" {
+		settings.ClientKeyPEM = account.Connection.ClientKeyPEM
+	}
+
+	// check that the server can be reached with the new settings; the
+	// credentials themselves haven't changed
+	c, err := mail.Dial(a.opsCtx, account.ImapUrl, settings)
+	if err != nil {
+		log.Println("Error connecting with new settings:", err)
+		return mail.ServerError(err)
+	}
+	c.Logout()
+
+	a.accountsMutex.Lock()
+	defer a.accountsMutex.Unlock()
+
+	stored, err := db.EncryptConnectionSettings(a.vault, account.Email, settings)
+	if err == nil {
+		_, err = a.db.Exec("UPDATE accounts SET connection_settings = ? WHERE id = ?", stored, accountId)
+	}
+	if err != nil {
+		log.Println("Error saving connection settings:", err)
+		return internalError(err)
+	}
+
+	if account, ok := a.accounts[accountId]; ok {
+		account.Connection = settings
+		a.accounts[accountId] = account
+	}
+	a.pool.CloseAccount(accountId)
+
+	return nil
+}
+
+// GetAccountIds returns the accounts that haven't been logged out, including
+// those that need to sign in again
 func (a *App) GetAccountIds() []int64 {
+	a.accountsMutex.RLock()
+	defer a.accountsMutex.RUnlock()
+
 	ids := make([]int64, 0, len(a.accounts))
 	for _, account := range a.accounts {
-		ids = append(ids, account.Id)
+		if account.AuthState != auth.AuthStateSignedOut {
+			ids = append(ids, account.Id)
+		}
 	}
 	return ids
 }
 
+// IsLoggedIn reports whether the account's credentials are usable
 func (a *App) IsLoggedIn(accountId int64) bool {
-	_, ok := a.accounts[accountId]
+	account, ok := a.getAccount(accountId)
 	if !ok {
 		log.Println("Account not found for ID:", accountId)
-		log.Println("Accounts:", a.accounts)
+		return false
 	}
 
-	return ok
+	return account.AuthState == auth.AuthStateActive
+}
+
+// GetAccountAuthState returns active, needs_reauth or signed_out
+func (a *App) GetAccountAuthState(accountId int64) auth.AuthState {
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		return auth.AuthStateSignedOut
+	}
+	return account.AuthState
+}
+
+// setAuthState records whether an account's credentials still work
+func (a *App) setAuthState(accountId int64, state auth.AuthState) error {
+	a.accountsMutex.Lock()
+	defer a.accountsMutex.Unlock()
+
+	if err := db.SetAccountAuthState(a.db, accountId, state); err != nil {
+		return fmt.Errorf("error saving account auth state: %w", err)
+	}
+	if account, ok := a.accounts[accountId]; ok {
+		account.AuthState = state
+		a.accounts[accountId] = account
+	}
+	return nil
+}
+
+// getAccount returns a copy of the account with the given ID
+func (a *App) getAccount(accountId int64) (auth.Account, bool) {
+	a.accountsMutex.RLock()
+	defer a.accountsMutex.RUnlock()
+
+	account, ok := a.accounts[accountId]
+	return account, ok
+}
+
+// getAccountByEmail returns a copy of the account with the given address
+func (a *App) getAccountByEmail(email string) (auth.Account, bool) {
+	a.accountsMutex.RLock()
+	defer a.accountsMutex.RUnlock()
+
+	for _, account := range a.accounts {
+		if account.Email == email {
+			return account, true
+		}
+	}
+	return auth.Account{}, false
 }
 
 func (a *App) updateAccounts(newAccount *auth.Account) error {
+	a.accountsMutex.Lock()
+	defer a.accountsMutex.Unlock()
+
+	if newAccount.AuthState == "" {
+		newAccount.AuthState = auth.AuthStateActive
+	}
+
+	stored, err := db.EncryptCredentials(a.vault, *newAccount)
+	if err != nil {
+		return fmt.Errorf("error encrypting account credentials: %w", err)
+	}
+	connectionSettings, err := db.EncryptConnectionSettings(a.vault, newAccount.Email, newAccount.Connection)
+	if err != nil {
+		return fmt.Errorf("error encrypting connection settings: %w", err)
+	}
+
 	// Update the accounts in the DB
 	for _, account := range a.accounts {
-		log.Println("Checking account:", account)
 		if account.Email == newAccount.Email {
-			var err error
-			log.Println("Updating account:", account, "with new account:", newAccount)
+			log.Println("Updating account:", account.Id, account.Email)
 			// update the account
-			result, err := a.db.Exec(`
+			_, err := a.db.Exec(`
 				UPDATE accounts 
-				SET imap_url = ?, oauth_access_token = ?, oauth_refresh_token = ?, oauth_expiry = ?, app_specific_password = ?
-				WHERE email = ?
-			`, newAccount.ImapUrl, newAccount.OAuthAccessToken, newAccount.OAuthRefreshToken, newAccount.OAuthExpiry, newAccount.AppSpecificPassword, newAccount.Email)
+				SET imap_url = ?, oauth_access_token = ?, oauth_refresh_token = ?, oauth_expiry = ?, app_specific_password = ?, provider = ?, auth_state = ?, connection_settings = ?
+				WHERE id = ?
+			`, stored.ImapUrl, stored.OAuthAccessToken, stored.OAuthRefreshToken, stored.OAuthExpiry, stored.AppSpecificPassword, stored.Provider, stored.AuthState, connectionSettings, account.Id)
 			if err != nil {
 				return fmt.Errorf("error updating accounts in the database: %v", err)
 			}
 
-			newAccount.Id, err = result.LastInsertId()
-			if err != nil {
-				return fmt.Errorf("error getting account ID: %v", err)
-			}
-
+			newAccount.Id = account.Id
 			account = *newAccount
 
 			// Update the accounts map
 			a.accounts[account.Id] = account
+
+			// connections logged in with the old credentials shouldn't be reused
+			a.pool.CloseAccount(account.Id)
 			return nil
 		}
 	}
 
 	// Insert the new account
-	var err error
 	result, err := a.db.Exec(`
-		INSERT INTO accounts (email, imap_url, oauth_access_token, oauth_refresh_token, oauth_expiry, app_specific_password)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, newAccount.Email, newAccount.ImapUrl, newAccount.OAuthAccessToken, newAccount.OAuthRefreshToken, newAccount.OAuthExpiry, newAccount.AppSpecificPassword)
+		INSERT INTO accounts (email, imap_url, oauth_access_token, oauth_refresh_token, oauth_expiry, app_specific_password, provider, auth_state, connection_settings)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, stored.Email, stored.ImapUrl, stored.OAuthAccessToken, stored.OAuthRefreshToken, stored.OAuthExpiry, stored.AppSpecificPassword, stored.Provider, stored.AuthState, connectionSettings)
 	if err != nil {
 		return fmt.Errorf("error inserting account into the database: %v", err)
 	}
@@ -147,27 +341,112 @@ func (a *App) updateAccounts(newAccount *auth.Account) error {
 	// Update the accounts map
 	a.accounts[newAccount.Id] = *newAccount
 
-	log.Println("Accounts Updated. Accounts:", a.accounts)
+	log.Println("Account added:", newAccount.Id, newAccount.Email)
 
 	return nil
 }
 
-func (a *App) LogoutUser(accountId int64) {
-	// Remove the account's tokens and password from the App struct and database
-	account, ok := a.accounts[accountId]
+// resumeSessions checks the stored credentials of every signed in account by
+// connecting to its server, then starts syncing the accounts that still work.
+// Rejected credentials mark the account as needing to sign in again.
+func (a *App) resumeSessions() {
+	resumed := make([]int64, 0)
+	for _, accountId := range a.GetAccountIds() {
+		if !a.IsLoggedIn(accountId) {
+			continue
+		}
+
+		err := a.withAccountClient(a.accountContext(accountId), accountId, func(c *mail.Conn) error {
+			return nil
+		})
+		if err != nil {
+			// network errors leave the account active so the next sync retries
+			log.Println("Error validating account", accountId, ":", err)
+		}
+		if a.IsLoggedIn(accountId) {
+			resumed = append(resumed, accountId)
+		}
+	}
+
+	emitEvent(a.ctx, "SessionsResumed", resumed)
+
+	if len(resumed) > 0 {
+		a.startUpdateLoops()
+	}
+}
+
+// LogoutUser signs the account out: its tokens and password are removed from
+// the App struct and database, but the account and its cached mail are kept
+// so signing in again doesn't start from scratch
+func (a *App) LogoutUser(accountId int64) error {
+	account, ok := a.getAccount(accountId)
 	if !ok {
-		log.Println("Account not found.")
-		return
+		return errAccountNotFound(accountId)
 	}
 
 	account.OAuthAccessToken = ""
 	account.OAuthRefreshToken = ""
 	account.OAuthExpiry = 0
 	account.AppSpecificPassword = ""
+	account.AuthState = auth.AuthStateSignedOut
 
-	a.updateAccounts(&account)
+	if err := a.updateAccounts(&account); err != nil {
+		log.Println("Error logging out:", err)
+		return internalError(err)
+	}
 
 	a.endUpdateLoops(accountId)
 
-	runtime.EventsEmit(a.ctx, "UserLoggedOut", accountId)
+	emitEvent(a.ctx, "UserLoggedOut", accountId)
+	return nil
+}
+
+// RemoveAccount deletes an account and everything cached for it. OAuth tokens
+// are revoked at the provider first so they can't be used again; a failed
+// revocation is logged but doesn't stop the removal.
+func (a *App) RemoveAccount(accountId int64) error {
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		log.Println("Account not found for ID:", accountId)
+		return errAccountNotFound(accountId)
+	}
+
+	// wait for a sync in progress so it doesn't write to the deleted account
+	<-a.endUpdateLoops(accountId)
+
+	if account.OAuthAccessToken != "" || account.OAuthRefreshToken != "" {
+		if provider, err := auth.GetProvider(account.Provider); err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err = provider.RevokeToken(ctx, &oauth2.Token{
+				AccessToken:  account.OAuthAccessToken,
+				RefreshToken: account.OAuthRefreshToken,
+			})
+			cancel()
+			if err != nil {
+				log.Println("Error revoking token:", err)
+			}
+		}
+	}
+
+	a.accountsMutex.Lock()
+	err := db.DeleteAccount(a.db, accountId)
+	if err == nil {
+		delete(a.accounts, accountId)
+	}
+	a.accountsMutex.Unlock()
+	if err != nil {
+		log.Println("Error removing account:", err)
+		return internalError(err)
+	}
+
+	a.pool.CloseAccount(accountId)
+	a.forgetMailboxOrders(accountId)
+
+	if err := db.IncrementalVacuum(a.db); err != nil {
+		log.Println("Error vacuuming database:", err)
+	}
+
+	emitEvent(a.ctx, "AccountRemoved", accountId)
+
+	return nil
 }
@@ -0,0 +1,124 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/auth"
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"email_test_app/backend/secrets"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// newTestApp returns an app with a fresh database and an unlocked vault, as
+// Startup leaves it before any account is added
+func newTestApp(t *testing.T) *App {
+	t.Helper()
+
+	database, err := db.InitDB(t.TempDir() + "/app.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	key, err := secrets.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault, err := secrets.NewVault(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &App{
+		ctx:      context.Background(),
+		accounts: make(map[int64]auth.Account),
+		pool:     mail.NewPool(),
+		db:       database,
+		vault:    vault,
+	}
+	a.opsCtx, a.cancelOps = context.WithCancel(context.Background())
+	t.Cleanup(func() {
+		a.cancelOps()
+		a.pool.Close()
+	})
+	return a
+}
+
+// addTestAccount stores an account the way a login does
+func addTestAccount(t *testing.T, a *App, account auth.Account) int64 {
+	t.Helper()
+
+	if err := a.updateAccounts(&account); err != nil {
+		t.Fatal(err)
+	}
+	return account.Id
+}
+
+type event struct {
+	name string
+	data []interface{}
+}
+
+// eventLog collects the events sent to the frontend
+type eventLog struct {
+	mutex  sync.Mutex
+	events []event
+}
+
+// recordEvents captures the events sent to the frontend until the test ends
+func recordEvents(t *testing.T) *eventLog {
+	log := &eventLog{}
+	emit := emitEvent
+	emitEvent = func(ctx context.Context, name string, data ...interface{}) {
+		log.mutex.Lock()
+		defer log.mutex.Unlock()
+		log.events = append(log.events, event{name, data})
+	}
+	t.Cleanup(func() { emitEvent = emit })
+	return log
+}
+
+// named returns the data of every event with the given name
+func (l *eventLog) named(name string) [][]interface{} {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var data [][]interface{}
+	for _, e := range l.events {
+		if e.name == name {
+			data = append(data, e.data)
+		}
+	}
+	return data
+}
+
+// assertErrorCode checks that err is a *mail.Error with the given code
+func assertErrorCode(t *testing.T, err error, code mail.ErrorCode) {
+	t.Helper()
+
+	var mailErr *mail.Error
+	if !errors.As(err, &mailErr) {
+		t.Fatalf("got %T %v, want a *mail.Error", err, err)
+	}
+	if mailErr.Code != code {
+		t.Fatalf("got code %q (%v), want %q", mailErr.Code, err, code)
+	}
+}
+
+func TestAccountBindingErrors(t *testing.T) {
+	a := newTestApp(t)
+
+	_, err := a.GetConnectionSettings(42)
+	assertErrorCode(t, err, mail.ErrorNotFound)
+	assertErrorCode(t, a.LogoutUser(42), mail.ErrorNotFound)
+
+	accountId := addTestAccount(t, a, auth.Account{
+		Email:     "user@example.com",
+		ImapUrl:   "imap.example.com:993",
+		AuthState: auth.AuthStateSignedOut,
+	})
+	assertErrorCode(t, a.UpdateMailboxes(accountId), mail.ErrorAuthRequired)
+	assertErrorCode(t, a.UpdateMessages(accountId, "INBOX"), mail.ErrorAuthRequired)
+}
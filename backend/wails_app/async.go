@@ -1,236 +1,228 @@
 package wails_app
 
 import (
+	"context"
 	"database/sql"
-	"email_test_app/backend/auth"
+	"email_test_app/backend/db"
 	"email_test_app/backend/mail"
 	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
-	"sync"
+	"maps"
 	"time"
 
 	"github.com/emersion/go-imap"
-	"github.com/emersion/go-imap/client"
-	"github.com/wailsapp/wails/v2/pkg/runtime"
-	"golang.org/x/oauth2"
 )
 
+// startUpdateLoops syncs every signed in account once, immediately, and
+// makes sure the scheduler keeps them in sync from then on
 func (a *App) startUpdateLoops() {
-	a.mailboxUpdateTicker.Reset(MAILBOX_UPDATE_TIME)
-	a.emailUpdateTicker.Reset(EMAIL_UPDATE_TIME)
-
-	// Run once, immediately
-	go func() {
-		for _, account := range a.accounts {
-			a.UpdateMailboxes(account.Id)
-			for _, mailbox := range a.GetMailboxes(account.Id) {
-				a.UpdateMessages(account.Id, mailbox)
-			}
-		}
-	}()
+	for _, accountId := range a.GetAccountIds() {
+		a.syncWorker(accountId).enqueue(syncJob{kind: syncAccountJob}, syncPriorityBackground)
+	}
 
-	// go func() {
-	// 	for range a.mailboxUpdateTicker.C {
-	// 		a.UpdateMailboxes()
-	// 	}
-	// }()
-
-	// go func() {
-	// 	for range a.emailUpdateTicker.C {
-	// 		mailboxes := a.GetMailboxes()
-	// 		for _, mailbox := range mailboxes {
-	// 			a.UpdateMessages(mailbox)
-	// 		}
-	// 	}
-	// }()
+	a.startScheduler()
 }
 
-func (a *App) endUpdateLoops(accountId int64) {
-	a.mailboxUpdateTicker.Stop()
-	a.emailUpdateTicker.Stop()
+// endUpdateLoops stops syncing the account and prefetching its bodies. The
+// returned channel is closed once the sync job in progress, if any, has
+// finished.
+func (a *App) endUpdateLoops(accountId int64) <-chan struct{} {
+	a.forgetSchedule(accountId)
+	a.stopBodyPrefetch(accountId)
+	a.cancelAccountOperations(accountId)
+	return a.stopSyncWorker(accountId)
 }
 
-var mailboxUpdateMutex sync.Mutex
+// UpdateMailboxes queues a refresh of the account's mailbox list ahead of
+// background syncing
+func (a *App) UpdateMailboxes(accountId int64) error {
+	if !a.IsLoggedIn(accountId) {
+		return errNotLoggedIn(accountId)
+	}
 
-func (a *App) UpdateMailboxes(accountId int64) {
+	a.syncWorker(accountId).enqueue(syncJob{kind: syncMailboxesJob}, syncPriorityUser)
+	return nil
+}
+
+// UpdateMessages queues a check for new messages in the mailbox ahead of
+// background syncing
+func (a *App) UpdateMessages(accountId int64, mailboxName string) error {
 	if !a.IsLoggedIn(accountId) {
-		log.Println("UpdateMailboxes: User not logged in.")
-		return
+		return errNotLoggedIn(accountId)
 	}
 
-	log.Println("Updating mailboxes")
+	a.syncWorker(accountId).enqueue(syncJob{kind: syncMessagesJob, mailbox: mailboxName}, syncPriorityUser)
+	return nil
+}
 
-	// use a mutex to prevent multiple updates at the same time
-	if !mailboxUpdateMutex.TryLock() {
-		log.Println("UpdateMailboxes: Update already in progress.")
-		return
+// syncMailboxes refreshes the account's mailbox list from the server
+func (a *App) syncMailboxes(ctx context.Context, accountId int64) error {
+	if !a.IsLoggedIn(accountId) {
+		return fmt.Errorf("account %d is not logged in", accountId)
 	}
-	defer mailboxUpdateMutex.Unlock()
 
-	var mailboxes []string
+	log.Println("Updating mailboxes")
+	a.reportProgress(SyncProgress{AccountId: accountId, Phase: SyncPhaseMailboxes})
+
+	var mailboxes map[string]mail.MailboxRole
 	var err error
 
-	fetchMailboxes := func(c *client.Client) error {
-		mboxes, err := mail.FetchMailboxes(c)
+	fetchMailboxes := func(c *mail.Conn) error {
+		mboxes, err := mail.FetchMailboxes(ctx, c.Client)
 		if err != nil {
 			return err
 		}
-		mailboxes = make([]string, len(mboxes))
-		for i, mbox := range mboxes {
-			mailboxes[i] = mbox.Name
-		}
+		mailboxes = mail.MailboxRoles(mboxes)
 		return nil
 	}
 
-	account, ok := a.accounts[accountId]
-	if !ok {
-		log.Println("Account not found for ID:", accountId)
-		return
-	}
-
-	if account.OAuthAccessToken != "" {
-		oauthConfig := auth.GmailOAuthConfig // TODO: Add support for other OAuth providers
-		_, err = mail.WithOAuthClient(account.ImapUrl,
-			account.Email,
-			&oauth2.Token{
-				AccessToken:  account.OAuthAccessToken,
-				RefreshToken: account.OAuthRefreshToken,
-				Expiry:       time.Unix(account.OAuthExpiry, 0),
-			},
-			oauthConfig,
-			fetchMailboxes)
-	} else {
-		err = mail.WithClient(account.ImapUrl, account.Email, account.AppSpecificPassword, fetchMailboxes)
-	}
+	err = a.withAccountClient(ctx, accountId, fetchMailboxes)
 
 	if err != nil {
-		log.Println("Error fetching mailboxes from server:", err)
-		return
+		return fmt.Errorf("error fetching mailboxes from server: %w", err)
 	}
 
 	tx, err := a.db.Begin()
 	if err != nil {
-		log.Println("Error starting transaction to update mailboxes:", err)
-		return
+		return fmt.Errorf("error starting transaction to update mailboxes: %w", err)
 	}
 	defer tx.Rollback()
 
 	// check if the existing mailboxes are the same as the new ones
-	mailboxesMatch := true
-	existingMailboxes := a.GetMailboxes(accountId)
-	if len(existingMailboxes) == len(mailboxes) {
-		for _, name := range mailboxes {
-			nameFound := false
-			for _, existingName := range existingMailboxes {
-				if name == existingName {
-					nameFound = true
-					break
-				}
-			}
-			if !nameFound {
-				mailboxesMatch = false
-				break
-			}
-		}
-	} else {
-		mailboxesMatch = false
+	existingMailboxes, err := a.getMailboxRoles(accountId)
+	if err != nil {
+		return fmt.Errorf("error querying mailboxes from database: %w", err)
 	}
+	mailboxesMatch := maps.Equal(existingMailboxes, mailboxes)
 
 	if !mailboxesMatch {
 		// Clear the existing mailboxes
-		_, err = tx.Exec("DELETE FROM mailboxes")
+		_, err = tx.Exec("DELETE FROM mailboxes WHERE account_id = ?", accountId)
 		if err != nil {
-			log.Println("Error clearing mailboxes:", err)
-			return
+			return fmt.Errorf("error clearing mailboxes: %w", err)
 		}
 
-		stmt, err := tx.Prepare("INSERT INTO mailboxes (name, account_id) VALUES (?, ?)")
+		stmt, err := tx.Prepare("INSERT INTO mailboxes (name, account_id, role) VALUES (?, ?, ?)")
 		if err != nil {
-			log.Println("Error preparing statement to insert mailboxes:", err)
-			return
+			return fmt.Errorf("error preparing statement to insert mailboxes: %w", err)
 		}
 		defer stmt.Close()
 
-		for _, name := range mailboxes {
-			_, err = stmt.Exec(name, accountId)
+		for name, role := range mailboxes {
+			_, err = stmt.Exec(name, accountId, role)
 			if err != nil {
 				log.Println("Error inserting mailbox:", err)
 			}
 		}
 
 		if err := tx.Commit(); err != nil {
-			log.Println("Error committing transaction to update mailboxes:", err)
-			return
+			return fmt.Errorf("error committing transaction to update mailboxes: %w", err)
 		}
 
-		mailboxesFromDB := a.GetMailboxes(accountId)
-		log.Println("Mailboxes updated:", mailboxesFromDB)
+		log.Println("Mailboxes updated:", mailboxes)
 
-		runtime.EventsEmit(a.ctx, "MailboxesUpdated")
+		emitEvent(a.ctx, "MailboxesUpdated")
 	} else {
 		log.Println("Mailboxes match, not updating.")
 	}
-}
 
-var messageUpdateMutex sync.Mutex
+	return nil
+}
 
-func (a *App) UpdateMessages(accountId int64, mailboxName string) {
+// syncMessages fetches the messages in the mailbox that aren't cached yet. The
+// first sync only reaches back as far as the mailbox's sync window; later
+// ones look for messages from the oldest one synced on, and older messages
+// are left to backfillMessages.
+func (a *App) syncMessages(ctx context.Context, accountId int64, mailboxName string) error {
 	if !a.IsLoggedIn(accountId) {
-		log.Println("UpdateMessages: User not logged in.")
-		return
-	}
-
-	account, ok := a.accounts[accountId]
-	if !ok {
-		log.Println("Account not found for ID:", accountId)
-		return
+		return fmt.Errorf("account %d is not logged in", accountId)
 	}
 
 	log.Println("Updating messages for mailbox:", mailboxName)
 
-	// Use a mutex to prevent multiple updates at the same time
-	if !messageUpdateMutex.TryLock() {
-		log.Println("UpdateMessages: Update already in progress.")
-		return
-	}
-	defer messageUpdateMutex.Unlock()
-
 	existingUIDs, err := fetchExistingUIDs(a.db, accountId, mailboxName)
 	if err != nil {
-		log.Println("Error fetching existing UIDs from database:", err)
-		return
+		return fmt.Errorf("error fetching existing UIDs from database: %w", err)
 	}
 	existingUIDSet := make(map[uint32]struct{}, len(existingUIDs))
 	for _, uid := range existingUIDs {
 		existingUIDSet[uid] = struct{}{}
 	}
 
+	undatedUIDs, err := fetchUndatedUIDs(a.db, accountId, mailboxName)
+	if err != nil {
+		return fmt.Errorf("error fetching undated UIDs from database: %w", err)
+	}
+
+	oldestUID, complete, err := db.GetSyncedRange(a.db, accountId, mailboxName)
+	if err != nil {
+		return err
+	}
+	window, err := a.syncWindow(accountId, mailboxName)
+	if err != nil {
+		return err
+	}
+
 	var newMessages []mail.SerializableMessage
+	var backfilledMessages []mail.SerializableMessage
+	// flaggedUIDs is nil if the flagged messages couldn't be searched
+	var flaggedUIDs []uint32
+
+	progress := SyncProgress{AccountId: accountId, MailboxName: mailboxName}
+
+	fetchMessages := func(c *mail.Conn) error {
+		// the pool runs this again if the connection was dropped
+		newMessages = nil
 
-	fetchMessages := func(c *client.Client) error {
 		mbox, err := c.Select(mailboxName, false)
 		if err != nil {
 			return fmt.Errorf("failed to select mailbox: %v", err)
 		}
 
-		seqSet := new(imap.SeqSet)
-		seqSet.AddRange(1, mbox.Messages)
-		items := []imap.FetchItem{imap.FetchUid}
+		progress.Phase, progress.Fetched, progress.Total, progress.Bytes = SyncPhaseListing, 0, int(mbox.Messages), 0
+		a.reportProgress(progress)
+
+		// Messages cached before we stored INTERNALDATE and size need them
+		// fetched once
+		backfilledMessages, err = mail.FetchDatesAndSizes(c.Client, mailboxName, undatedUIDs)
+		if err != nil {
+			log.Println("Error backfilling message dates:", err)
+		}
 
-		messages := make(chan *imap.Message, 10)
-		go func() {
-			if err := c.Fetch(seqSet, items, messages); err != nil {
-				log.Println("Error fetching message UIDs:", err)
+		if oldestUID == 0 {
+			if len(existingUIDs) > 0 {
+				// mailboxes cached before sync windows were synced in full
+				oldestUID, complete = 1, true
+			} else {
+				oldestUID, complete, err = mail.WindowStart(c.Client, window)
+				if err != nil {
+					return err
+				}
 			}
-		}()
+		}
 
 		var newUIDs []uint32
-		for msg := range messages {
-			if _, exists := existingUIDSet[msg.Uid]; !exists {
-				newUIDs = append(newUIDs, msg.Uid)
+		if oldestUID != 0 {
+			uids, err := mail.UIDsFrom(c.Client, oldestUID)
+			if err != nil {
+				return err
+			}
+			for _, uid := range uids {
+				if _, exists := existingUIDSet[uid]; !exists {
+					newUIDs = append(newUIDs, uid)
+				}
 			}
+			progress.Fetched, progress.Total = len(uids), len(uids)
+			a.reportProgress(progress)
+		}
+
+		// which messages are starred decides whose bodies stay cached
+		flaggedUIDs, err = mail.FetchFlaggedUIDs(c.Client)
+		if err != nil {
+			log.Println("Error fetching flagged messages:", err)
+		} else if flaggedUIDs == nil {
+			flaggedUIDs = []uint32{}
 		}
 
 		if len(newUIDs) == 0 {
@@ -238,89 +230,207 @@ func (a *App) UpdateMessages(accountId int64, mailboxName string) {
 			return nil
 		}
 
-		seqSet = new(imap.SeqSet)
-		seqSet.AddNum(newUIDs...)
-		items = []imap.FetchItem{imap.FetchEnvelope, imap.FetchBodyStructure, imap.FetchUid}
+		newMessages, err = a.fetchNewMessages(c, mailboxName, newUIDs, &progress)
+		return err
+	}
 
-		messages = make(chan *imap.Message, 10)
-		go func() {
-			if err := c.UidFetch(seqSet, items, messages); err != nil {
-				log.Println("Error fetching new messages:", err)
-			}
-		}()
+	err = a.withAccountClient(ctx, accountId, fetchMessages)
+
+	if err != nil {
+		return fmt.Errorf("error fetching messages from server: %w", err)
+	}
 
-		strconv.ParseFloat("1.0", 64)
+	if len(backfilledMessages) > 0 {
+		if err := a.updateMessageDates(accountId, mailboxName, backfilledMessages); err != nil {
+			log.Println("Error storing backfilled message dates:", err)
+		}
+	}
 
-		for msg := range messages {
-			email := mail.SerializableMessage{
-				UID:         msg.Uid,
-				Envelope:    msg.Envelope,
-				MailboxName: mailboxName,
-			}
+	if len(newMessages) > 0 {
+		if err := a.storeMessages(accountId, mailboxName, newMessages); err != nil {
+			return fmt.Errorf("error storing messages: %w", err)
+		}
+	}
 
-			newMessages = append(newMessages, email)
+	// an empty mailbox has no window yet; it is worked out once there is mail
+	if oldestUID != 0 {
+		if err := db.SetSyncedRange(a.db, accountId, mailboxName, oldestUID, complete); err != nil {
+			return err
 		}
+	}
 
+	if flaggedUIDs != nil {
+		if err := db.SetFlaggedMessages(a.db, accountId, mailboxName, flaggedUIDs); err != nil {
+			log.Println(err)
+		}
+	}
+
+	if len(newMessages) == 0 {
+		log.Println("No new messages to update.")
 		return nil
 	}
 
-	if account.OAuthAccessToken != "" {
-		oauthConfig := auth.GmailOAuthConfig // TODO: Add support for other OAuth providers
-		_, err = mail.WithOAuthClient(account.ImapUrl, account.Email, &oauth2.Token{
-			AccessToken:  account.OAuthAccessToken,
-			RefreshToken: account.OAuthRefreshToken,
-			Expiry:       time.Unix(account.OAuthExpiry, 0),
-		}, oauthConfig, fetchMessages)
-	} else {
-		err = mail.WithClient(account.ImapUrl, account.Email, account.AppSpecificPassword, fetchMessages)
+	a.messagesUpdated(accountId, mailboxName)
+	return nil
+}
+
+// fetchNewMessages fetches the envelopes and previews of the messages with the
+// given UIDs from the selected mailbox, reporting progress as it goes. Only
+// missing previews are left out if fetching them fails; any other error
+// fails the whole fetch.
+func (a *App) fetchNewMessages(c *mail.Conn, mailboxName string, uids []uint32, progress *SyncProgress) ([]mail.SerializableMessage, error) {
+	seqSet := new(imap.SeqSet)
+	seqSet.AddNum(uids...)
+	items := append([]imap.FetchItem{imap.FetchBodyStructure}, mail.MessageFetchItems...)
+
+	progress.Phase, progress.Fetched, progress.Total = SyncPhaseHeaders, 0, len(uids)
+	a.reportProgress(*progress)
+
+	messages := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqSet, items, messages)
+	}()
+
+	var newMessages []mail.SerializableMessage
+	structures := make(map[uint32]*imap.BodyStructure)
+	for msg := range messages {
+		newMessages = append(newMessages, mail.NewSerializableMessage(msg, mailboxName))
+		structures[msg.Uid] = msg.BodyStructure
+		progress.Fetched++
+		progress.Bytes += int64(msg.Size)
+		a.reportProgress(*progress)
 	}
+	if err := <-done; err != nil {
+		return nil, fmt.Errorf("error fetching new messages: %w", err)
+	}
+
+	progress.Phase, progress.Fetched, progress.Total = SyncPhasePreviews, 0, len(structures)
+	a.reportProgress(*progress)
 
+	previews, err := mail.FetchPreviews(c.Client, structures)
 	if err != nil {
-		log.Println("Error fetching messages from server:", err)
-		return
+		log.Println("Error fetching message previews:", err)
+	}
+	for i := range newMessages {
+		newMessages[i].Preview = previews[newMessages[i].UID]
 	}
 
-	if len(newMessages) == 0 {
-		log.Println("No new messages to update.")
-		return
+	return newMessages, nil
+}
+
+// MessagesUpdated is sent with the MessagesUpdated event when messages were
+// added to a mailbox
+type MessagesUpdated struct {
+	AccountId   int64  `json:"account_id"`
+	MailboxName string `json:"mailbox_name"`
+}
+
+// messagesUpdated tells the frontend that messages were added to a mailbox
+func (a *App) messagesUpdated(accountId int64, mailboxName string) {
+	emitEvent(a.ctx, "MessagesUpdated", MessagesUpdated{AccountId: accountId, MailboxName: mailboxName})
+
+	if role := a.getMailboxRole(accountId, mailboxName); role != mail.RoleNone {
+		emitEvent(a.ctx, "UnifiedMessagesUpdated", role)
 	}
+}
 
+// storeMessages inserts newly fetched messages into the cache
+func (a *App) storeMessages(accountId int64, mailboxName string, messages []mail.SerializableMessage) error {
 	tx, err := a.db.Begin()
 	if err != nil {
-		log.Println("Error starting transaction to update messages:", err)
-		return
+		return fmt.Errorf("error starting transaction to update messages: %w", err)
 	}
 	defer tx.Rollback()
 
 	stmt, err := tx.Prepare(`
-        INSERT INTO messages (mailbox_name, account_id, uid, envelope, body_plain, body_html, body_raw, received_at, last_updated) 
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+        INSERT OR IGNORE INTO messages (mailbox_name, account_id, uid, envelope, body_plain, body_html, body_raw, internal_date, sent_date, size, date, preview, received_at, last_updated) 
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
     `)
 	if err != nil {
-		log.Println("Error preparing statement to insert messages:", err)
-		return
+		return fmt.Errorf("error preparing statement to insert messages: %w", err)
 	}
 	defer stmt.Close()
 
-	for _, msg := range newMessages {
+	for _, msg := range messages {
 		envelopeData, err := json.Marshal(msg.Envelope)
 		if err != nil {
 			log.Println("Error marshalling envelope for UID", msg.UID, ":", err)
 			continue
 		}
 
-		_, err = stmt.Exec(mailboxName, accountId, msg.UID, envelopeData, msg.Body.Plain, msg.Body.HTML, nil, time.Now(), time.Now())
+		// an empty sent_date means there is no Date header; NULL is left for
+		// rows from before the column, which backfillMessageDates fills in
+		var internalDate interface{}
+		var sentDate string
+		if !msg.InternalDate.IsZero() {
+			internalDate = msg.InternalDate.Unix()
+		}
+		if msg.Envelope != nil && !msg.Envelope.Date.IsZero() {
+			sentDate = msg.Envelope.Date.Format(time.RFC3339)
+		}
+
+		_, err = stmt.Exec(mailboxName, accountId, msg.UID, envelopeData, msg.Body.Plain, msg.Body.HTML, nil,
+			internalDate, sentDate, msg.Size, msg.Date().Unix(), msg.Preview, time.Now(), time.Now())
 		if err != nil {
 			log.Println("Error inserting message UID", msg.UID, "into database:", err)
 		}
 	}
 
 	if err := tx.Commit(); err != nil {
-		log.Println("Error committing transaction to update messages:", err)
-		return
+		return fmt.Errorf("error committing transaction to update messages: %w", err)
+	}
+
+	return nil
+}
+
+// updateMessageDates stores INTERNALDATE and size for already cached messages
+func (a *App) updateMessageDates(accountId int64, mailboxName string, messages []mail.SerializableMessage) error {
+	tx, err := a.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`
+        UPDATE messages
+        SET internal_date = ?, size = ?, date = ?
+        WHERE mailbox_name = ? AND account_id = ? AND uid = ?
+    `)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, msg := range messages {
+		if msg.InternalDate.IsZero() {
+			continue
+		}
+		_, err := stmt.Exec(msg.InternalDate.Unix(), msg.Size, msg.InternalDate.Unix(), mailboxName, accountId, msg.UID)
+		if err != nil {
+			return err
+		}
 	}
 
-	runtime.EventsEmit(a.ctx, "MessagesUpdated", mailboxName)
+	return tx.Commit()
+}
+
+func fetchUndatedUIDs(db *sql.DB, accountId int64, mailboxName string) ([]uint32, error) {
+	rows, err := db.Query("SELECT uid FROM messages WHERE mailbox_name = ? AND account_id = ? AND internal_date IS NULL", mailboxName, accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+	return uids, nil
 }
 
 func fetchExistingUIDs(db *sql.DB, accountId int64, mailboxName string) ([]uint32, error) {
@@ -0,0 +1,225 @@
+package wails_app
+
+import (
+	"email_test_app/backend/db"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	// CACHE_MAINTENANCE_INTERVAL is how often cached bodies are evicted to
+	// keep the database under its size limit
+	CACHE_MAINTENANCE_INTERVAL = time.Hour
+	// CACHE_VACUUM_INTERVAL is how often the database is rebuilt with a full
+	// VACUUM; in between, freed pages are returned with incremental_vacuum
+	CACHE_VACUUM_INTERVAL = 7 * 24 * time.Hour
+
+	DEFAULT_CACHE_MAX_DATABASE_MB = 1024
+	DEFAULT_CACHE_KEEP_DAYS       = 30
+)
+
+const (
+	settingCacheMaxDatabaseMB = "cache.max_database_mb"
+	settingCacheKeepDays      = "cache.keep_days"
+	settingCacheKeepStarred   = "cache.keep_starred"
+	settingCacheLastVacuum    = "cache.last_vacuum"
+)
+
+// CacheSettings limit how much message data is kept on disk. Envelopes and
+// previews are always kept; bodies and attachments are evicted, least
+// recently opened first, once the database outgrows MaxDatabaseMB.
+type CacheSettings struct {
+	// MaxDatabaseMB is the size the database is kept under; 0 means no limit
+	MaxDatabaseMB int64 `json:"max_database_mb"`
+	// KeepDays protects the bodies of messages newer than this many days
+	KeepDays int `json:"keep_days"`
+	// KeepStarred protects the bodies of starred messages
+	KeepStarred bool `json:"keep_starred"`
+}
+
+// StorageUsage is how much disk space the cache takes, per account and mailbox
+type StorageUsage struct {
+	DatabaseBytes int64 `json:"database_bytes"`
+	// FreeBytes is space inside the database file not in use yet, which a
+	// vacuum returns to the filesystem
+	FreeBytes int64            `json:"free_bytes"`
+	Accounts  []AccountStorage `json:"accounts"`
+}
+
+type AccountStorage struct {
+	AccountId int64            `json:"account_id"`
+	Email     string           `json:"email"`
+	Bytes     int64            `json:"bytes"`
+	Mailboxes []MailboxStorage `json:"mailboxes"`
+}
+
+type MailboxStorage struct {
+	MailboxName     string `json:"mailbox_name"`
+	Messages        int64  `json:"messages"`
+	CachedBodies    int64  `json:"cached_bodies"`
+	EnvelopeBytes   int64  `json:"envelope_bytes"`
+	BodyBytes       int64  `json:"body_bytes"`
+	AttachmentBytes int64  `json:"attachment_bytes"`
+}
+
+// startCacheMaintenance evicts cached bodies and vacuums the database now and
+// every CACHE_MAINTENANCE_INTERVAL until stopCacheMaintenance
+func (a *App) startCacheMaintenance() {
+	a.cacheMutex.Lock()
+	defer a.cacheMutex.Unlock()
+
+	if a.cacheStop != nil {
+		return
+	}
+	a.cacheStop = make(chan struct{})
+	go a.runCacheMaintenance(a.cacheStop)
+}
+
+func (a *App) stopCacheMaintenance() {
+	a.cacheMutex.Lock()
+	defer a.cacheMutex.Unlock()
+
+	if a.cacheStop != nil {
+		close(a.cacheStop)
+		a.cacheStop = nil
+	}
+}
+
+func (a *App) runCacheMaintenance(stop <-chan struct{}) {
+	ticker := time.NewTicker(CACHE_MAINTENANCE_INTERVAL)
+	defer ticker.Stop()
+
+	a.maintainCache()
+	for {
+		select {
+		case <-ticker.C:
+			a.maintainCache()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// maintainCache evicts bodies the database has no room for, returns the
+// freed pages to the filesystem and, once every CACHE_VACUUM_INTERVAL,
+// rebuilds the database to defragment it
+func (a *App) maintainCache() {
+	a.cacheMaintenanceMutex.Lock()
+	defer a.cacheMaintenanceMutex.Unlock()
+
+	settings := a.GetCacheSettings()
+	evicted, freed, err := db.EvictBodies(a.db, db.RetentionPolicy{
+		MaxDatabaseBytes: settings.MaxDatabaseMB << 20,
+		KeepDays:         settings.KeepDays,
+		KeepFlagged:      settings.KeepStarred,
+	})
+	if err != nil {
+		log.Println("Error evicting cached bodies:", err)
+	} else if evicted > 0 {
+		log.Println("Evicted", evicted, "cached bodies,", freed, "bytes")
+	}
+
+	// databases from before incremental vacuum are converted once, here
+	// rather than at startup since it takes a full vacuum
+	converted, err := db.ConvertToIncrementalVacuum(a.db)
+	if err != nil {
+		log.Println(err)
+	} else if converted {
+		log.Println("Switched the database to incremental vacuum")
+	}
+
+	value, err := db.GetSetting(a.db, settingCacheLastVacuum, "0")
+	if err != nil {
+		log.Println(err)
+	}
+	lastVacuum, _ := strconv.ParseInt(value, 10, 64)
+	if lastVacuum == 0 || converted {
+		// a new database has nothing to defragment yet and a converted one
+		// was just rebuilt; count from now
+		if err := db.SetSetting(a.db, settingCacheLastVacuum, strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if time.Since(time.Unix(lastVacuum, 0)) < CACHE_VACUUM_INTERVAL {
+		if err := db.IncrementalVacuum(a.db); err != nil {
+			log.Println("Error vacuuming database:", err)
+		}
+		return
+	}
+
+	if err := db.Vacuum(a.db); err != nil {
+		log.Println(err)
+		return
+	}
+	if err := db.SetSetting(a.db, settingCacheLastVacuum, strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		log.Println(err)
+	}
+}
+
+func (a *App) GetCacheSettings() CacheSettings {
+	return CacheSettings{
+		MaxDatabaseMB: int64(a.intSetting(settingCacheMaxDatabaseMB, DEFAULT_CACHE_MAX_DATABASE_MB)),
+		KeepDays:      a.intSetting(settingCacheKeepDays, DEFAULT_CACHE_KEEP_DAYS),
+		KeepStarred:   a.boolSetting(settingCacheKeepStarred, true),
+	}
+}
+
+// SetCacheSettings saves the cache limits and applies them right away
+func (a *App) SetCacheSettings(settings CacheSettings) error {
+	if settings.MaxDatabaseMB < 0 || settings.KeepDays < 0 {
+		return errInvalidArgument("cache limits can't be negative")
+	}
+
+	err := db.SetSetting(a.db, settingCacheMaxDatabaseMB, strconv.FormatInt(settings.MaxDatabaseMB, 10))
+	if err == nil {
+		err = db.SetSetting(a.db, settingCacheKeepDays, strconv.Itoa(settings.KeepDays))
+	}
+	if err == nil {
+		err = db.SetSetting(a.db, settingCacheKeepStarred, strconv.FormatBool(settings.KeepStarred))
+	}
+	if err != nil {
+		log.Println(err)
+		return internalError(err)
+	}
+
+	go a.maintainCache()
+	return nil
+}
+
+// GetStorageUsage returns the size of the database and how much of it each
+// account's mailboxes take
+func (a *App) GetStorageUsage() (StorageUsage, error) {
+	size, free, err := db.DatabaseSize(a.db)
+	if err != nil {
+		log.Println(err)
+		return StorageUsage{}, internalError(err)
+	}
+
+	mailboxes, err := db.GetMailboxUsage(a.db)
+	if err != nil {
+		log.Println(err)
+		return StorageUsage{}, internalError(err)
+	}
+
+	usage := StorageUsage{DatabaseBytes: size, FreeBytes: free, Accounts: []AccountStorage{}}
+	for _, m := range mailboxes {
+		// mailboxes come ordered by account
+		if n := len(usage.Accounts); n == 0 || usage.Accounts[n-1].AccountId != m.AccountId {
+			account, _ := a.getAccount(m.AccountId)
+			usage.Accounts = append(usage.Accounts, AccountStorage{AccountId: m.AccountId, Email: account.Email})
+		}
+		account := &usage.Accounts[len(usage.Accounts)-1]
+		account.Bytes += m.EnvelopeBytes + m.BodyBytes + m.AttachmentBytes
+		account.Mailboxes = append(account.Mailboxes, MailboxStorage{
+			MailboxName:     m.MailboxName,
+			Messages:        m.Messages,
+			CachedBodies:    m.CachedBodies,
+			EnvelopeBytes:   m.EnvelopeBytes,
+			BodyBytes:       m.BodyBytes,
+			AttachmentBytes: m.AttachmentBytes,
+		})
+	}
+	return usage, nil
+}
@@ -0,0 +1,197 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/auth"
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emersion/go-imap/client"
+	"golang.org/x/oauth2"
+)
+
+// withAccountClient borrows a connection to the account's IMAP server from the
+// pool and executes the provided function, aborting it if ctx is cancelled.
+// Errors are classified as the server's.
+func (a *App) withAccountClient(ctx context.Context, accountId int64, fn func(c *mail.Conn) error) error {
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		return errAccountNotFound(accountId)
+	}
+	if account.AuthState != auth.AuthStateActive {
+		return mail.NewError(mail.ErrorAuthRequired, fmt.Errorf("account %d is %s", accountId, account.AuthState))
+	}
+
+	err := a.pool.With(ctx, accountId, func(ctx context.Context) (*client.Client, time.Time, error) {
+		return a.dialAccount(ctx, accountId)
+	}, fn)
+
+	if errors.Is(err, mail.ErrAuthFailed) {
+		a.markNeedsReauth(accountId)
+	}
+	return mail.ServerError(err)
+}
+
+// dialAccount opens a new connection to the account's IMAP server and logs in
+// using whichever credentials the account has, refreshing its OAuth token
+// first if needed. The returned time is when an OAuth login expires.
+func (a *App) dialAccount(ctx context.Context, accountId int64) (*client.Client, time.Time, error) {
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		return nil, time.Time{}, errAccountNotFound(accountId)
+	}
+
+	var token *oauth2.Token
+	switch {
+	case account.OAuthAccessToken != "":
+		var err error
+		token, err = a.accountToken(ctx, accountId)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+	case account.AppSpecificPassword == "":
+		return nil, time.Time{}, mail.NewError(mail.ErrorAuthFailed, fmt.Errorf("no valid credentials found for account %d", account.Id))
+	}
+
+	c, err := mail.Dial(ctx, account.ImapUrl, account.Connection)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if token != nil {
+		err = mail.LoginOAuth(ctx, c, account.Email, token.AccessToken)
+	} else {
+		err = mail.Login(ctx, c, account.Email, account.AppSpecificPassword)
+	}
+	if err != nil {
+		c.Logout()
+		return nil, time.Time{}, err
+	}
+
+	if token != nil {
+		return c, token.Expiry, nil
+	}
+	return c, time.Time{}, nil
+}
+
+// accountToken returns a valid OAuth token for the account, refreshing it if
+// it has expired. A refreshed token is saved to the database and the accounts
+// map before it is used, so it survives restarts and later connections don't
+// refresh again. If the provider rejects the refresh token the account is
+// marked as needing re-authentication and AccountNeedsReauth is emitted.
+func (a *App) accountToken(ctx context.Context, accountId int64) (*oauth2.Token, error) {
+	a.tokenMutex.Lock()
+	defer a.tokenMutex.Unlock()
+
+	// re-read the account in case another connection refreshed the token
+	// while this one was waiting
+	account, ok := a.getAccount(accountId)
+	if !ok {
+		return nil, errAccountNotFound(accountId)
+	}
+	if account.AuthState == auth.AuthStateNeedsReauth {
+		return nil, mail.NewError(mail.ErrorAuthRequired, fmt.Errorf("account %d needs to sign in again", accountId))
+	}
+
+	provider, err := auth.GetProvider(account.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &oauth2.Token{
+		AccessToken:  account.OAuthAccessToken,
+		RefreshToken: account.OAuthRefreshToken,
+		Expiry:       time.Unix(account.OAuthExpiry, 0),
+	}
+
+	newToken, err := provider.OAuthConfig().TokenSource(ctx, token).Token()
+	if err != nil {
+		if auth.NeedsReauth(err) {
+			a.markNeedsReauth(accountId)
+		}
+		return nil, auth.TokenError(fmt.Errorf("error refreshing OAuth token: %w", err))
+	}
+
+	if newToken.AccessToken == token.AccessToken && newToken.RefreshToken == token.RefreshToken {
+		return newToken, nil
+	}
+
+	// providers only send a new refresh token when they rotate it
+	if newToken.RefreshToken == "" {
+		newToken.RefreshToken = token.RefreshToken
+	}
+
+	a.accountsMutex.Lock()
+	defer a.accountsMutex.Unlock()
+
+	err = db.UpdateAccountToken(a.db, a.vault, accountId, account.Email, newToken.AccessToken, newToken.RefreshToken, newToken.Expiry.Unix())
+	if err != nil {
+		// the new token is still good for this connection
+		log.Println("Error saving refreshed token:", err)
+		return newToken, nil
+	}
+
+	if account, ok := a.accounts[accountId]; ok {
+		account.OAuthAccessToken = newToken.AccessToken
+		account.OAuthRefreshToken = newToken.RefreshToken
+		account.OAuthExpiry = newToken.Expiry.Unix()
+		a.accounts[accountId] = account
+	}
+
+	return newToken, nil
+}
+
+// markNeedsReauth flags an account whose credentials were rejected, such as a
+// revoked refresh token or a changed password, and tells the frontend so it
+// can prompt the user to sign in
+func (a *App) markNeedsReauth(accountId int64) {
+	a.pool.CloseAccount(accountId)
+
+	if err := a.setAuthState(accountId, auth.AuthStateNeedsReauth); err != nil {
+		log.Println(err)
+	}
+
+	log.Println("Account", accountId, "needs to sign in again")
+	emitEvent(a.ctx, "AccountNeedsReauth", accountId)
+}
+
+type accountOperations struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// accountContext returns the context the account's IMAP operations run
+// under. It is cancelled when the account stops syncing, which happens on
+// logout, removal, locking the vault and shutdown.
+func (a *App) accountContext(accountId int64) context.Context {
+	a.accountOpsMutex.Lock()
+	defer a.accountOpsMutex.Unlock()
+
+	if a.accountOps == nil {
+		a.accountOps = make(map[int64]accountOperations)
+	}
+
+	ops, ok := a.accountOps[accountId]
+	if !ok {
+		ctx, cancel := context.WithCancel(a.opsCtx)
+		ops = accountOperations{ctx, cancel}
+		a.accountOps[accountId] = ops
+	}
+	return ops.ctx
+}
+
+// cancelAccountOperations aborts the account's IMAP operations in progress.
+// Later operations get a new context.
+func (a *App) cancelAccountOperations(accountId int64) {
+	a.accountOpsMutex.Lock()
+	defer a.accountOpsMutex.Unlock()
+
+	if ops, ok := a.accountOps[accountId]; ok {
+		ops.cancel()
+		delete(a.accountOps, accountId)
+	}
+}
@@ -0,0 +1,200 @@
+package wails_app
+
+import (
+	"email_test_app/backend/auth"
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenEndpoint is a fake OAuth token endpoint answering refresh requests
+// with the queued responses in order, repeating the last one
+type tokenEndpoint struct {
+	*httptest.Server
+
+	mutex     sync.Mutex
+	responses []map[string]any
+	// refreshTokens holds the refresh token of each request
+	refreshTokens []string
+}
+
+func newTokenEndpoint(t *testing.T, responses ...map[string]any) *tokenEndpoint {
+	e := &tokenEndpoint{responses: responses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "refresh_token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		e.mutex.Lock()
+		e.refreshTokens = append(e.refreshTokens, r.PostForm.Get("refresh_token"))
+		response := e.responses[0]
+		if len(e.responses) > 1 {
+			e.responses = e.responses[1:]
+		}
+		e.mutex.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if _, ok := response["error"]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *tokenEndpoint) requests() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string(nil), e.refreshTokens...)
+}
+
+// addOAuthAccount registers a provider using the endpoint and adds an
+// account of it whose access token has expired
+func addOAuthAccount(t *testing.T, a *App, e *tokenEndpoint) int64 {
+	t.Helper()
+
+	auth.RegisterProvider(&auth.OAuthProvider{
+		ProviderName: t.Name(),
+		Config: &oauth2.Config{
+			ClientID: "client-id",
+			Endpoint: oauth2.Endpoint{TokenURL: e.URL, AuthStyle: oauth2.AuthStyleInParams},
+		},
+	})
+
+	return addTestAccount(t, a, auth.Account{
+		Email:             "user@example.com",
+		ImapUrl:           "imap.example.com:993",
+		OAuthAccessToken:  "old-access-token",
+		OAuthRefreshToken: "old-refresh-token",
+		OAuthExpiry:       time.Now().Add(-time.Minute).Unix(),
+		Provider:          t.Name(),
+	})
+}
+
+// storedAccount reads the account back from the database
+func storedAccount(t *testing.T, a *App, accountId int64) auth.Account {
+	t.Helper()
+
+	accounts, err := db.GetAccounts(a.db, a.vault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, ok := accounts[accountId]
+	if !ok {
+		t.Fatalf("account %d isn't in the database", accountId)
+	}
+	return account
+}
+
+func TestAccountToken(t *testing.T) {
+	t.Run("refresh", func(t *testing.T) {
+		a := newTestApp(t)
+		e := newTokenEndpoint(t, map[string]any{
+			"access_token":  "new-access-token",
+			"refresh_token": "new-refresh-token",
+			"token_type":    "Bearer",
+			"expires_in":    3600,
+		})
+		accountId := addOAuthAccount(t, a, e)
+
+		token, err := a.accountToken(a.opsCtx, accountId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.AccessToken != "new-access-token" || token.RefreshToken != "new-refresh-token" {
+			t.Errorf("got tokens %q, %q, want the new ones", token.AccessToken, token.RefreshToken)
+		}
+		if requests := e.requests(); len(requests) != 1 || requests[0] != "old-refresh-token" {
+			t.Errorf("refreshed with %v, want the old refresh token once", requests)
+		}
+
+		// the new tokens are saved, so a restart doesn't refresh again
+		for name, account := range map[string]auth.Account{"memory": a.accounts[accountId], "database": storedAccount(t, a, accountId)} {
+			if account.OAuthAccessToken != "new-access-token" || account.OAuthRefreshToken != "new-refresh-token" || account.OAuthExpiry != token.Expiry.Unix() {
+				t.Errorf("%s has tokens %q, %q expiring at %d, want the new ones expiring at %d",
+					name, account.OAuthAccessToken, account.OAuthRefreshToken, account.OAuthExpiry, token.Expiry.Unix())
+			}
+		}
+
+		// the saved token is used while it is valid
+		if _, err := a.accountToken(a.opsCtx, accountId); err != nil {
+			t.Fatal(err)
+		}
+		if requests := e.requests(); len(requests) != 1 {
+			t.Errorf("refreshed %d times, want once", len(requests))
+		}
+	})
+
+	t.Run("refresh token kept", func(t *testing.T) {
+		a := newTestApp(t)
+		e := newTokenEndpoint(t, map[string]any{
+			"access_token": "new-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+		})
+		accountId := addOAuthAccount(t, a, e)
+
+		if _, err := a.accountToken(a.opsCtx, accountId); err != nil {
+			t.Fatal(err)
+		}
+		if account := storedAccount(t, a, accountId); account.OAuthRefreshToken != "old-refresh-token" {
+			t.Errorf("stored refresh token %q, want the old one kept", account.OAuthRefreshToken)
+		}
+	})
+
+	t.Run("invalid_grant", func(t *testing.T) {
+		a := newTestApp(t)
+		events := recordEvents(t)
+		e := newTokenEndpoint(t, map[string]any{"error": "invalid_grant"})
+		accountId := addOAuthAccount(t, a, e)
+
+		_, err := a.accountToken(a.opsCtx, accountId)
+		assertErrorCode(t, err, mail.ErrorAuthFailed)
+
+		if state := a.GetAccountAuthState(accountId); state != auth.AuthStateNeedsReauth {
+			t.Errorf("auth state is %q, want %q", state, auth.AuthStateNeedsReauth)
+		}
+		if state := storedAccount(t, a, accountId).AuthState; state != auth.AuthStateNeedsReauth {
+			t.Errorf("stored auth state is %q, want %q", state, auth.AuthStateNeedsReauth)
+		}
+		if sent := events.named("AccountNeedsReauth"); len(sent) != 1 || sent[0][0] != accountId {
+			t.Errorf("sent AccountNeedsReauth %v, want once for account %d", sent, accountId)
+		}
+
+		// the rejected refresh token isn't tried again
+		_, err = a.accountToken(a.opsCtx, accountId)
+		assertErrorCode(t, err, mail.ErrorAuthRequired)
+		if requests := e.requests(); len(requests) != 1 {
+			t.Errorf("refreshed %d times, want once", len(requests))
+		}
+	})
+
+	t.Run("temporarily_unavailable", func(t *testing.T) {
+		a := newTestApp(t)
+		events := recordEvents(t)
+		e := newTokenEndpoint(t, map[string]any{"error": "temporarily_unavailable"})
+		accountId := addOAuthAccount(t, a, e)
+
+		_, err := a.accountToken(a.opsCtx, accountId)
+		assertErrorCode(t, err, mail.ErrorRateLimited)
+
+		if state := storedAccount(t, a, accountId).AuthState; state != auth.AuthStateActive {
+			t.Errorf("stored auth state is %q, want %q", state, auth.AuthStateActive)
+		}
+		if sent := events.named("AccountNeedsReauth"); len(sent) != 0 {
+			t.Errorf("sent AccountNeedsReauth %v, want none", sent)
+		}
+		if account := storedAccount(t, a, accountId); account.OAuthAccessToken != "old-access-token" {
+			t.Errorf("stored access token %q, want the old one kept", account.OAuthAccessToken)
+		}
+	})
+}
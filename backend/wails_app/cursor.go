@@ -0,0 +1,40 @@
+package wails_app
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// messageCursor marks the last message of a page. The frontend treats it as
+// an opaque string and passes it back to get the next page.
+type messageCursor struct {
+	Date      int64  `json:"d"`
+	AccountId int64  `json:"a"`
+	UID       uint32 `json:"u"`
+}
+
+func encodeCursor(cursor messageCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor parses a cursor from the frontend. The empty string is the
+// cursor for the first page.
+func decodeCursor(s string) (*messageCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	var cursor messageCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	return &cursor, nil
+}
@@ -0,0 +1,65 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/auth"
+	"log"
+)
+
+// StartDeviceLogin signs in with the device authorization grant, for when the
+// browser can't reach the loopback redirect. The user code and verification
+// URL are sent to the frontend in a DeviceLoginCode event, then the provider
+// is polled until the user finishes signing in on any device.
+func (a *App) StartDeviceLogin(providerName string) error {
+	err := a.startDeviceLogin(providerName)
+	if err != nil {
+		log.Println("Device login failed:", err)
+		return err
+	}
+
+	a.startUpdateLoops()
+
+	return nil
+}
+
+func (a *App) startDeviceLogin(providerName string) error {
+	provider, err := auth.GetProvider(providerName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	flow := &oauthFlow{cancel: cancel}
+	a.setOAuthFlow(flow)
+	defer a.clearOAuthFlow(flow)
+
+	login, err := auth.StartDeviceLogin(ctx, provider.OAuthConfig())
+	if err != nil {
+		emitEvent(a.ctx, "OAuthFailure", err.Error())
+		return err
+	}
+
+	emitEvent(a.ctx, "DeviceLoginCode", login)
+
+	token, err := login.Wait(ctx)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			err = cause
+		}
+		emitEvent(a.ctx, "OAuthFailure", err.Error())
+		return err
+	}
+
+	return a.addOAuthAccount(ctx, provider, token)
+}
+
+// SupportsDeviceLogin reports whether the provider can sign in with a device code
+func (a *App) SupportsDeviceLogin(providerName string) bool {
+	provider, err := auth.GetProvider(providerName)
+	if err != nil {
+		return false
+	}
+	return auth.SupportsDeviceLogin(provider)
+}
@@ -0,0 +1,31 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/discovery"
+	"errors"
+	"log"
+	"time"
+)
+
+// DISCOVERY_TIMEOUT bounds how long looking up server settings may take
+const DISCOVERY_TIMEOUT = 15 * time.Second
+
+// DiscoverServers suggests IMAP and SMTP servers for an email address, best
+// first. Both lists are empty if nothing was found.
+func (a *App) DiscoverServers(emailAddr string) (discovery.Result, error) {
+	ctx, cancel := context.WithTimeout(a.opsCtx, DISCOVERY_TIMEOUT)
+	defer cancel()
+
+	result, err := discovery.New().Discover(ctx, emailAddr)
+	switch {
+	case errors.Is(err, discovery.ErrInvalidAddress):
+		return discovery.Result{}, errInvalidArgument("invalid email address %q", emailAddr)
+	case a.opsCtx.Err() != nil:
+		return discovery.Result{}, a.opsCtx.Err()
+	case err != nil:
+		log.Println("Server discovery failed:", err)
+		return discovery.Result{Imap: []discovery.Server{}, Smtp: []discovery.Server{}}, nil
+	}
+	return *result, nil
+}
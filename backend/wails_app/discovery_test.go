@@ -0,0 +1,20 @@
+package wails_app
+
+import (
+	"email_test_app/backend/mail"
+	"testing"
+)
+
+func TestDiscoverServersErrors(t *testing.T) {
+	a := newTestApp(t)
+
+	for _, emailAddr := range []string{"", "user", "user@"} {
+		_, err := a.DiscoverServers(emailAddr)
+		assertErrorCode(t, err, mail.ErrorInvalidArgument)
+	}
+
+	// shutting down aborts discovery
+	a.cancelOps()
+	_, err := a.DiscoverServers("user@example.invalid")
+	assertErrorCode(t, mail.ClassifyError(err), mail.ErrorCancelled)
+}
@@ -0,0 +1,31 @@
+package wails_app
+
+import (
+	"email_test_app/backend/mail"
+	"fmt"
+)
+
+// FormatError is the Wails error formatter. Errors returned by bindings reach
+// the frontend as a rejected promise with a {code, message} object.
+func FormatError(err error) any {
+	return mail.ClassifyError(err)
+}
+
+func errAccountNotFound(accountId int64) error {
+	return mail.NewError(mail.ErrorNotFound, fmt.Errorf("account %d not found", accountId))
+}
+
+func errNotLoggedIn(accountId int64) error {
+	return mail.NewError(mail.ErrorAuthRequired, fmt.Errorf("account %d is not signed in", accountId))
+}
+
+// errInvalidArgument rejects a request that can't be done as asked
+func errInvalidArgument(format string, args ...any) error {
+	return mail.NewError(mail.ErrorInvalidArgument, fmt.Errorf(format, args...))
+}
+
+// internalError marks an error of the app itself, such as a database error,
+// so it isn't mistaken for the server's answer
+func internalError(err error) error {
+	return mail.NewError(mail.ErrorInternal, err)
+}
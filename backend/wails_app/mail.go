@@ -1,28 +1,37 @@
 package wails_app
 
 import (
-	"email_test_app/backend/auth"
+	"context"
+	"database/sql"
+	"email_test_app/backend/db"
 	"email_test_app/backend/mail"
 	"encoding/json"
 	"fmt"
 	"log"
 	"time"
-
-	"github.com/emersion/go-imap/client"
-	"golang.org/x/oauth2"
 )
 
-func (a *App) GetMailboxes(accountId int64) []string {
+// GetMailboxes returns the names of the account's cached mailboxes. An
+// account that has to sign in again gets an auth_required error.
+func (a *App) GetMailboxes(accountId int64) ([]string, error) {
 	if !a.IsLoggedIn(accountId) {
 		log.Println("GetMailboxes: User not logged in.")
-		a.LogoutUser(accountId)
-		return nil
+		return nil, errNotLoggedIn(accountId)
+	}
+
+	mailboxes, err := a.getMailboxes(accountId)
+	if err != nil {
+		log.Println(err)
+		return nil, internalError(err)
 	}
+	return mailboxes, nil
+}
 
+// getMailboxes returns the names of the account's cached mailboxes
+func (a *App) getMailboxes(accountId int64) ([]string, error) {
 	rows, err := a.db.Query("SELECT name FROM mailboxes WHERE account_id = ?", accountId)
 	if err != nil {
-		log.Println("Error querying mailboxes from database:", err)
-		return nil
+		return nil, fmt.Errorf("error querying mailboxes from database: %w", err)
 	}
 	defer rows.Close()
 
@@ -30,69 +39,204 @@ func (a *App) GetMailboxes(accountId int64) []string {
 	for rows.Next() {
 		var name string
 		if err := rows.Scan(&name); err != nil {
-			log.Println("Error scanning mailbox row:", err)
-			continue
+			return nil, fmt.Errorf("error scanning mailbox row: %w", err)
 		}
 		mailboxes = append(mailboxes, name)
 	}
 
-	return mailboxes
+	return mailboxes, rows.Err()
+}
+
+// getMailboxRoles returns the special-use role of each of the account's mailboxes
+func (a *App) getMailboxRoles(accountId int64) (map[string]mail.MailboxRole, error) {
+	rows, err := a.db.Query("SELECT name, COALESCE(role, '') FROM mailboxes WHERE account_id = ?", accountId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := make(map[string]mail.MailboxRole)
+	for rows.Next() {
+		var name string
+		var role mail.MailboxRole
+		if err := rows.Scan(&name, &role); err != nil {
+			return nil, err
+		}
+		roles[name] = role
+	}
+
+	return roles, rows.Err()
+}
+
+func (a *App) getMailboxRole(accountId int64, mailboxName string) mail.MailboxRole {
+	var role mail.MailboxRole
+	err := a.db.QueryRow("SELECT COALESCE(role, '') FROM mailboxes WHERE account_id = ? AND name = ?", accountId, mailboxName).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		log.Println("Error querying mailbox role from database:", err)
+	}
+	return role
+}
+
+// MessagePage is a page of messages along with the cursor for the next one.
+// NextCursor is empty on the last page. Backfilling is set when the page ran
+// out of synced messages and older ones are being fetched from the server;
+// NextCursor then continues from the end of the page once BackfillFinished
+// says they have arrived.
+type MessagePage struct {
+	Messages    []mail.SerializableMessage `json:"messages"`
+	NextCursor  string                     `json:"next_cursor"`
+	Backfilling bool                       `json:"backfilling"`
 }
 
-// GetEmailsForMailbox returns emails for a mailbox, using cache if available
-func (a *App) GetEmailsForMailbox(accountId int64, mailboxName string, start, limit uint32) []mail.SerializableMessage {
+// GetEmailsForMailbox returns a page of cached emails for a mailbox, newest
+// first. Pass an empty cursor for the first page and the returned NextCursor
+// for the following ones; pages stay consistent while new mail arrives. query
+// holds before:YYYY-MM-DD and after:YYYY-MM-DD terms limiting the page to
+// messages dated in that range, or is empty.
+func (a *App) GetEmailsForMailbox(accountId int64, mailboxName string, query string, cursor string, limit uint32) (MessagePage, error) {
 	if !a.IsLoggedIn(accountId) {
 		log.Println("GetEmailsForMailbox: User not logged in.")
-		a.LogoutUser(accountId)
-		return nil
+		return MessagePage{}, errNotLoggedIn(accountId)
 	}
 
-	rows, err := a.db.Query(`
-        SELECT uid, envelope FROM messages 
-        WHERE mailbox_name = ? AND account_id = ?
-        ORDER BY received_at DESC 
-        LIMIT ? OFFSET ?`, mailboxName, accountId, limit, start)
+	filter, err := mail.ParseDateFilter(query)
 	if err != nil {
-		log.Println("Error querying messages from database:", err)
-		return nil
+		return MessagePage{}, errInvalidArgument("%v", err)
+	}
+	dates := dateRange(filter)
+
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		log.Println("GetEmailsForMailbox:", err)
+		return MessagePage{}, errInvalidArgument("invalid cursor")
+	}
+
+	var key *db.PageKey
+	if after != nil {
+		key = &db.PageKey{Date: after.Date, UID: after.UID}
+	}
+
+	rows, err := db.QueryMailboxPage(a.db, messageColumns, accountId, mailboxName, dates, key, limit)
+	if err != nil {
+		log.Println(err)
+		return MessagePage{}, internalError(err)
 	}
 	defer rows.Close()
 
+	var page MessagePage
+	var last messageCursor
+	page.Messages, last = scanMessages(rows)
+
+	switch {
+	case uint32(len(page.Messages)) == limit:
+		page.NextCursor = encodeCursor(last)
+	case a.syncedPast(accountId, mailboxName, dates.After):
+		// the older messages still on the server are all outside the range
+	case a.queueBackfill(accountId, mailboxName):
+		// past the synced messages; the next page picks up where this one
+		// ended once the older ones have been fetched
+		page.Backfilling = true
+		page.NextCursor = cursor
+		if len(page.Messages) > 0 {
+			page.NextCursor = encodeCursor(last)
+		}
+	}
+
+	return page, nil
+}
+
+// dateRange converts a filter to the unix dates stored in the cache
+func dateRange(filter mail.DateFilter) db.DateRange {
+	var dates db.DateRange
+	if !filter.After.IsZero() {
+		dates.After = filter.After.Unix()
+	}
+	if !filter.Before.IsZero() {
+		dates.Before = filter.Before.Unix()
+	}
+	return dates
+}
+
+// syncedPast reports whether the mailbox's cached messages reach back before
+// date, so fetching older ones can't add anything dated from then on
+func (a *App) syncedPast(accountId int64, mailboxName string, date int64) bool {
+	if date == 0 {
+		return false
+	}
+	oldest, ok, err := db.GetOldestMessageDate(a.db, accountId, mailboxName)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	return ok && oldest < date
+}
+
+// messageColumns are the columns read by scanMessage
+const messageColumns = "messages.account_id, messages.mailbox_name, messages.uid, messages.envelope, messages.internal_date, messages.size, COALESCE(messages.preview, ''), COALESCE(messages.date, 0)"
+
+// scanMessage reads a cached message selected with messageColumns, along with
+// the cursor pointing at it
+func scanMessage(row interface{ Scan(...any) error }) (mail.SerializableMessage, messageCursor, error) {
+	var msg mail.SerializableMessage
+	var cursor messageCursor
+	var envelopeData []byte
+	var internalDate, size sql.NullInt64
+	if err := row.Scan(&msg.AccountId, &msg.MailboxName, &msg.UID, &envelopeData, &internalDate, &size, &msg.Preview, &cursor.Date); err != nil {
+		return msg, cursor, err
+	}
+
+	// Deserialize the envelope
+	if err := json.Unmarshal(envelopeData, &msg.Envelope); err != nil {
+		return msg, cursor, fmt.Errorf("error unmarshalling envelope: %w", err)
+	}
+
+	if internalDate.Valid {
+		msg.InternalDate = time.Unix(internalDate.Int64, 0)
+	}
+	msg.Size = uint32(size.Int64)
+
+	cursor.AccountId = msg.AccountId
+	cursor.UID = msg.UID
+
+	return msg, cursor, nil
+}
+
+// scanMessagePage reads a page of messages, setting NextCursor if the page is full
+func scanMessagePage(rows *sql.Rows, limit uint32) MessagePage {
+	var page MessagePage
+	var last messageCursor
+	page.Messages, last = scanMessages(rows)
+
+	if uint32(len(page.Messages)) == limit {
+		page.NextCursor = encodeCursor(last)
+	}
+
+	return page
+}
+
+// scanMessages reads messages along with the cursor pointing at the last one
+func scanMessages(rows *sql.Rows) ([]mail.SerializableMessage, messageCursor) {
 	var messages []mail.SerializableMessage
+	var last messageCursor
 	for rows.Next() {
-		var msg mail.SerializableMessage
-		var envelopeData []byte
-		if err := rows.Scan(&msg.UID, &envelopeData); err != nil {
+		msg, cursor, err := scanMessage(rows)
+		if err != nil {
 			log.Println("Error scanning message row:", err)
 			continue
 		}
 
-		// Deserialize the envelope
-		if err := json.Unmarshal(envelopeData, &msg.Envelope); err != nil {
-			log.Println("Error unmarshalling envelope:", err)
-			continue
-		}
-
-		msg.MailboxName = mailboxName
-		msg.Body = mail.EmailBody{}
 		messages = append(messages, msg)
+		last = cursor
 	}
-
-	return messages
+	return messages, last
 }
 
-// GetEmailBody fetches the body of an email, using cache if available
-func (a *App) GetEmailBody(accountId int64, mailboxName string, uid uint32) string {
+// GetEmailBody fetches the body of an email, using cache if available. The
+// HTML body is returned if the message has one, the plain text body otherwise.
+func (a *App) GetEmailBody(accountId int64, mailboxName string, uid uint32) (string, error) {
 	if !a.IsLoggedIn(accountId) {
 		log.Println("GetEmailBody: User not logged in.")
-		a.LogoutUser(accountId)
-		return ""
-	}
-
-	account, ok := a.accounts[accountId]
-	if !ok {
-		log.Println("Account not found for ID:", accountId)
-		return ""
+		return "", errNotLoggedIn(accountId)
 	}
 
 	rows, err := a.db.Query(`
@@ -103,7 +247,7 @@ func (a *App) GetEmailBody(accountId int64, mailboxName string, uid uint32) stri
 
 	if err != nil {
 		log.Println("Error querying email body from database:", err)
-		return ""
+		return "", internalError(err)
 	}
 	defer rows.Close()
 
@@ -112,18 +256,18 @@ func (a *App) GetEmailBody(accountId int64, mailboxName string, uid uint32) stri
 	if rows.Next() {
 		if err := rows.Scan(&body_plain, &body_html); err != nil {
 			log.Println("Error scanning email body row:", err)
-			return ""
+			return "", internalError(err)
 		}
 	}
 
-	fetchBody := func(c *client.Client, bodyPlainPtr *string, bodyHtmlPtr *string) error {
+	fetchBody := func(ctx context.Context, c *mail.Conn, bodyPlainPtr *string, bodyHtmlPtr *string) error {
 		_, err := c.Select(mailboxName, false)
 		if err != nil {
-			return fmt.Errorf("error selecting mailbox: %v", err)
+			return fmt.Errorf("error selecting mailbox: %w", err)
 		}
-		body, err := mail.FetchEmailBody(c, uid)
+		body, err := mail.FetchEmailBody(ctx, c.Client, uid)
 		if err != nil {
-			return fmt.Errorf("error fetching email body: %v", err)
+			return fmt.Errorf("error fetching email body: %w", err)
 		}
 
 		*bodyHtmlPtr = body.HTML
@@ -135,52 +279,78 @@ func (a *App) GetEmailBody(accountId int64, mailboxName string, uid uint32) stri
 	if body_plain == "" && body_html == "" {
 		log.Println("Email body not found in cache, fetching from server.")
 
-		if account.OAuthAccessToken != "" {
-			oauthConfig := auth.GmailOAuthConfig
-			mail.WithOAuthClient(account.ImapUrl,
-				account.Email,
-				&oauth2.Token{
-					AccessToken:  account.OAuthAccessToken,
-					RefreshToken: account.OAuthRefreshToken,
-					Expiry:       time.Unix(account.OAuthExpiry, 0),
-				},
-				oauthConfig,
-				func(c *client.Client) error {
-					return fetchBody(c, &body_plain, &body_html)
-				})
-		} else if account.AppSpecificPassword != "" {
-			mail.WithClient(account.ImapUrl, account.Email, account.AppSpecificPassword, func(c *client.Client) error {
-				return fetchBody(c, &body_plain, &body_html)
-			})
-		} else {
-			log.Println("No valid credentials found.")
-			return ""
+		ctx, done := a.startBodyFetch(accountId)
+		defer done()
+
+		err := a.withAccountClient(ctx, accountId, func(c *mail.Conn) error {
+			return fetchBody(ctx, c, &body_plain, &body_html)
+		})
+		if err != nil {
+			log.Println("Error fetching email body from server:", err)
+			return "", mail.ServerError(err)
 		}
 
 		if body_html == "" && body_plain == "" {
 			log.Println("Error fetching email body.")
-			return ""
+			return "", mail.NewError(mail.ErrorNotFound, fmt.Errorf("message %d has no body", uid))
 		}
 
-		// Update the cache
-		_, err := a.db.Exec(`
-            UPDATE messages
-            SET body_plain = ?, body_html = ?
-            WHERE mailbox_name = ? AND uid = ?
-        `, body_plain, body_html, mailboxName, uid)
+		err = a.cacheBody(accountId, mailboxName, uid, mail.EmailBody{Plain: body_plain, HTML: body_html})
 		if err != nil {
-			log.Println("Error updating email body in cache:", err)
-			return ""
+			log.Println(err)
+			return "", internalError(err)
 		}
 	}
 
+	if err := db.MarkBodyAccessed(a.db, accountId, mailboxName, uid); err != nil {
+		log.Println(err)
+	}
+
 	if body_html != "" {
-		return body_html
+		return body_html, nil
+	}
+
+	return body_plain, nil
+}
+
+// bodyFetch is a message body being fetched from the server for the reader
+type bodyFetch struct {
+	cancel context.CancelFunc
+}
+
+// startBodyFetch returns the context to fetch a message body with. Only one
+// body is fetched at a time: starting another one cancels the previous fetch,
+// since the user has moved on to another message. done must be called when
+// the fetch is over.
+func (a *App) startBodyFetch(accountId int64) (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(a.accountContext(accountId))
+	fetch := &bodyFetch{cancel: cancel}
+
+	a.bodyFetchMutex.Lock()
+	if a.bodyFetch != nil {
+		a.bodyFetch.cancel()
 	}
+	a.bodyFetch = fetch
+	a.bodyFetchMutex.Unlock()
 
-	if body_plain != "" {
-		return body_plain
+	return ctx, func() {
+		cancel()
+
+		a.bodyFetchMutex.Lock()
+		if a.bodyFetch == fetch {
+			a.bodyFetch = nil
+		}
+		a.bodyFetchMutex.Unlock()
 	}
+}
 
-	return "Error retrieving email body"
+// CancelEmailBody abandons the message body being fetched, if any, for when
+// the user clicks away before it has loaded
+func (a *App) CancelEmailBody() {
+	a.bodyFetchMutex.Lock()
+	defer a.bodyFetchMutex.Unlock()
+
+	if a.bodyFetch != nil {
+		a.bodyFetch.cancel()
+	}
 }
@@ -2,113 +2,253 @@ package wails_app
 
 import (
 	"context"
+	"crypto/subtle"
 	"email_test_app/backend/assets"
 	"email_test_app/backend/auth"
+	"email_test_app/backend/mail"
 	_ "embed"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"time"
 
 	"github.com/wailsapp/wails/v2/pkg/runtime"
 	"golang.org/x/oauth2"
 )
 
-func (a *App) StartOAuth(providerName string) error {
-	var oauthConfig *oauth2.Config
-	var codeVerifier string
-	var err error
-	var newAccount auth.Account
+// OAUTH_TIMEOUT is how long to wait for the user to finish signing in in the
+// browser before giving up
+const OAUTH_TIMEOUT = 5 * time.Minute
 
-	switch providerName {
-	case "Gmail":
-		oauthConfig = auth.GmailOAuthConfig
+const oauthCallbackPath = "/oauth2callback"
+
+var (
+	errOAuthCancelled = mail.NewError(mail.ErrorCancelled, errors.New("OAuth login cancelled"))
+	errOAuthDenied    = mail.NewError(mail.ErrorAuthFailed, errors.New("OAuth access denied by user"))
+)
+
+// oauthFlow is a single browser sign-in. Each flow has its own state
+// parameter and its own loopback listener, which is closed when the flow ends.
+// Device logins only use cancel.
+type oauthFlow struct {
+	state  string
+	result chan oauthResult
+	server *http.Server
+	cancel context.CancelCauseFunc
+}
+
+type oauthResult struct {
+	code string
+	err  error
+}
+
+// finish delivers the result of the callback. Only the first result counts;
+// later requests to the callback URL are ignored.
+func (f *oauthFlow) finish(code string, err error) {
+	select {
+	case f.result <- oauthResult{code, err}:
 	default:
-		return fmt.Errorf("unsupported provider for OAuth")
 	}
+}
 
-	codeVerifier, err = auth.GenerateCodeVerifier()
+func (a *App) StartOAuth(providerName string) error {
+	provider, err := auth.GetProvider(providerName)
 	if err != nil {
 		return err
 	}
+
+	codeVerifier, err := auth.GenerateCodeVerifier()
+	if err != nil {
+		return internalError(err)
+	}
 	codeChallenge := auth.GenerateCodeChallenge(codeVerifier)
 
-	authURL := oauthConfig.AuthCodeURL(a.oauthState, oauth2.AccessTypeOffline,
+	state, err := auth.GenerateState()
+	if err != nil {
+		return internalError(err)
+	}
+
+	// Bind an ephemeral port on the loopback interface (RFC 8252 section 7.3)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return internalError(fmt.Errorf("error starting OAuth callback listener: %w", err))
+	}
+
+	// Copy the config so the per-flow redirect URL isn't shared
+	oauthConfig := *provider.OAuthConfig()
+	oauthConfig.RedirectURL = fmt.Sprintf("http://%s%s", listener.Addr().String(), oauthCallbackPath)
+
+	ctx, cancel := context.WithTimeoutCause(context.Background(), OAUTH_TIMEOUT,
+		mail.NewError(mail.ErrorCancelled, fmt.Errorf("OAuth login timed out after %v", OAUTH_TIMEOUT)))
+	defer cancel()
+	ctx, cancelCause := context.WithCancelCause(ctx)
+	defer cancelCause(nil)
+
+	flow := &oauthFlow{
+		state:  state,
+		result: make(chan oauthResult, 1),
+		cancel: cancelCause,
+	}
+	flow.server = &http.Server{Handler: a.oauthHandler(flow)}
+
+	a.setOAuthFlow(flow)
+	defer a.clearOAuthFlow(flow)
+
+	go func() {
+		if err := flow.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Println("OAuth callback server failed:", err)
+			flow.cancel(err)
+		}
+	}()
+	defer flow.server.Shutdown(context.Background())
+
+	authURL := oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOffline,
 		oauth2.SetAuthURLParam("code_challenge", codeChallenge),
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"))
 
 	// Open the browser to let the user authenticate
 	runtime.BrowserOpenURL(a.ctx, authURL)
 
-	// Wait for the authorization code from the HTTP handler
-	code := <-a.oauthCodeChannel
+	// Wait for the authorization code from the HTTP handler, the timeout or
+	// CancelOAuth, whichever comes first
+	var code string
+	select {
+	case result := <-flow.result:
+		if result.err != nil {
+			emitEvent(a.ctx, "OAuthFailure", result.err.Error())
+			return result.err
+		}
+		code = result.code
+	case <-ctx.Done():
+		err := context.Cause(ctx)
+		emitEvent(a.ctx, "OAuthFailure", err.Error())
+		return err
+	}
 
 	// Exchange the authorization code for a token
-	token, err := oauthConfig.Exchange(context.Background(), code,
+	token, err := oauthConfig.Exchange(ctx, code,
 		oauth2.SetAuthURLParam("code_verifier", codeVerifier))
 	if err != nil {
 		log.Println("Token exchange failed:", err)
-		runtime.EventsEmit(a.ctx, "OAuthFailure", nil)
+		err = auth.TokenError(err)
+		emitEvent(a.ctx, "OAuthFailure", err.Error())
 		return err
 	}
 
+	return a.addOAuthAccount(ctx, provider, token)
+}
+
+// addOAuthAccount saves the account a newly signed-in token belongs to and
+// tells the frontend about it
+func (a *App) addOAuthAccount(ctx context.Context, provider auth.Provider, token *oauth2.Token) error {
+	var err error
+	var newAccount auth.Account
 	newAccount.OAuthAccessToken = token.AccessToken
 	newAccount.OAuthRefreshToken = token.RefreshToken
 	newAccount.OAuthExpiry = token.Expiry.Unix()
 
 	// Get the user's email address
-	client := oauthConfig.Client(context.Background(), token)
-	resp, err := client.Get("https://www.googleapis.com/oauth2/v2/userinfo")
+	newAccount.Email, err = provider.LookupEmail(ctx, token)
 	if err != nil {
 		log.Println("Failed to get user info:", err)
-		runtime.EventsEmit(a.ctx, "OAuthFailure", nil)
+		err = auth.TokenError(err)
+		emitEvent(a.ctx, "OAuthFailure", err.Error())
 		return err
 	}
-	defer resp.Body.Close()
+	newAccount.ImapUrl = provider.ImapUrl()
+	newAccount.Provider = provider.Name()
+	newAccount.AuthState = auth.AuthStateActive
+	// signing in again doesn't reset the connection settings
+	if account, ok := a.getAccountByEmail(newAccount.Email); ok {
+		newAccount.Connection = account.Connection
+	}
 
-	var userInfo struct {
-		Email string `json:"email"`
+	if err := a.updateAccounts(&newAccount); err != nil {
+		emitEvent(a.ctx, "OAuthFailure", err.Error())
+		return internalError(err)
 	}
-	err = json.NewDecoder(resp.Body).Decode(&userInfo)
-	if err != nil {
-		log.Println("Failed to parse user info:", err)
-		runtime.EventsEmit(a.ctx, "OAuthFailure", nil)
-		return err
+
+	// Emit an event to the frontend to proceed
+	emitEvent(a.ctx, "OAuthSuccess", newAccount.Id)
+
+	return nil
+}
+
+// CancelOAuth abandons the sign-in that is waiting for the browser or for a
+// device code to be entered, if any
+func (a *App) CancelOAuth() {
+	a.oauthMutex.Lock()
+	defer a.oauthMutex.Unlock()
+
+	if a.oauthFlow != nil {
+		a.oauthFlow.cancel(errOAuthCancelled)
 	}
+}
 
-	newAccount.Email = userInfo.Email
-	switch providerName {
-	case "Gmail":
-		newAccount.ImapUrl = auth.GmailImapUrl
-	default:
-		return fmt.Errorf("unsupported provider for OAuth")
+// setOAuthFlow makes flow the current sign-in, cancelling any earlier one
+// that is still waiting
+func (a *App) setOAuthFlow(flow *oauthFlow) {
+	a.oauthMutex.Lock()
+	defer a.oauthMutex.Unlock()
+
+	if a.oauthFlow != nil {
+		a.oauthFlow.cancel(errOAuthCancelled)
 	}
+	a.oauthFlow = flow
+}
 
-	a.updateAccounts(&newAccount)
+func (a *App) clearOAuthFlow(flow *oauthFlow) {
+	a.oauthMutex.Lock()
+	defer a.oauthMutex.Unlock()
 
-	// Emit an event to the frontend to proceed
-	runtime.EventsEmit(a.ctx, "OAuthSuccess", newAccount.Id)
+	if a.oauthFlow == flow {
+		a.oauthFlow = nil
+	}
+}
 
-	return nil
+// oauthHandler serves the loopback redirect for a single flow
+func (a *App) oauthHandler(flow *oauthFlow) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(oauthCallbackPath, func(w http.ResponseWriter, r *http.Request) {
+		a.oauthCallbackHandler(flow, w, r)
+	})
+	mux.HandleFunc("/appicon.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(assets.AppIconPNG)
+	})
+	return mux
 }
 
-func (a *App) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
+func (a *App) oauthCallbackHandler(flow *oauthFlow, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
 	// Validate state parameter
-	state := r.URL.Query().Get("state")
-	if state != a.oauthState {
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.state)) != 1 {
 		http.Error(w, "Invalid state parameter", http.StatusBadRequest)
 		return
 	}
 
-	code := r.URL.Query().Get("code")
+	if oauthErr := query.Get("error"); oauthErr != "" {
+		if oauthErr == "access_denied" {
+			flow.finish("", errOAuthDenied)
+			http.Error(w, "Sign-in was cancelled. You can close this window.", http.StatusForbidden)
+			return
+		}
+		flow.finish("", mail.NewError(mail.ErrorServerRefused, fmt.Errorf("OAuth error: %s %s", oauthErr, query.Get("error_description"))))
+		http.Error(w, "Sign-in failed. You can close this window.", http.StatusBadRequest)
+		return
+	}
+
+	code := query.Get("code")
 	if code == "" {
 		http.Error(w, "No code in request", http.StatusBadRequest)
-		runtime.EventsEmit(a.ctx, "OAuthFailure", nil)
 		return
 	}
 
 	// Send the code back to the application
-	a.oauthCodeChannel <- code
+	flow.finish(code, nil)
 
 	htmlContent, err := assets.OauthSuccessHTML.ReadFile("oauth_success.html")
 	if err != nil {
@@ -121,18 +261,3 @@ func (a *App) oauthCallbackHandler(w http.ResponseWriter, r *http.Request) {
 	// Write the file content as the response
 	fmt.Fprint(w, string(htmlContent))
 }
-
-func (a *App) startHTTPServer() {
-	http.HandleFunc("/oauth2callback", a.oauthCallbackHandler)
-	http.HandleFunc("/appicon.png", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "image/png")
-		w.Write(assets.AppIconPNG)
-	})
-
-	a.httpServer = &http.Server{Addr: "localhost:9498"}
-
-	// Start the server
-	if err := a.httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		log.Fatalf("HTTP server failed: %v", err)
-	}
-}
@@ -0,0 +1,56 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/auth"
+	"email_test_app/backend/mail"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fixedEmailProvider is a provider whose tokens all belong to one address
+type fixedEmailProvider struct {
+	*auth.OAuthProvider
+	email string
+}
+
+func (p fixedEmailProvider) LookupEmail(ctx context.Context, token *oauth2.Token) (string, error) {
+	return p.email, nil
+}
+
+func TestAddOAuthAccountKeepsConnectionSettings(t *testing.T) {
+	a := newTestApp(t)
+	events := recordEvents(t)
+
+	settings := mail.ConnectionSettings{Security: mail.SecurityStartTLS, MinTLSVersion: "1.3"}
+	accountId := addTestAccount(t, a, auth.Account{
+		Email:      "user@example.com",
+		ImapUrl:    "imap.example.com:993",
+		Provider:   t.Name(),
+		AuthState:  auth.AuthStateSignedOut,
+		Connection: settings,
+	})
+
+	provider := fixedEmailProvider{
+		OAuthProvider: &auth.OAuthProvider{ProviderName: t.Name(), Imap: "imap.example.com:993"},
+		email:         "user@example.com",
+	}
+	token := &oauth2.Token{AccessToken: "access-token", RefreshToken: "refresh-token", Expiry: time.Now().Add(time.Hour)}
+	if err := a.addOAuthAccount(context.Background(), provider, token); err != nil {
+		t.Fatal(err)
+	}
+
+	if successes := events.named("OAuthSuccess"); len(successes) != 1 || successes[0][0] != accountId {
+		t.Fatalf("got OAuthSuccess events %v, want one for account %d", successes, accountId)
+	}
+	for name, account := range map[string]auth.Account{"memory": a.accounts[accountId], "database": storedAccount(t, a, accountId)} {
+		if account.Connection != settings {
+			t.Errorf("%s: connection settings are %+v, want %+v", name, account.Connection, settings)
+		}
+		if account.OAuthAccessToken != "access-token" || account.AuthState != auth.AuthStateActive {
+			t.Errorf("%s: got token %q in state %q, want the new token and an active account", name, account.OAuthAccessToken, account.AuthState)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/mail"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+const (
+	// PREFETCH_BATCH_SIZE is how many bodies are fetched per round trip
+	PREFETCH_BATCH_SIZE = 25
+	// PREFETCH_CONCURRENCY is how many batches of an account are fetched at
+	// once. It stays below POOL_MAX_CONNS so opening a message or syncing
+	// doesn't have to wait for prefetching.
+	PREFETCH_CONCURRENCY = 2
+	// sqliteMaxParams keeps IN lists under SQLite's limit on query parameters
+	sqliteMaxParams = 500
+)
+
+// BodiesPrefetched is sent with the BodiesPrefetched event once a batch of
+// bodies has been cached
+type BodiesPrefetched struct {
+	AccountId   int64    `json:"account_id"`
+	MailboxName string   `json:"mailbox_name"`
+	UIDs        []uint32 `json:"uids"`
+}
+
+type prefetchItem struct {
+	mailbox string
+	uid     uint32
+}
+
+// bodyPrefetcher fetches an account's message bodies into the cache in the
+// background. The queue is in priority order: each PrefetchBodies call
+// replaces what was queued for its mailbox and goes first, since it is about
+// what the user is looking at now.
+type bodyPrefetcher struct {
+	accountId int64
+
+	mu      sync.Mutex
+	queue   []prefetchItem
+	running int
+}
+
+// prefetch queues the bodies of a mailbox's messages ahead of everything else
+// and starts workers if there are fewer than PREFETCH_CONCURRENCY
+func (p *bodyPrefetcher) prefetch(a *App, mailbox string, uids []uint32) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	queue := make([]prefetchItem, 0, len(uids)+len(p.queue))
+	for _, uid := range uids {
+		queue = append(queue, prefetchItem{mailbox, uid})
+	}
+	for _, item := range p.queue {
+		if item.mailbox != mailbox {
+			queue = append(queue, item)
+		}
+	}
+	p.queue = queue
+
+	for p.running < PREFETCH_CONCURRENCY && p.running < len(p.queue) {
+		p.running++
+		go p.run(a)
+	}
+}
+
+// nextBatch takes up to PREFETCH_BATCH_SIZE of the first queued mailbox's
+// messages off the queue, keeping their order
+func (p *bodyPrefetcher) nextBatch() (string, []uint32, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.queue) == 0 {
+		p.running--
+		return "", nil, false
+	}
+
+	mailbox := p.queue[0].mailbox
+	var uids []uint32
+	rest := p.queue[:0]
+	for _, item := range p.queue {
+		if item.mailbox == mailbox && len(uids) < PREFETCH_BATCH_SIZE {
+			uids = append(uids, item.uid)
+		} else {
+			rest = append(rest, item)
+		}
+	}
+	p.queue = rest
+	return mailbox, uids, true
+}
+
+func (p *bodyPrefetcher) clear() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = nil
+}
+
+func (p *bodyPrefetcher) run(a *App) {
+	for {
+		mailbox, uids, ok := p.nextBatch()
+		if !ok {
+			return
+		}
+
+		err := a.prefetchBodies(a.accountContext(p.accountId), p.accountId, mailbox, uids)
+		if err != nil {
+			log.Println("Error prefetching bodies for account", p.accountId, ":", err)
+		}
+	}
+}
+
+// bodyPrefetcher returns the account's prefetcher, creating it if needed
+func (a *App) bodyPrefetcher(accountId int64) *bodyPrefetcher {
+	a.prefetchersMutex.Lock()
+	defer a.prefetchersMutex.Unlock()
+
+	if a.prefetchers == nil {
+		a.prefetchers = make(map[int64]*bodyPrefetcher)
+	}
+
+	p, ok := a.prefetchers[accountId]
+	if !ok {
+		p = &bodyPrefetcher{accountId: accountId}
+		a.prefetchers[accountId] = p
+	}
+	return p
+}
+
+// stopBodyPrefetch drops the account's queued prefetches; batches being
+// fetched are aborted by cancelling the account's operations
+func (a *App) stopBodyPrefetch(accountId int64) {
+	a.prefetchersMutex.Lock()
+	p, ok := a.prefetchers[accountId]
+	a.prefetchersMutex.Unlock()
+
+	if ok {
+		p.clear()
+	}
+}
+
+// prefetchBodies fetches and caches the bodies of the messages that aren't
+// cached yet, then tells the frontend which ones it cached
+func (a *App) prefetchBodies(ctx context.Context, accountId int64, mailboxName string, uids []uint32) error {
+	uids, err := a.uncachedBodies(accountId, mailboxName, uids)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+
+	var bodies map[uint32]mail.EmailBody
+	err = a.withAccountClient(ctx, accountId, func(c *mail.Conn) error {
+		if _, err := c.Select(mailboxName, false); err != nil {
+			return fmt.Errorf("error selecting mailbox: %w", err)
+		}
+		var err error
+		bodies, err = mail.FetchEmailBodies(ctx, c.Client, uids, mail.BodyLimits{})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	cached := make([]uint32, 0, len(bodies))
+	for _, uid := range uids {
+		body, ok := bodies[uid]
+		if !ok || (body.Plain == "" && body.HTML == "") {
+			continue
+		}
+		if err := a.cacheBody(accountId, mailboxName, uid, body); err != nil {
+			return err
+		}
+		cached = append(cached, uid)
+	}
+
+	if len(cached) > 0 {
+		emitEvent(a.ctx, "BodiesPrefetched", BodiesPrefetched{
+			AccountId:   accountId,
+			MailboxName: mailboxName,
+			UIDs:        cached,
+		})
+	}
+	return nil
+}
+
+// uncachedBodies returns the UIDs among uids, in the same order, of cached
+// messages whose bodies haven't been fetched yet
+func (a *App) uncachedBodies(accountId int64, mailboxName string, uids []uint32) ([]uint32, error) {
+	missing := make(map[uint32]bool)
+	err := forEachBatch(uids, func(batch []uint32) error {
+		query := `
+        SELECT uid FROM messages
+        WHERE account_id = ? AND mailbox_name = ? AND uid IN (` + placeholders(len(batch)) + `)
+          AND COALESCE(body_plain, '') = '' AND COALESCE(body_html, '') = ''`
+		args := []interface{}{accountId, mailboxName}
+		for _, uid := range batch {
+			args = append(args, uid)
+		}
+
+		rows, err := a.db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var uid uint32
+			if err := rows.Scan(&uid); err != nil {
+				return err
+			}
+			missing[uid] = true
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying uncached bodies: %w", err)
+	}
+
+	result := make([]uint32, 0, len(missing))
+	for _, uid := range uids {
+		if missing[uid] {
+			result = append(result, uid)
+			delete(missing, uid)
+		}
+	}
+	return result, nil
+}
+
+// cacheBody stores a fetched body with its message
+func (a *App) cacheBody(accountId int64, mailboxName string, uid uint32, body mail.EmailBody) error {
+	_, err := a.db.Exec(`
+        UPDATE messages
+        SET body_plain = ?, body_html = ?
+        WHERE account_id = ? AND mailbox_name = ? AND uid = ?
+    `, body.Plain, body.HTML, accountId, mailboxName, uid)
+	if err != nil {
+		return fmt.Errorf("error updating email body in cache: %w", err)
+	}
+	return nil
+}
+
+// forEachBatch calls fn with consecutive slices of uids small enough to be
+// passed as query parameters
+func forEachBatch(uids []uint32, fn func(batch []uint32) error) error {
+	for start := 0; start < len(uids); start += sqliteMaxParams {
+		if err := fn(uids[start:min(start+sqliteMaxParams, len(uids))]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// PrefetchBodies fetches the bodies of the given messages in the background so
+// opening them doesn't wait for the server. UIDs are fetched in the order
+// given, so the messages closest to what is on screen should come first; a
+// later call for the same mailbox replaces the messages still queued. A
+// BodiesPrefetched event is sent as each batch is cached.
+func (a *App) PrefetchBodies(accountId int64, mailboxName string, uids []uint32) error {
+	if !a.IsLoggedIn(accountId) {
+		return errNotLoggedIn(accountId)
+	}
+
+	uids, err := a.uncachedBodies(accountId, mailboxName, uids)
+	if err != nil {
+		log.Println(err)
+		return internalError(err)
+	}
+	if len(uids) > 0 {
+		a.bodyPrefetcher(accountId).prefetch(a, mailboxName, uids)
+	}
+	return nil
+}
+
+// GetMessagesByIds returns the cached messages of a mailbox with the given
+// UIDs, in the same order, along with their bodies if they have been fetched.
+// UIDs that aren't cached are left out.
+func (a *App) GetMessagesByIds(accountId int64, mailboxName string, uids []uint32) ([]mail.SerializableMessage, error) {
+	if !a.IsLoggedIn(accountId) {
+		return nil, errNotLoggedIn(accountId)
+	}
+
+	found := make(map[uint32]mail.SerializableMessage)
+	err := forEachBatch(uids, func(batch []uint32) error {
+		query := `
+        SELECT ` + messageColumns + `, COALESCE(body_plain, ''), COALESCE(body_html, '') FROM messages
+        WHERE account_id = ? AND mailbox_name = ? AND uid IN (` + placeholders(len(batch)) + `)`
+		args := []interface{}{accountId, mailboxName}
+		for _, uid := range batch {
+			args = append(args, uid)
+		}
+
+		rows, err := a.db.Query(query, args...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var body mail.EmailBody
+			msg, _, err := scanMessage(extraColumns{rows, []any{&body.Plain, &body.HTML}})
+			if err != nil {
+				log.Println("Error scanning message row:", err)
+				continue
+			}
+			msg.Body = body
+			found[msg.UID] = msg
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		log.Println("Error querying messages from database:", err)
+		return nil, internalError(err)
+	}
+
+	messages := make([]mail.SerializableMessage, 0, len(found))
+	for _, uid := range uids {
+		if msg, ok := found[uid]; ok {
+			messages = append(messages, msg)
+			delete(found, uid)
+		}
+	}
+	return messages, nil
+}
+
+// extraColumns lets scanMessage read rows that select more columns after
+// messageColumns
+type extraColumns struct {
+	row  interface{ Scan(...any) error }
+	dest []any
+}
+
+func (r extraColumns) Scan(dest ...any) error {
+	return r.row.Scan(append(dest, r.dest...)...)
+}
@@ -0,0 +1,403 @@
+package wails_app
+
+import (
+	"email_test_app/backend/db"
+	"email_test_app/backend/power"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	// SYNC_MIN_INTERVAL keeps a configured interval from hammering the server
+	SYNC_MIN_INTERVAL = time.Minute
+	// SYNC_RETRY_DELAY is how long to wait before retrying a failed sync; it
+	// doubles with every further failure up to SYNC_MAX_BACKOFF
+	SYNC_RETRY_DELAY = 30 * time.Second
+	SYNC_MAX_BACKOFF = time.Hour
+	// SYNC_JITTER is the fraction an interval is randomly shortened or
+	// lengthened by, so mailboxes and accounts don't all sync at once
+	SYNC_JITTER = 0.1
+	// SCHEDULER_TICK is how often the scheduler looks for syncs that are due
+	SCHEDULER_TICK = 15 * time.Second
+	// POWER_CHECK_INTERVAL is how long the power and network status is
+	// trusted before IsSyncPaused looks again; reading it can mean running
+	// a system command
+	POWER_CHECK_INTERVAL = 2 * time.Minute
+)
+
+const (
+	settingPauseOnBattery = "sync.pause_on_battery"
+	settingPauseOnMetered = "sync.pause_on_metered"
+)
+
+// SyncSettings are the app-wide background sync preferences
+type SyncSettings struct {
+	PauseOnBattery bool `json:"pause_on_battery"`
+	PauseOnMetered bool `json:"pause_on_metered"`
+}
+
+// SyncScheduleEntry describes when a mailbox, or with an empty name the
+// account's mailbox list, is next synced in the background
+type SyncScheduleEntry struct {
+	MailboxName     string `json:"mailbox_name"`
+	IntervalSeconds int64  `json:"interval_seconds"`
+	NextRun         int64  `json:"next_run"` // unix seconds
+	Failures        int    `json:"failures"`
+	Queued          bool   `json:"queued"`
+}
+
+// scheduleKey identifies a scheduled sync. kind is syncMailboxesJob for the
+// mailbox list or syncMessagesJob for a mailbox.
+type scheduleKey struct {
+	accountId int64
+	kind      syncJobKind
+	mailbox   string
+}
+
+type scheduleEntry struct {
+	interval time.Duration
+	nextRun  time.Time
+	failures int
+	// queued is set while the sync waits in the account's worker or runs, so
+	// it isn't queued again
+	queued bool
+}
+
+// startScheduler starts syncing accounts in the background if it isn't
+// running yet
+func (a *App) startScheduler() {
+	a.scheduleMutex.Lock()
+	defer a.scheduleMutex.Unlock()
+
+	if a.schedulerStop != nil {
+		return
+	}
+	a.schedulerStop = make(chan struct{})
+	go a.runScheduler(a.schedulerStop)
+}
+
+func (a *App) stopScheduler() {
+	a.scheduleMutex.Lock()
+	defer a.scheduleMutex.Unlock()
+
+	if a.schedulerStop != nil {
+		close(a.schedulerStop)
+		a.schedulerStop = nil
+	}
+}
+
+func (a *App) runScheduler(stop <-chan struct{}) {
+	ticker := time.NewTicker(SCHEDULER_TICK)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.queueDueSyncs()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// queueDueSyncs hands every sync whose time has come to its account's worker,
+// unless syncing is paused
+func (a *App) queueDueSyncs() {
+	a.updateSchedule()
+
+	if a.IsSyncPaused() {
+		return
+	}
+
+	now := time.Now()
+	var due []scheduleKey
+
+	a.scheduleMutex.Lock()
+	for key, entry := range a.schedule {
+		if !entry.queued && !now.Before(entry.nextRun) {
+			entry.queued = true
+			due = append(due, key)
+		}
+	}
+	a.scheduleMutex.Unlock()
+
+	for _, key := range due {
+		a.syncWorker(key.accountId).enqueue(syncJob{kind: key.kind, mailbox: key.mailbox}, syncPriorityBackground)
+	}
+}
+
+// updateSchedule adds the mailboxes of signed in accounts that aren't
+// scheduled yet, drops those that are gone and applies changed intervals
+func (a *App) updateSchedule() {
+	wanted := make(map[scheduleKey]time.Duration)
+	for _, accountId := range a.GetAccountIds() {
+		if !a.IsLoggedIn(accountId) {
+			continue
+		}
+
+		intervals, err := db.GetSyncIntervals(a.db, accountId)
+		if err != nil {
+			log.Println("Error reading sync intervals:", err)
+			continue
+		}
+
+		accountInterval, ok := intervals[""]
+		if ok {
+			wanted[scheduleKey{accountId, syncMailboxesJob, ""}] = accountInterval
+		} else {
+			wanted[scheduleKey{accountId, syncMailboxesJob, ""}] = MAILBOX_UPDATE_TIME
+			accountInterval = EMAIL_UPDATE_TIME
+		}
+
+		mailboxes, err := a.getMailboxes(accountId)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, mailbox := range mailboxes {
+			interval, ok := intervals[mailbox]
+			if !ok {
+				interval = accountInterval
+			}
+			wanted[scheduleKey{accountId, syncMessagesJob, mailbox}] = interval
+		}
+	}
+
+	now := time.Now()
+
+	a.scheduleMutex.Lock()
+	defer a.scheduleMutex.Unlock()
+
+	if a.schedule == nil {
+		a.schedule = make(map[scheduleKey]*scheduleEntry)
+	}
+
+	for key := range a.schedule {
+		if _, ok := wanted[key]; !ok {
+			delete(a.schedule, key)
+		}
+	}
+
+	// accounts have just been synced when they are first scheduled, so the
+	// first background sync is a full interval away
+	for key, interval := range wanted {
+		entry, ok := a.schedule[key]
+		if !ok {
+			a.schedule[key] = &scheduleEntry{interval: interval, nextRun: now.Add(jitter(interval))}
+			continue
+		}
+		if entry.interval != interval {
+			entry.interval = interval
+			if entry.failures == 0 {
+				entry.nextRun = now.Add(jitter(interval))
+			}
+		}
+	}
+}
+
+// syncFinished schedules the next background run of a sync that has just
+// run, whether the scheduler or the user asked for it
+func (a *App) syncFinished(accountId int64, job syncJob, err error) {
+	if job.kind == syncAccountJob {
+		job.kind = syncMailboxesJob
+	}
+
+	a.scheduleMutex.Lock()
+	defer a.scheduleMutex.Unlock()
+
+	entry, ok := a.schedule[scheduleKey{accountId, job.kind, job.mailbox}]
+	if !ok {
+		return
+	}
+
+	entry.queued = false
+	if err == nil {
+		entry.failures = 0
+		entry.nextRun = time.Now().Add(jitter(entry.interval))
+		return
+	}
+
+	entry.failures++
+	entry.nextRun = time.Now().Add(jitter(backoff(entry.failures)))
+}
+
+// forgetSchedule stops scheduling syncs of the account
+func (a *App) forgetSchedule(accountId int64) {
+	a.scheduleMutex.Lock()
+	defer a.scheduleMutex.Unlock()
+
+	for key := range a.schedule {
+		if key.accountId == accountId {
+			delete(a.schedule, key)
+		}
+	}
+}
+
+// backoff is the delay before the next attempt after the given number of
+// consecutive failures
+func backoff(failures int) time.Duration {
+	delay := SYNC_RETRY_DELAY
+	for i := 1; i < failures && delay < SYNC_MAX_BACKOFF; i++ {
+		delay *= 2
+	}
+	return min(delay, SYNC_MAX_BACKOFF)
+}
+
+func jitter(d time.Duration) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*SYNC_JITTER*float64(d))
+}
+
+// SyncNow queues a sync of the account's mailbox list and every mailbox
+// ahead of background syncing, even while syncing is paused
+func (a *App) SyncNow(accountId int64) error {
+	if !a.IsLoggedIn(accountId) {
+		return errNotLoggedIn(accountId)
+	}
+
+	a.syncWorker(accountId).enqueue(syncJob{kind: syncAccountJob}, syncPriorityUser)
+	return nil
+}
+
+// GetSyncSchedule returns when the account's mailbox list and each of its
+// mailboxes will next be synced
+func (a *App) GetSyncSchedule(accountId int64) []SyncScheduleEntry {
+	a.updateSchedule()
+
+	a.scheduleMutex.Lock()
+	defer a.scheduleMutex.Unlock()
+
+	result := make([]SyncScheduleEntry, 0)
+	for key, entry := range a.schedule {
+		if key.accountId != accountId {
+			continue
+		}
+		result = append(result, SyncScheduleEntry{
+			MailboxName:     key.mailbox,
+			IntervalSeconds: int64(entry.interval / time.Second),
+			NextRun:         entry.nextRun.Unix(),
+			Failures:        entry.failures,
+			Queued:          entry.queued,
+		})
+	}
+
+	// the mailbox list, which has no name, comes first
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].MailboxName < result[j].MailboxName
+	})
+
+	return result
+}
+
+// SetSyncInterval sets how often a mailbox, or with an empty name the whole
+// account, is synced in the background. Zero goes back to the default.
+func (a *App) SetSyncInterval(accountId int64, mailboxName string, intervalSeconds int64) error {
+	interval := time.Duration(intervalSeconds) * time.Second
+	if interval != 0 && interval < SYNC_MIN_INTERVAL {
+		return errInvalidArgument("sync interval must be at least %v", SYNC_MIN_INTERVAL)
+	}
+
+	if err := db.SetSyncInterval(a.db, accountId, mailboxName, interval); err != nil {
+		log.Println(err)
+		return internalError(err)
+	}
+
+	a.updateSchedule()
+	return nil
+}
+
+func (a *App) GetSyncSettings() SyncSettings {
+	a.syncPauseMutex.Lock()
+	defer a.syncPauseMutex.Unlock()
+
+	if a.syncSettings == nil {
+		a.syncSettings = &SyncSettings{
+			PauseOnBattery: a.boolSetting(settingPauseOnBattery, false),
+			PauseOnMetered: a.boolSetting(settingPauseOnMetered, false),
+		}
+	}
+	return *a.syncSettings
+}
+
+func (a *App) SetSyncSettings(settings SyncSettings) error {
+	a.syncPauseMutex.Lock()
+	defer a.syncPauseMutex.Unlock()
+
+	// read the settings again if only some were saved
+	a.syncSettings = nil
+
+	err := db.SetSetting(a.db, settingPauseOnBattery, strconv.FormatBool(settings.PauseOnBattery))
+	if err == nil {
+		err = db.SetSetting(a.db, settingPauseOnMetered, strconv.FormatBool(settings.PauseOnMetered))
+	}
+	if err != nil {
+		log.Println(err)
+		return internalError(err)
+	}
+
+	a.syncSettings = &settings
+	return nil
+}
+
+// IsSyncPaused reports whether background syncing is paused because the
+// machine is on battery or a metered connection and the user asked for that.
+// The status may be up to POWER_CHECK_INTERVAL old.
+func (a *App) IsSyncPaused() bool {
+	settings := a.GetSyncSettings()
+	if !settings.PauseOnBattery && !settings.PauseOnMetered {
+		return false
+	}
+
+	status := a.currentPowerStatus()
+	return (settings.PauseOnBattery && status.OnBattery) || (settings.PauseOnMetered && status.Metered)
+}
+
+// currentPowerStatus returns the power and network status, reading it again
+// once POWER_CHECK_INTERVAL has passed. The status is read without holding
+// syncPauseMutex, as it can mean waiting for a system command; other callers
+// get the old status meanwhile.
+func (a *App) currentPowerStatus() power.Status {
+	a.syncPauseMutex.Lock()
+	status := a.powerStatus
+	stale := time.Since(a.powerCheckedAt) >= POWER_CHECK_INTERVAL
+	if stale {
+		a.powerCheckedAt = time.Now()
+	}
+	a.syncPauseMutex.Unlock()
+
+	if !stale {
+		return status
+	}
+
+	status = power.Current()
+	a.syncPauseMutex.Lock()
+	a.powerStatus = status
+	a.syncPauseMutex.Unlock()
+	return status
+}
+
+func (a *App) boolSetting(key string, def bool) bool {
+	value, err := db.GetSetting(a.db, key, strconv.FormatBool(def))
+	if err != nil {
+		log.Println(err)
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return def
+	}
+	return enabled
+}
+
+func (a *App) intSetting(key string, def int) int {
+	value, err := db.GetSetting(a.db, key, strconv.Itoa(def))
+	if err != nil {
+		log.Println(err)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package wails_app
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, SYNC_RETRY_DELAY},
+		{2, 2 * SYNC_RETRY_DELAY},
+		{3, 4 * SYNC_RETRY_DELAY},
+		{7, 64 * SYNC_RETRY_DELAY},
+		// doubling again would pass the cap
+		{8, SYNC_MAX_BACKOFF},
+		{1000, SYNC_MAX_BACKOFF},
+	}
+	for _, test := range tests {
+		if got := backoff(test.failures); got != test.want {
+			t.Errorf("backoff(%d) = %v, want %v", test.failures, got, test.want)
+		}
+	}
+}
+
+// assertNextRun checks that a sync is due after roughly d, allowing for jitter
+func assertNextRun(t *testing.T, entry *scheduleEntry, d time.Duration) {
+	t.Helper()
+
+	slack := time.Duration(SYNC_JITTER*float64(d)) + time.Second
+	if until := time.Until(entry.nextRun); until < d-slack || until > d+slack {
+		t.Errorf("next run is in %v, want about %v", until, d)
+	}
+}
+
+func TestSyncFinished(t *testing.T) {
+	a := newTestApp(t)
+
+	mailboxKey := scheduleKey{1, syncMessagesJob, "INBOX"}
+	listKey := scheduleKey{1, syncMailboxesJob, ""}
+	a.schedule = map[scheduleKey]*scheduleEntry{
+		mailboxKey: {interval: 10 * time.Minute, nextRun: time.Now(), queued: true},
+		listKey:    {interval: time.Hour, nextRun: time.Now(), queued: true},
+	}
+	entry := a.schedule[mailboxKey]
+	failed := errors.New("connection refused")
+
+	a.syncFinished(1, syncJob{kind: syncMessagesJob, mailbox: "INBOX"}, failed)
+	if entry.queued || entry.failures != 1 {
+		t.Fatalf("after a failure: queued %v with %d failures, want unqueued with 1", entry.queued, entry.failures)
+	}
+	assertNextRun(t, entry, SYNC_RETRY_DELAY)
+
+	// a retry that fails again waits longer
+	entry.queued = true
+	a.syncFinished(1, syncJob{kind: syncMessagesJob, mailbox: "INBOX"}, failed)
+	if entry.queued || entry.failures != 2 {
+		t.Fatalf("after a second failure: queued %v with %d failures, want unqueued with 2", entry.queued, entry.failures)
+	}
+	assertNextRun(t, entry, 2*SYNC_RETRY_DELAY)
+
+	// and a success goes back to the interval
+	entry.queued = true
+	a.syncFinished(1, syncJob{kind: syncMessagesJob, mailbox: "INBOX"}, nil)
+	if entry.queued || entry.failures != 0 {
+		t.Fatalf("after a success: queued %v with %d failures, want unqueued with none", entry.queued, entry.failures)
+	}
+	assertNextRun(t, entry, 10*time.Minute)
+
+	// a whole-account sync counts as syncing the mailbox list
+	a.syncFinished(1, syncJob{kind: syncAccountJob}, nil)
+	if list := a.schedule[listKey]; list.queued {
+		t.Error("the mailbox list is still queued after syncing the account")
+	} else {
+		assertNextRun(t, list, time.Hour)
+	}
+
+	// syncs that aren't scheduled, such as of a removed mailbox, are ignored
+	a.syncFinished(1, syncJob{kind: syncMessagesJob, mailbox: "Gone"}, failed)
+	if len(a.schedule) != 2 {
+		t.Errorf("got %d scheduled syncs, want 2", len(a.schedule))
+	}
+}
@@ -0,0 +1,317 @@
+package wails_app
+
+import (
+	"email_test_app/backend/mail"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+)
+
+// MessageThread is a page entry returned by GetThreadsForMailbox
+type MessageThread struct {
+	Thread   *mail.Thread               `json:"thread"`
+	Messages []mail.SerializableMessage `json:"messages"`
+}
+
+type mailboxOrderKey struct {
+	accountId   int64
+	mailboxName string
+	ordering    string
+}
+
+// mailboxOrder is a server-computed ordering of a mailbox, cached so that
+// paging through it stays stable while new mail arrives
+type mailboxOrder struct {
+	uids    []uint32
+	threads []*mail.Thread
+}
+
+// GetSortedEmailsForMailbox returns a page of emails in the order computed by
+// the server's SORT extension. Requesting the first page recomputes the order;
+// later pages reuse it. Falls back to the local date order when the server
+// doesn't support SORT, which can only sort by date or arrival.
+func (a *App) GetSortedEmailsForMailbox(accountId int64, mailboxName string, sortField string, reverse bool, start, limit uint32) ([]mail.SerializableMessage, error) {
+	if !a.IsLoggedIn(accountId) {
+		log.Println("GetSortedEmailsForMailbox: User not logged in.")
+		return nil, errNotLoggedIn(accountId)
+	}
+
+	field, err := mail.ParseSortField(sortField)
+	if err != nil {
+		return nil, errInvalidArgument("%v", err)
+	}
+
+	key := mailboxOrderKey{accountId, mailboxName, fmt.Sprintf("sort:%s:%t", field, reverse)}
+	order, ok := a.getMailboxOrder(key)
+	if !ok || start == 0 {
+		var uids []uint32
+		err := a.withAccountClient(a.accountContext(accountId), accountId, func(c *mail.Conn) error {
+			if !mail.SupportsSort(c.Client) {
+				return client.ErrExtensionUnsupported
+			}
+			if _, err := c.Select(mailboxName, true); err != nil {
+				return fmt.Errorf("failed to select mailbox: %v", err)
+			}
+
+			criteria := imap.NewSearchCriteria()
+			criteria.WithoutFlags = []string{imap.DeletedFlag}
+			var err error
+			uids, err = mail.UidSort(c.Client, []mail.SortCriterion{{Field: field, Reverse: reverse}}, criteria)
+			return err
+		})
+		if errors.Is(err, client.ErrExtensionUnsupported) {
+			if field != mail.SortDate && field != mail.SortArrival {
+				return nil, errInvalidArgument("the server can't sort by %s", strings.ToLower(string(field)))
+			}
+
+			log.Println("Server doesn't support SORT, using cached order for mailbox:", mailboxName)
+			uids, err = a.getCachedOrder(accountId, mailboxName)
+			if err != nil {
+				log.Println("Error querying cached order:", err)
+				return nil, internalError(err)
+			}
+			// the cached order is newest first, SORT's is oldest first
+			if !reverse {
+				slices.Reverse(uids)
+			}
+		}
+		if err != nil {
+			log.Println("Error sorting mailbox on server:", err)
+			return nil, err
+		}
+
+		order = mailboxOrder{uids: uids}
+		a.setMailboxOrder(key, order)
+	}
+
+	return a.getMessagesInOrder(accountId, mailboxName, pageOf(order.uids, start, limit))
+}
+
+// GetThreadsForMailbox returns a page of conversation threads, newest first,
+// as computed by the server's THREAD=REFERENCES extension. Falls back to one
+// thread per message when the server doesn't support threading.
+func (a *App) GetThreadsForMailbox(accountId int64, mailboxName string, start, limit uint32) ([]MessageThread, error) {
+	if !a.IsLoggedIn(accountId) {
+		log.Println("GetThreadsForMailbox: User not logged in.")
+		return nil, errNotLoggedIn(accountId)
+	}
+
+	key := mailboxOrderKey{accountId, mailboxName, "thread:" + mail.ThreadReferences}
+	order, ok := a.getMailboxOrder(key)
+	if !ok || start == 0 {
+		var threads []*mail.Thread
+		err := a.withAccountClient(a.accountContext(accountId), accountId, func(c *mail.Conn) error {
+			if !mail.SupportsThread(c.Client, mail.ThreadReferences) {
+				return client.ErrExtensionUnsupported
+			}
+			if _, err := c.Select(mailboxName, true); err != nil {
+				return fmt.Errorf("failed to select mailbox: %v", err)
+			}
+
+			criteria := imap.NewSearchCriteria()
+			criteria.WithoutFlags = []string{imap.DeletedFlag}
+			var err error
+			threads, err = mail.UidThread(c.Client, mail.ThreadReferences, criteria)
+			return err
+		})
+		if errors.Is(err, client.ErrExtensionUnsupported) {
+			log.Println("Server doesn't support THREAD, using one thread per message for mailbox:", mailboxName)
+			uids, err := a.getCachedOrder(accountId, mailboxName)
+			if err != nil {
+				log.Println("Error querying cached order:", err)
+				return nil, internalError(err)
+			}
+			threads = nil
+			for _, uid := range uids {
+				threads = append(threads, &mail.Thread{UID: uid})
+			}
+		} else if err != nil {
+			log.Println("Error threading mailbox on server:", err)
+			return nil, err
+		}
+
+		order = mailboxOrder{threads: threads}
+		a.setMailboxOrder(key, order)
+	}
+
+	page := pageOf(order.threads, start, limit)
+
+	var uids []uint32
+	for _, thread := range page {
+		uids = append(uids, mail.ThreadUIDs(thread)...)
+	}
+	messages, err := a.getMessagesInOrder(accountId, mailboxName, uids)
+	if err != nil {
+		return nil, err
+	}
+	messagesByUID := make(map[uint32]mail.SerializableMessage, len(messages))
+	for _, msg := range messages {
+		messagesByUID[msg.UID] = msg
+	}
+
+	result := make([]MessageThread, 0, len(page))
+	for _, thread := range page {
+		entry := MessageThread{Thread: thread}
+		for _, uid := range mail.ThreadUIDs(thread) {
+			if msg, ok := messagesByUID[uid]; ok {
+				entry.Messages = append(entry.Messages, msg)
+			}
+		}
+		result = append(result, entry)
+	}
+
+	return result, nil
+}
+
+// getCachedOrder returns the UIDs of the cached messages in a mailbox, newest first
+func (a *App) getCachedOrder(accountId int64, mailboxName string) ([]uint32, error) {
+	rows, err := a.db.Query(`
+        SELECT uid FROM messages
+        WHERE account_id = ? AND mailbox_name = ?
+        ORDER BY COALESCE(date, 0) DESC, uid DESC`, accountId, mailboxName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, err
+		}
+		uids = append(uids, uid)
+	}
+
+	return uids, rows.Err()
+}
+
+func (a *App) getMailboxOrder(key mailboxOrderKey) (mailboxOrder, bool) {
+	a.mailboxOrderMutex.Lock()
+	defer a.mailboxOrderMutex.Unlock()
+
+	order, ok := a.mailboxOrders[key]
+	return order, ok
+}
+
+func (a *App) setMailboxOrder(key mailboxOrderKey, order mailboxOrder) {
+	a.mailboxOrderMutex.Lock()
+	defer a.mailboxOrderMutex.Unlock()
+
+	if a.mailboxOrders == nil {
+		a.mailboxOrders = make(map[mailboxOrderKey]mailboxOrder)
+	}
+	a.mailboxOrders[key] = order
+}
+
+// forgetMailboxOrders drops the cached orderings of an account's mailboxes
+func (a *App) forgetMailboxOrders(accountId int64) {
+	a.mailboxOrderMutex.Lock()
+	defer a.mailboxOrderMutex.Unlock()
+
+	for key := range a.mailboxOrders {
+		if key.accountId == accountId {
+			delete(a.mailboxOrders, key)
+		}
+	}
+}
+
+// getMessagesInOrder loads the given UIDs from the cache in the order given,
+// fetching any envelopes the cache doesn't have yet from the server. Messages
+// the server can't be reached for are left out.
+func (a *App) getMessagesInOrder(accountId int64, mailboxName string, uids []uint32) ([]mail.SerializableMessage, error) {
+	if len(uids) == 0 {
+		return nil, nil
+	}
+
+	cached, err := a.getCachedMessages(accountId, mailboxName, uids)
+	if err != nil {
+		log.Println("Error querying messages from database:", err)
+		return nil, internalError(err)
+	}
+
+	var missing []uint32
+	for _, uid := range uids {
+		if _, ok := cached[uid]; !ok {
+			missing = append(missing, uid)
+		}
+	}
+
+	if len(missing) > 0 {
+		var fetched []mail.SerializableMessage
+		err := a.withAccountClient(a.accountContext(accountId), accountId, func(c *mail.Conn) error {
+			_, err := c.Select(mailboxName, true)
+			if err != nil {
+				return fmt.Errorf("failed to select mailbox: %v", err)
+			}
+			fetched, err = mail.FetchEnvelopes(c.Client, mailboxName, missing)
+			return err
+		})
+		if err != nil {
+			log.Println("Error fetching missing envelopes from server:", err)
+		}
+
+		if len(fetched) > 0 {
+			if err := a.storeMessages(accountId, mailboxName, fetched); err != nil {
+				log.Println("Error storing messages:", err)
+			}
+			for _, msg := range fetched {
+				msg.AccountId = accountId
+				cached[msg.UID] = msg
+			}
+		}
+	}
+
+	messages := make([]mail.SerializableMessage, 0, len(uids))
+	for _, uid := range uids {
+		if msg, ok := cached[uid]; ok {
+			messages = append(messages, msg)
+		}
+	}
+
+	return messages, nil
+}
+
+func (a *App) getCachedMessages(accountId int64, mailboxName string, uids []uint32) (map[uint32]mail.SerializableMessage, error) {
+	args := []interface{}{mailboxName, accountId}
+	for _, uid := range uids {
+		args = append(args, uid)
+	}
+
+	rows, err := a.db.Query(`
+        SELECT `+messageColumns+` FROM messages
+        WHERE mailbox_name = ? AND account_id = ? AND uid IN (?`+strings.Repeat(", ?", len(uids)-1)+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make(map[uint32]mail.SerializableMessage, len(uids))
+	for rows.Next() {
+		msg, _, err := scanMessage(rows)
+		if err != nil {
+			log.Println("Error scanning message row:", err)
+			continue
+		}
+
+		messages[msg.UID] = msg
+	}
+
+	return messages, rows.Err()
+}
+
+// pageOf returns up to limit items from start on
+func pageOf[T any](items []T, start, limit uint32) []T {
+	total := uint64(len(items))
+	if uint64(start) >= total {
+		return nil
+	}
+	// in 64 bits, so start+limit can't wrap around
+	end := min(uint64(start)+uint64(limit), total)
+	return items[start:end]
+}
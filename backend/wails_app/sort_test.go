@@ -0,0 +1,30 @@
+package wails_app
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestPageOf(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4}
+
+	tests := []struct {
+		start, limit uint32
+		want         []int
+	}{
+		{0, 2, []int{0, 1}},
+		{3, 2, []int{3, 4}},
+		{3, 10, []int{3, 4}},
+		{5, 1, nil},
+		{1, 0, []int{}},
+		// start+limit wraps around in 32 bits
+		{1, math.MaxUint32, []int{1, 2, 3, 4}},
+		{math.MaxUint32, math.MaxUint32, nil},
+	}
+	for _, test := range tests {
+		if got := pageOf(items, test.start, test.limit); !slices.Equal(got, test.want) {
+			t.Errorf("pageOf(%d, %d) = %v, want %v", test.start, test.limit, got, test.want)
+		}
+	}
+}
@@ -2,7 +2,10 @@ package wails_app
 
 import (
 	"context"
+	"email_test_app/backend/auth"
 	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"email_test_app/backend/secrets"
 	"fmt"
 	"log"
 	"os"
@@ -11,14 +14,15 @@ import (
 	"time"
 )
 
+// MAILBOX_UPDATE_TIME and EMAIL_UPDATE_TIME are how often the mailbox list
+// and each mailbox are synced unless the account sets its own interval
 const MAILBOX_UPDATE_TIME = 5 * time.Minute
 const EMAIL_UPDATE_TIME = 5 * time.Minute
 
 // startup is called at application startup
 func (a *App) Startup(ctx context.Context) {
 	a.ctx = ctx
-	a.oauthState = "state-token"
-	a.oauthCodeChannel = make(chan string)
+	a.opsCtx, a.cancelOps = context.WithCancel(ctx)
 
 	appDataDir, err := getAppDataDir()
 	if err != nil {
@@ -26,25 +30,22 @@ func (a *App) Startup(ctx context.Context) {
 		return
 	}
 
-	// create a ticker to update mailboxes every 5 minutes
-	a.mailboxUpdateTicker = time.NewTicker(MAILBOX_UPDATE_TIME)
-	a.emailUpdateTicker = time.NewTicker(EMAIL_UPDATE_TIME)
-
 	a.db, err = db.InitDB(appDataDir + "/email_test_app.db")
 	if err != nil {
 		log.Println("Error initializing database:", err)
 		return
 	}
 
-	// pull the accounts from the database
-	a.accounts, err = db.GetAccounts(a.db)
-	if err != nil {
-		log.Println("Error getting accounts from database:", err)
-	}
+	a.accounts = make(map[int64]auth.Account)
+	a.pool = mail.NewPool()
+	a.vault = &secrets.Vault{}
+	a.keystore = secrets.SystemKeystore()
 
-	log.Println("Pulled accounts from database:", a.accounts)
+	a.startCacheMaintenance()
 
-	go a.startHTTPServer()
+	// unlock the credentials with the system keystore if possible and pull
+	// the accounts from the database; otherwise wait for the passphrase
+	a.openVault()
 }
 
 // domReady is called after front-end resources have been loaded
@@ -59,16 +60,18 @@ func (a *App) BeforeClose(ctx context.Context) (prevent bool) {
 
 // shutdown is called at application termination
 func (a *App) Shutdown(ctx context.Context) {
-	// Perform your teardown here
-	for _, account := range a.accounts {
-		a.endUpdateLoops(account.Id)
-		a.LogoutUser(account.Id)
+	// Stop syncing but keep everyone signed in for the next launch
+	a.cancelOps()
+	a.stopScheduler()
+	a.stopCacheMaintenance()
+	for _, accountId := range a.GetAccountIds() {
+		a.endUpdateLoops(accountId)
 	}
 
-	// Shutdown the HTTP server
-	if a.httpServer != nil {
-		a.httpServer.Shutdown(ctx)
-	}
+	// Stop waiting for any sign-in still open in the browser
+	a.CancelOAuth()
+
+	a.pool.Close()
 }
 
 func getAppDataDir() (string, error) {
@@ -0,0 +1,171 @@
+package wails_app
+
+import (
+	"email_test_app/backend/db"
+	"log"
+	"sort"
+	"time"
+)
+
+// SYNC_PROGRESS_INTERVAL limits how often progress within a phase is sent to
+// the frontend; phase changes are always sent
+const SYNC_PROGRESS_INTERVAL = 250 * time.Millisecond
+
+// SyncPhase is the step a sync is at
+type SyncPhase string
+
+const (
+	// SyncPhaseMailboxes lists the account's mailboxes
+	SyncPhaseMailboxes SyncPhase = "mailboxes"
+	// SyncPhaseListing looks for messages that aren't cached yet
+	SyncPhaseListing SyncPhase = "listing"
+	// SyncPhaseHeaders fetches the envelopes of new messages
+	SyncPhaseHeaders SyncPhase = "headers"
+	// SyncPhasePreviews fetches the beginnings of new messages' bodies
+	SyncPhasePreviews SyncPhase = "previews"
+	SyncPhaseDone     SyncPhase = "done"
+	SyncPhaseFailed   SyncPhase = "failed"
+)
+
+// SyncProgress is sent with the SyncProgress event while a mailbox, or with
+// an empty name an account's mailbox list, is synced. Bytes is the total size
+// of the messages fetched so far.
+type SyncProgress struct {
+	AccountId   int64     `json:"account_id"`
+	MailboxName string    `json:"mailbox_name"`
+	Phase       SyncPhase `json:"phase"`
+	Fetched     int       `json:"fetched"`
+	Total       int       `json:"total"`
+	Bytes       int64     `json:"bytes"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// SyncStatus is the state of a mailbox's syncing returned by GetSyncStatus.
+// Times are unix seconds, or zero if it hasn't happened yet.
+type SyncStatus struct {
+	AccountId   int64         `json:"account_id"`
+	MailboxName string        `json:"mailbox_name"`
+	LastSuccess int64         `json:"last_success"`
+	LastError   string        `json:"last_error"`
+	LastErrorAt int64         `json:"last_error_at"`
+	InProgress  *SyncProgress `json:"in_progress,omitempty"`
+}
+
+type syncProgressKey struct {
+	accountId   int64
+	mailboxName string
+}
+
+type trackedProgress struct {
+	progress SyncProgress
+	emitted  time.Time
+}
+
+// reportProgress records how far a sync has got and tells the frontend
+func (a *App) reportProgress(progress SyncProgress) {
+	key := syncProgressKey{progress.AccountId, progress.MailboxName}
+
+	a.syncProgressMutex.Lock()
+	if a.syncProgress == nil {
+		a.syncProgress = make(map[syncProgressKey]*trackedProgress)
+	}
+	tracked, ok := a.syncProgress[key]
+	if !ok {
+		tracked = &trackedProgress{}
+		a.syncProgress[key] = tracked
+	}
+	emit := !ok || tracked.progress.Phase != progress.Phase ||
+		progress.Fetched >= progress.Total || time.Since(tracked.emitted) >= SYNC_PROGRESS_INTERVAL
+	tracked.progress = progress
+	if emit {
+		tracked.emitted = time.Now()
+	}
+	a.syncProgressMutex.Unlock()
+
+	if emit {
+		emitEvent(a.ctx, "SyncProgress", progress)
+	}
+}
+
+// recordSyncResult stores the outcome of a sync job and sends its final
+// progress event
+func (a *App) recordSyncResult(accountId int64, job syncJob, err error) {
+	mailboxName := job.mailbox
+	if job.kind != syncMessagesJob && job.kind != syncBackfillJob {
+		mailboxName = ""
+	}
+
+	a.syncProgressMutex.Lock()
+	progress := SyncProgress{AccountId: accountId, MailboxName: mailboxName}
+	if tracked, ok := a.syncProgress[syncProgressKey{accountId, mailboxName}]; ok {
+		progress = tracked.progress
+		delete(a.syncProgress, syncProgressKey{accountId, mailboxName})
+	}
+	a.syncProgressMutex.Unlock()
+
+	// fetching older messages doesn't bring the mailbox up to date
+	if job.kind != syncBackfillJob {
+		if dbErr := db.RecordSyncResult(a.db, accountId, mailboxName, err); dbErr != nil {
+			log.Println(dbErr)
+		}
+	}
+
+	progress.Phase = SyncPhaseDone
+	if err != nil {
+		progress.Phase = SyncPhaseFailed
+		progress.Error = err.Error()
+	}
+	emitEvent(a.ctx, "SyncProgress", progress)
+}
+
+// GetSyncStatus returns when each mailbox of every account, and each
+// account's mailbox list, last synced successfully, the last error if the
+// sync has failed since, and how far the syncs in progress have got
+func (a *App) GetSyncStatus() ([]SyncStatus, error) {
+	results, err := db.GetSyncResults(a.db)
+	if err != nil {
+		log.Println(err)
+		return nil, internalError(err)
+	}
+
+	statuses := make(map[syncProgressKey]*SyncStatus)
+	for _, result := range results {
+		status := &SyncStatus{
+			AccountId:   result.AccountId,
+			MailboxName: result.MailboxName,
+			LastError:   result.LastError,
+		}
+		if !result.LastSuccess.IsZero() {
+			status.LastSuccess = result.LastSuccess.Unix()
+		}
+		if !result.LastErrorAt.IsZero() {
+			status.LastErrorAt = result.LastErrorAt.Unix()
+		}
+		statuses[syncProgressKey{result.AccountId, result.MailboxName}] = status
+	}
+
+	a.syncProgressMutex.Lock()
+	for key, tracked := range a.syncProgress {
+		status, ok := statuses[key]
+		if !ok {
+			status = &SyncStatus{AccountId: key.accountId, MailboxName: key.mailboxName}
+			statuses[key] = status
+		}
+		progress := tracked.progress
+		status.InProgress = &progress
+	}
+	a.syncProgressMutex.Unlock()
+
+	result := make([]SyncStatus, 0, len(statuses))
+	for _, status := range statuses {
+		result = append(result, *status)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].AccountId != result[j].AccountId {
+			return result[i].AccountId < result[j].AccountId
+		}
+		return result[i].MailboxName < result[j].MailboxName
+	})
+
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package wails_app
+
+import (
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"errors"
+	"testing"
+)
+
+func TestGetSyncStatus(t *testing.T) {
+	a := newTestApp(t)
+
+	if err := db.RecordSyncResult(a.db, 1, "INBOX", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordSyncResult(a.db, 1, "", errors.New("connection refused")); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := a.GetSyncStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 2 || statuses[0].MailboxName != "" || statuses[1].MailboxName != "INBOX" {
+		t.Fatalf("got %+v, want the mailbox list's status and INBOX's", statuses)
+	}
+	if statuses[0].LastError != "connection refused" || statuses[0].LastErrorAt == 0 {
+		t.Errorf("mailbox list status is %+v, want the failure", statuses[0])
+	}
+	if statuses[1].LastSuccess == 0 || statuses[1].LastError != "" {
+		t.Errorf("INBOX status is %+v, want a success", statuses[1])
+	}
+
+	// a database error isn't passed off as nothing having synced
+	a.db.Close()
+	_, err = a.GetSyncStatus()
+	assertErrorCode(t, err, mail.ErrorInternal)
+}
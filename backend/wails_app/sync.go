@@ -0,0 +1,198 @@
+package wails_app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+type syncJobKind int
+
+const (
+	// syncAccountJob refreshes the mailbox list, then queues every mailbox
+	syncAccountJob syncJobKind = iota
+	syncMailboxesJob
+	syncMessagesJob
+	// syncBackfillJob fetches a batch of messages older than the mailbox's
+	// sync window reached
+	syncBackfillJob
+)
+
+// syncPriority orders queued jobs; higher runs first
+type syncPriority int
+
+const (
+	syncPriorityBackground syncPriority = iota
+	// syncPriorityUser is for something the user asked for or is looking at
+	syncPriorityUser
+)
+
+type syncJob struct {
+	kind    syncJobKind
+	mailbox string
+}
+
+type queuedSyncJob struct {
+	syncJob
+	priority syncPriority
+}
+
+// syncWorker runs the sync jobs of one account, one at a time, so accounts
+// sync independently of each other. Queuing a job that is already waiting
+// only raises its priority; a job queued while the same job is running runs
+// again afterwards, since it may have been asked for because of newer mail.
+type syncWorker struct {
+	accountId int64
+	// ctx is cancelled together with the worker
+	ctx context.Context
+
+	mu    sync.Mutex
+	queue []queuedSyncJob
+
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newSyncWorker(ctx context.Context, accountId int64) *syncWorker {
+	return &syncWorker{
+		accountId: accountId,
+		ctx:       ctx,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+func (w *syncWorker) enqueue(job syncJob, priority syncPriority) {
+	w.mu.Lock()
+	queued := false
+	for i := range w.queue {
+		if w.queue[i].syncJob == job {
+			w.queue[i].priority = max(w.queue[i].priority, priority)
+			queued = true
+			break
+		}
+	}
+	if !queued {
+		w.queue = append(w.queue, queuedSyncJob{job, priority})
+	}
+	w.mu.Unlock()
+
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// next removes the highest priority job from the queue; jobs of the same
+// priority run in the order they were queued
+func (w *syncWorker) next() (syncJob, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.queue) == 0 {
+		return syncJob{}, false
+	}
+
+	best := 0
+	for i, job := range w.queue {
+		if job.priority > w.queue[best].priority {
+			best = i
+		}
+	}
+	job := w.queue[best].syncJob
+	w.queue = append(w.queue[:best], w.queue[best+1:]...)
+	return job, true
+}
+
+func (w *syncWorker) run(a *App) {
+	defer close(w.done)
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		default:
+		}
+
+		job, ok := w.next()
+		if !ok {
+			select {
+			case <-w.wake:
+				continue
+			case <-w.stop:
+				return
+			}
+		}
+
+		err := a.runSyncJob(w, job)
+		if err != nil {
+			log.Println("Error syncing account", w.accountId, ":", err)
+		}
+		a.recordSyncResult(w.accountId, job, err)
+		a.syncFinished(w.accountId, job, err)
+	}
+}
+
+func (a *App) runSyncJob(w *syncWorker, job syncJob) error {
+	switch job.kind {
+	case syncAccountJob:
+		err := a.syncMailboxes(w.ctx, w.accountId)
+		mailboxes, listErr := a.getMailboxes(w.accountId)
+		if listErr != nil {
+			log.Println(listErr)
+		}
+		for _, mailbox := range mailboxes {
+			w.enqueue(syncJob{kind: syncMessagesJob, mailbox: mailbox}, syncPriorityBackground)
+		}
+		return err
+	case syncMailboxesJob:
+		return a.syncMailboxes(w.ctx, w.accountId)
+	case syncMessagesJob:
+		return a.syncMessages(w.ctx, w.accountId, job.mailbox)
+	case syncBackfillJob:
+		err := a.backfillMessages(w.ctx, w.accountId, job.mailbox)
+		a.backfillFinished(w.accountId, job.mailbox, err)
+		return err
+	default:
+		return fmt.Errorf("unknown sync job %d", job.kind)
+	}
+}
+
+// syncWorker returns the account's worker, starting it if needed
+func (a *App) syncWorker(accountId int64) *syncWorker {
+	a.syncWorkersMutex.Lock()
+	defer a.syncWorkersMutex.Unlock()
+
+	if a.syncWorkers == nil {
+		a.syncWorkers = make(map[int64]*syncWorker)
+	}
+
+	w, ok := a.syncWorkers[accountId]
+	if !ok {
+		w = newSyncWorker(a.accountContext(accountId), accountId)
+		a.syncWorkers[accountId] = w
+		go w.run(a)
+	}
+	return w
+}
+
+// stopSyncWorker drops the account's queued jobs. The returned channel is
+// closed once the job in progress, if any, has finished.
+func (a *App) stopSyncWorker(accountId int64) <-chan struct{} {
+	a.syncWorkersMutex.Lock()
+	defer a.syncWorkersMutex.Unlock()
+
+	w, ok := a.syncWorkers[accountId]
+	if !ok {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+
+	delete(a.syncWorkers, accountId)
+	close(w.stop)
+	return w.done
+}
@@ -0,0 +1,65 @@
+package wails_app
+
+import (
+	"email_test_app/backend/mail"
+	"log"
+	"strings"
+)
+
+// GetUnifiedEmails returns a page of messages from the mailbox with the given
+// special-use role in every signed in account, newest first. Accounts that
+// need to sign in again are left out until they do. Pass an empty cursor for
+// the first page and the returned NextCursor for the following ones.
+func (a *App) GetUnifiedEmails(role string, cursor string, limit uint32) (MessagePage, error) {
+	mailboxRole, err := mail.ParseMailboxRole(role)
+	if err != nil {
+		return MessagePage{}, errInvalidArgument("%v", err)
+	}
+
+	after, err := decodeCursor(cursor)
+	if err != nil {
+		log.Println("GetUnifiedEmails:", err)
+		return MessagePage{}, errInvalidArgument("invalid cursor")
+	}
+
+	var accountIds []int64
+	for _, id := range a.GetAccountIds() {
+		if a.IsLoggedIn(id) {
+			accountIds = append(accountIds, id)
+		}
+	}
+	if len(accountIds) == 0 {
+		return MessagePage{}, nil
+	}
+
+	// syncMailboxes gives each role to one mailbox of an account at most, so
+	// no message comes up twice
+	query := `
+        SELECT ` + messageColumns + `
+        FROM messages
+        JOIN mailboxes ON mailboxes.account_id = messages.account_id AND mailboxes.name = messages.mailbox_name
+        WHERE mailboxes.role = ? AND messages.account_id IN (?` + strings.Repeat(", ?", len(accountIds)-1) + `)`
+	args := []interface{}{mailboxRole}
+	for _, id := range accountIds {
+		args = append(args, id)
+	}
+
+	if after != nil {
+		query += ` AND (COALESCE(messages.date, 0), messages.account_id, messages.uid) < (?, ?, ?)`
+		args = append(args, after.Date, after.AccountId, after.UID)
+	}
+
+	query += `
+        ORDER BY COALESCE(messages.date, 0) DESC, messages.account_id DESC, messages.uid DESC
+        LIMIT ?`
+	args = append(args, limit)
+
+	rows, err := a.db.Query(query, args...)
+	if err != nil {
+		log.Println("Error querying unified messages from database:", err)
+		return MessagePage{}, internalError(err)
+	}
+	defer rows.Close()
+
+	return scanMessagePage(rows, limit), nil
+}
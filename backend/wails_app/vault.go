@@ -0,0 +1,374 @@
+package wails_app
+
+import (
+	"email_test_app/backend/auth"
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"email_test_app/backend/secrets"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// VaultStatus says whether account credentials can be read
+type VaultStatus string
+
+const (
+	// VaultSetupRequired means no system keystore is available and the user
+	// hasn't chosen a passphrase yet
+	VaultSetupRequired VaultStatus = "setup_required"
+	VaultLocked        VaultStatus = "locked"
+	VaultUnlocked      VaultStatus = "unlocked"
+)
+
+// openVault unlocks the credentials at startup. If encryption hasn't been set
+// up and the system has a keystore, a data key is created there and existing
+// plaintext credentials are encrypted with it.
+func (a *App) openVault() {
+	a.vaultMutex.Lock()
+	defer a.vaultMutex.Unlock()
+
+	header, err := db.GetVaultHeader(a.db)
+	if err != nil {
+		log.Println("Error opening vault:", err)
+		return
+	}
+
+	switch {
+	case header == nil && a.keystore != nil:
+		key, err := secrets.NewKey()
+		if err != nil {
+			log.Println("Error creating data key:", err)
+			return
+		}
+		if err := a.keystore.Set(secrets.KeystoreKeyName(1), key); err != nil {
+			log.Println("Keystore unavailable, waiting for a passphrase:", err)
+			return
+		}
+		if err := a.encryptWithNewKey(key, secrets.NewKeystoreHeader(1)); err != nil {
+			log.Println("Error encrypting credentials:", err)
+			a.keystore.Delete(secrets.KeystoreKeyName(1))
+			return
+		}
+	case header != nil && header.Source == secrets.KeySourceKeystore:
+		if a.keystore == nil {
+			log.Println("Credentials are protected by the system keystore, but it is unavailable")
+			return
+		}
+		key, err := a.keystore.Get(secrets.KeystoreKeyName(header.KeyVersion))
+		if err != nil {
+			log.Println("Error reading data key:", err)
+			return
+		}
+		if err := a.unlockWithKey(key); err != nil {
+			log.Println("Error unlocking credentials:", err)
+			return
+		}
+	default:
+		// wait for SetupPassphrase or UnlockVault
+		return
+	}
+}
+
+// GetVaultStatus reports whether the credentials are unlocked
+func (a *App) GetVaultStatus() VaultStatus {
+	if a.vault.Unlocked() {
+		return VaultUnlocked
+	}
+
+	header, err := db.GetVaultHeader(a.db)
+	if err != nil {
+		log.Println("Error reading vault header:", err)
+		return VaultLocked
+	}
+	if header == nil {
+		return VaultSetupRequired
+	}
+	return VaultLocked
+}
+
+// SetupPassphrase protects the credentials with a passphrase. On first use it
+// creates the data key and encrypts any existing plaintext credentials. If
+// the credentials are currently in the system keystore they are moved to the
+// passphrase instead.
+func (a *App) SetupPassphrase(passphrase string) error {
+	a.vaultMutex.Lock()
+	defer a.vaultMutex.Unlock()
+
+	header, err := db.GetVaultHeader(a.db)
+	if err != nil {
+		log.Println("SetupPassphrase:", err)
+		return internalError(err)
+	}
+
+	if header == nil {
+		key, err := secrets.NewKey()
+		if err != nil {
+			log.Println("Error creating data key:", err)
+			return internalError(err)
+		}
+		newHeader, err := secrets.NewPassphraseHeader(passphrase, key, 1)
+		if err != nil {
+			log.Println("SetupPassphrase:", err)
+			return internalError(err)
+		}
+		if err := a.encryptWithNewKey(key, newHeader); err != nil {
+			log.Println("Error encrypting credentials:", err)
+			return internalError(err)
+		}
+		return nil
+	}
+
+	if header.Source != secrets.KeySourceKeystore || !a.vault.Unlocked() {
+		return errInvalidArgument("a passphrase is already set")
+	}
+
+	key, err := a.keystore.Get(secrets.KeystoreKeyName(header.KeyVersion))
+	if err != nil {
+		log.Println("Error reading data key:", err)
+		return internalError(err)
+	}
+	newHeader, err := secrets.NewPassphraseHeader(passphrase, key, header.KeyVersion)
+	if err != nil {
+		log.Println("SetupPassphrase:", err)
+		return internalError(err)
+	}
+	if err := db.SaveVaultHeader(a.db, newHeader); err != nil {
+		log.Println("SetupPassphrase:", err)
+		return internalError(err)
+	}
+	if err := a.keystore.Delete(secrets.KeystoreKeyName(header.KeyVersion)); err != nil {
+		log.Println("Error removing data key from keystore:", err)
+	}
+	return nil
+}
+
+// UnlockVault unlocks passphrase-protected credentials and loads the accounts
+func (a *App) UnlockVault(passphrase string) error {
+	a.vaultMutex.Lock()
+	defer a.vaultMutex.Unlock()
+
+	header, err := db.GetVaultHeader(a.db)
+	if err != nil {
+		log.Println("UnlockVault:", err)
+		return internalError(err)
+	}
+	if header == nil {
+		return errInvalidArgument("no vault to unlock")
+	}
+
+	key, err := header.UnwrapKey(passphrase)
+	if err != nil {
+		log.Println("UnlockVault:", err)
+		return vaultError(err)
+	}
+
+	if err := a.unlockWithKey(key); err != nil {
+		log.Println("UnlockVault:", err)
+		return internalError(err)
+	}
+	return nil
+}
+
+// LockVault forgets the data key and the decrypted accounts until the
+// passphrase is entered again
+func (a *App) LockVault() {
+	a.vaultMutex.Lock()
+	defer a.vaultMutex.Unlock()
+
+	for _, accountId := range a.GetAccountIds() {
+		a.endUpdateLoops(accountId)
+		a.pool.CloseAccount(accountId)
+	}
+
+	a.accountsMutex.Lock()
+	a.vault.Lock()
+	a.accounts = make(map[int64]auth.Account)
+	a.accountsMutex.Unlock()
+
+	emitEvent(a.ctx, "VaultLocked")
+}
+
+// ChangePassphrase wraps the data key with a new passphrase. The credentials
+// themselves don't need to be re-encrypted.
+func (a *App) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if newPassphrase == "" {
+		return errInvalidArgument("the new passphrase can't be empty")
+	}
+
+	a.vaultMutex.Lock()
+	defer a.vaultMutex.Unlock()
+
+	header, err := db.GetVaultHeader(a.db)
+	if err != nil {
+		log.Println("ChangePassphrase:", err)
+		return internalError(err)
+	}
+	if header == nil || header.Source != secrets.KeySourcePassphrase {
+		return errInvalidArgument("no passphrase is set")
+	}
+
+	key, err := header.UnwrapKey(oldPassphrase)
+	if err != nil {
+		log.Println("ChangePassphrase:", err)
+		return vaultError(err)
+	}
+
+	newHeader, err := secrets.NewPassphraseHeader(newPassphrase, key, header.KeyVersion)
+	if err == nil {
+		err = db.SaveVaultHeader(a.db, newHeader)
+	}
+	if err != nil {
+		log.Println("ChangePassphrase:", err)
+		return internalError(err)
+	}
+	return nil
+}
+
+// RotateEncryptionKey re-encrypts every account's credentials under a new
+// data key. The passphrase is required when the key is passphrase-protected
+// and ignored when it is kept in the system keystore.
+func (a *App) RotateEncryptionKey(passphrase string) error {
+	err := a.rotateEncryptionKey(passphrase)
+	if err != nil {
+		log.Println("Error rotating encryption key:", err)
+		return vaultError(err)
+	}
+	return nil
+}
+
+// vaultError classifies an error unlocking or changing the vault. A wrong
+// passphrase can be tried again; anything else is the app's own failure.
+func vaultError(err error) error {
+	if errors.Is(err, secrets.ErrWrongPassphrase) {
+		return mail.NewError(mail.ErrorAuthFailed, err)
+	}
+	return internalError(err)
+}
+
+func (a *App) rotateEncryptionKey(passphrase string) error {
+	a.vaultMutex.Lock()
+	defer a.vaultMutex.Unlock()
+
+	if !a.vault.Unlocked() {
+		return secrets.ErrLocked
+	}
+
+	header, err := db.GetVaultHeader(a.db)
+	if err != nil {
+		return err
+	}
+	if header == nil {
+		return errors.New("credential encryption has not been set up")
+	}
+
+	key, err := secrets.NewKey()
+	if err != nil {
+		return err
+	}
+	newVault, err := secrets.NewVault(key)
+	if err != nil {
+		return err
+	}
+
+	version := header.KeyVersion + 1
+	var newHeader *secrets.Header
+	switch header.Source {
+	case secrets.KeySourcePassphrase:
+		// check the passphrase before re-encrypting anything
+		if _, err := header.UnwrapKey(passphrase); err != nil {
+			return err
+		}
+		newHeader, err = secrets.NewPassphraseHeader(passphrase, key, version)
+		if err != nil {
+			return err
+		}
+	case secrets.KeySourceKeystore:
+		if a.keystore == nil {
+			return secrets.ErrNoKeystore
+		}
+		// the old key stays in the keystore until the new one is committed
+		if err := a.keystore.Set(secrets.KeystoreKeyName(version), key); err != nil {
+			return err
+		}
+		newHeader = secrets.NewKeystoreHeader(version)
+	default:
+		return fmt.Errorf("unknown key source %q", header.Source)
+	}
+
+	// hold the accounts lock so no refreshed token is written with the old
+	// key while the rows are being re-encrypted
+	a.accountsMutex.Lock()
+	err = db.ReencryptAccounts(a.db, a.vault, newVault, newHeader)
+	if err == nil {
+		err = a.vault.Unlock(key)
+	}
+	a.accountsMutex.Unlock()
+
+	if err != nil {
+		if header.Source == secrets.KeySourceKeystore {
+			a.keystore.Delete(secrets.KeystoreKeyName(version))
+		}
+		return err
+	}
+
+	if header.Source == secrets.KeySourceKeystore {
+		if err := a.keystore.Delete(secrets.KeystoreKeyName(header.KeyVersion)); err != nil {
+			log.Println("Error removing old data key from keystore:", err)
+		}
+	}
+
+	return nil
+}
+
+// encryptWithNewKey encrypts the existing credentials, which may still be
+// plaintext, with a newly created data key and unlocks with it
+func (a *App) encryptWithNewKey(key []byte, header *secrets.Header) error {
+	newVault, err := secrets.NewVault(key)
+	if err != nil {
+		return err
+	}
+
+	a.accountsMutex.Lock()
+	err = db.ReencryptAccounts(a.db, a.vault, newVault, header)
+	a.accountsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return a.unlockWithKey(key)
+}
+
+// unlockWithKey unlocks the vault, loads the accounts and resumes their sessions
+func (a *App) unlockWithKey(key []byte) error {
+	if err := a.vault.Unlock(key); err != nil {
+		return err
+	}
+
+	// credentials sealed by older versions can't be read until then
+	upgraded, err := db.UpgradeAccountEncryption(a.db, a.vault)
+	if err != nil {
+		a.vault.Lock()
+		return err
+	}
+	if upgraded > 0 {
+		log.Println("Upgraded the encryption of", upgraded, "accounts")
+	}
+
+	accounts, err := db.GetAccounts(a.db, a.vault)
+	if err != nil {
+		a.vault.Lock()
+		return err
+	}
+
+	a.accountsMutex.Lock()
+	a.accounts = accounts
+	a.accountsMutex.Unlock()
+
+	log.Println("Pulled", len(accounts), "accounts from database")
+	emitEvent(a.ctx, "VaultUnlocked")
+
+	go a.resumeSessions()
+
+	return nil
+}
@@ -0,0 +1,53 @@
+package wails_app
+
+import (
+	"bytes"
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"email_test_app/backend/secrets"
+	"testing"
+)
+
+func TestChangePassphrase(t *testing.T) {
+	defaults := secrets.DefaultKDFParams
+	secrets.DefaultKDFParams = secrets.KDFParams{Time: 1, Memory: 64, Threads: 1}
+	defer func() { secrets.DefaultKDFParams = defaults }()
+
+	a := newTestApp(t)
+
+	// the key is in the keystore until a passphrase is set
+	err := a.ChangePassphrase("old passphrase", "new passphrase")
+	assertErrorCode(t, err, mail.ErrorInvalidArgument)
+
+	key, err := secrets.NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, err := secrets.NewPassphraseHeader("old passphrase", key, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveVaultHeader(a.db, header); err != nil {
+		t.Fatal(err)
+	}
+
+	err = a.ChangePassphrase("wrong passphrase", "new passphrase")
+	assertErrorCode(t, err, mail.ErrorAuthFailed)
+
+	err = a.ChangePassphrase("old passphrase", "")
+	assertErrorCode(t, err, mail.ErrorInvalidArgument)
+
+	if err := a.ChangePassphrase("old passphrase", "new passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	header, err = db.GetVaultHeader(a.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := header.UnwrapKey("old passphrase"); err == nil {
+		t.Error("the old passphrase still unlocks the key")
+	}
+	if unwrapped, err := header.UnwrapKey("new passphrase"); err != nil || !bytes.Equal(unwrapped, key) {
+		t.Errorf("the new passphrase doesn't unlock the key: %v", err)
+	}
+}
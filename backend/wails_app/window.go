@@ -0,0 +1,160 @@
+package wails_app
+
+import (
+	"context"
+	"email_test_app/backend/db"
+	"email_test_app/backend/mail"
+	"fmt"
+	"log"
+)
+
+const (
+	// DEFAULT_SYNC_WINDOW_MESSAGES is how many of a mailbox's newest messages
+	// the first sync fetches unless the account or mailbox sets a window
+	DEFAULT_SYNC_WINDOW_MESSAGES = 1000
+	// BACKFILL_BATCH_SIZE is how many older messages are fetched each time
+	// the user scrolls past the ones synced so far
+	BACKFILL_BATCH_SIZE = 500
+)
+
+// syncWindow returns how far back the first sync of a mailbox reaches
+func (a *App) syncWindow(accountId int64, mailboxName string) (mail.SyncWindow, error) {
+	window, ok, err := db.GetSyncWindow(a.db, accountId, mailboxName)
+	if err != nil {
+		return mail.SyncWindow{}, err
+	}
+	if !ok {
+		return mail.SyncWindow{Messages: DEFAULT_SYNC_WINDOW_MESSAGES}, nil
+	}
+	return window, nil
+}
+
+// GetSyncWindow returns how far back the first sync of a mailbox, or with an
+// empty name of the account's mailboxes, reaches
+func (a *App) GetSyncWindow(accountId int64, mailboxName string) (mail.SyncWindow, error) {
+	window, err := a.syncWindow(accountId, mailboxName)
+	if err != nil {
+		log.Println(err)
+		return mail.SyncWindow{}, internalError(err)
+	}
+	return window, nil
+}
+
+// SetSyncWindow sets how far back the first sync of a mailbox, or with an
+// empty name of every mailbox of the account without its own window,
+// reaches. Mailboxes that have been synced already keep what they have and
+// fetch older messages as the user scrolls to them.
+func (a *App) SetSyncWindow(accountId int64, mailboxName string, window mail.SyncWindow) error {
+	if window.Days < 0 || window.Messages < 0 {
+		return errInvalidArgument("sync window limits can't be negative")
+	}
+
+	if err := db.SetSyncWindow(a.db, accountId, mailboxName, window); err != nil {
+		log.Println(err)
+		return internalError(err)
+	}
+	return nil
+}
+
+// BackfillFinished is sent with the BackfillFinished event once a batch of
+// older messages queued by queueBackfill has been fetched, or fetching it
+// failed
+type BackfillFinished struct {
+	AccountId   int64  `json:"account_id"`
+	MailboxName string `json:"mailbox_name"`
+	// Error is empty if the batch was fetched
+	Error string `json:"error,omitempty"`
+}
+
+// queueBackfill queues fetching the mailbox's next batch of older messages,
+// unless every message has been synced. It reports whether there are older
+// messages to come; if so, BackfillFinished is sent once they are in.
+func (a *App) queueBackfill(accountId int64, mailboxName string) bool {
+	oldestUID, complete, err := db.GetSyncedRange(a.db, accountId, mailboxName)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if oldestUID == 0 || complete {
+		return false
+	}
+
+	a.syncWorker(accountId).enqueue(syncJob{kind: syncBackfillJob, mailbox: mailboxName}, syncPriorityUser)
+	return true
+}
+
+// backfillMessages fetches up to BACKFILL_BATCH_SIZE of the newest messages
+// older than those the mailbox has synced so far
+func (a *App) backfillMessages(ctx context.Context, accountId int64, mailboxName string) error {
+	if !a.IsLoggedIn(accountId) {
+		return fmt.Errorf("account %d is not logged in", accountId)
+	}
+
+	oldestUID, complete, err := db.GetSyncedRange(a.db, accountId, mailboxName)
+	if err != nil {
+		return err
+	}
+	if oldestUID == 0 || complete {
+		return nil
+	}
+
+	log.Println("Fetching older messages for mailbox:", mailboxName)
+
+	var messages []mail.SerializableMessage
+	progress := SyncProgress{AccountId: accountId, MailboxName: mailboxName}
+
+	err = a.withAccountClient(ctx, accountId, func(c *mail.Conn) error {
+		if _, err := c.Select(mailboxName, false); err != nil {
+			return fmt.Errorf("failed to select mailbox: %v", err)
+		}
+
+		progress.Phase, progress.Fetched, progress.Total, progress.Bytes = SyncPhaseListing, 0, 0, 0
+		a.reportProgress(progress)
+
+		older, err := mail.UIDsBefore(c.Client, oldestUID)
+		if err != nil {
+			return err
+		}
+		if len(older) <= BACKFILL_BATCH_SIZE {
+			complete = true
+		} else {
+			older = older[len(older)-BACKFILL_BATCH_SIZE:]
+		}
+		if len(older) == 0 {
+			return nil
+		}
+
+		messages, err = a.fetchNewMessages(c, mailboxName, older, &progress)
+		if err != nil {
+			return err
+		}
+		oldestUID = older[0]
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error fetching older messages from server: %w", err)
+	}
+
+	if len(messages) > 0 {
+		if err := a.storeMessages(accountId, mailboxName, messages); err != nil {
+			return fmt.Errorf("error storing messages: %w", err)
+		}
+	}
+
+	if err := db.SetSyncedRange(a.db, accountId, mailboxName, oldestUID, complete); err != nil {
+		return err
+	}
+
+	a.messagesUpdated(accountId, mailboxName)
+	return nil
+}
+
+// backfillFinished tells the frontend that a backfill job is over, so it can
+// page on from what was fetched or stop waiting
+func (a *App) backfillFinished(accountId int64, mailboxName string, err error) {
+	finished := BackfillFinished{AccountId: accountId, MailboxName: mailboxName}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	emitEvent(a.ctx, "BackfillFinished", finished)
+}
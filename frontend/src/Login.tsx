@@ -1,10 +1,11 @@
-import { useEffect, useState } from "react";
-import { LoginUser, LoginUserWithOAuth } from "../wailsjs/go/wails_app/App";
+import { useEffect, useRef, useState } from "react";
+import { CancelOAuth, DiscoverServers, LoginUser, LoginUserWithOAuth, StartDeviceLogin, SupportsDeviceLogin } from "../wailsjs/go/wails_app/App";
 import { Pages } from "./main";
 import { emailProviders, EmailProvider } from "./utils/emailProviders"; // Update the path accordingly
 import { FontAwesomeIcon } from "@fortawesome/react-fontawesome";
 import { faChevronLeft } from "@fortawesome/free-solid-svg-icons";
 import { EventsOn } from "../wailsjs/runtime/runtime";
+import { errorMessage, isCancelled } from "./utils/errors";
 
 function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], setAccountIds: (accountIds: number[]) => void, setPage: (page: Pages) => void }) {
     const [step, setStep] = useState(1);
@@ -14,21 +15,40 @@ function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], s
     const [email, setEmail] = useState('');
     const [password, setPassword] = useState('');
     const [error, setError] = useState('');
+    const [waitingForOAuth, setWaitingForOAuth] = useState(false);
+    const [oauthProviderName, setOAuthProviderName] = useState('');
+    const [deviceLoginSupported, setDeviceLoginSupported] = useState(false);
+    const [deviceCode, setDeviceCode] = useState<{ user_code: string, verification_uri: string } | null>(null);
+    // Only the most recent sign-in attempt may update the UI
+    const oauthAttempt = useRef(0);
+
+    const runOAuth = (login: Promise<void>) => {
+        const attempt = ++oauthAttempt.current;
+        setError('');
+        setDeviceCode(null);
+        setWaitingForOAuth(true);
+        // No need to call setPage on success, OAuthSuccess does
+        login
+            .catch((err) => {
+                console.log('OAuth login failed:', err);
+                if (attempt === oauthAttempt.current) {
+                    setError(isCancelled(err) ? '' : errorMessage(err));
+                }
+            })
+            .finally(() => {
+                if (attempt === oauthAttempt.current) {
+                    setWaitingForOAuth(false);
+                    setDeviceCode(null);
+                }
+            });
+    };
 
     const clickProvider = (provider: EmailProvider) => {
         setError('');
         if (provider.requiresOAuth) {
-            LoginUserWithOAuth(provider.name)
-                .then((status) => {
-                    console.log('OAuth login status:', status);
-                    // No need to call setPage here
-                    if (!status) {
-                        setError('OAuth login failed.');
-                    }
-                })
-                .catch((err) => {
-                    setError('OAuth login failed.');
-                });
+            setOAuthProviderName(provider.name);
+            SupportsDeviceLogin(provider.name).then(setDeviceLoginSupported);
+            runOAuth(LoginUserWithOAuth(provider.name));
         } else {
             setSelectedProvider(provider);
             setShowCustomImap(provider.name === 'Custom');
@@ -39,6 +59,24 @@ function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], s
         }
     };
 
+    // Fill in the IMAP URL for custom providers from the email address
+    const discoverImapUrl = async () => {
+        if (!showCustomImap || imapUrl || !email.includes('@')) {
+            return;
+        }
+        try {
+            const result = await DiscoverServers(email);
+            // only implicit TLS is supported for IMAP
+            const server = result.imap.find((server) => server.security === 'tls');
+            if (server) {
+                setImapUrl(`${server.host}:${server.port}`);
+            }
+        } catch (err) {
+            // the URL can still be typed in
+            console.log(errorMessage(err));
+        }
+    };
+
     const handleSubmit = async (e: React.FormEvent) => {
         e.preventDefault();
 
@@ -53,12 +91,12 @@ function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], s
             return;
         }
 
-        const newAccountId = await LoginUser(imapUrlToUse, email, password);
-        if (newAccountId >= 0) {
+        try {
+            const newAccountId = await LoginUser(imapUrlToUse, email, password);
             setAccountIds([...accountIds, newAccountId]);
             setPage(Pages.MAIL);
-        } else {
-            setError('Invalid credentials');
+        } catch (err) {
+            setError(errorMessage(err));
         }
     };
 
@@ -75,6 +113,10 @@ function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], s
             setError("OAuth login failed.");
         }))
 
+        unsubscribeFunctions.push(EventsOn("DeviceLoginCode", (code) => {
+            setDeviceCode(code);
+        }))
+
         // Clean up the event listeners when the component unmounts
         return () => {
             for (const unsubscribe of unsubscribeFunctions) {
@@ -104,6 +146,32 @@ function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], s
                                 </button>
                             ))}
                         </div>
+                        {waitingForOAuth && (
+                            <div className="mt-4 flex flex-col gap-2">
+                                {deviceCode ? (
+                                    <span>
+                                        Go to <span className="font-bold select-text">{deviceCode.verification_uri}</span> on any device
+                                        and enter the code <span className="font-bold select-text">{deviceCode.user_code}</span>
+                                    </span>
+                                ) : (
+                                    <span>Waiting for you to sign in in your browser...</span>
+                                )}
+                                {deviceLoginSupported && !deviceCode && (
+                                    <button
+                                        className="transition ease-in-out duration-300 motion-reduce:transition-none hover:bg-blue-500 hover:border-blue-400 bg-white/20 text-white p-2 drop-shadow-lg rounded border-2 border-gray-400"
+                                        onClick={() => runOAuth(StartDeviceLogin(oauthProviderName))}
+                                    >
+                                        Sign in with a code instead
+                                    </button>
+                                )}
+                                <button
+                                    className="transition ease-in-out duration-300 motion-reduce:transition-none hover:bg-red-500 hover:border-red-400 bg-white/20 text-white p-2 drop-shadow-lg rounded border-2 border-gray-400"
+                                    onClick={() => CancelOAuth()}
+                                >
+                                    Cancel
+                                </button>
+                            </div>
+                        )}
                     </>
                 )}
                 {step === 2 && (
@@ -139,6 +207,7 @@ function Login({ accountIds, setAccountIds, setPage }: { accountIds: number[], s
                                     setError('');
                                     setEmail(e.target.value);
                                 }}
+                                onBlur={discoverImapUrl}
                                 required
                             />
                             <input 
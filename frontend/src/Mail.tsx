@@ -1,6 +1,6 @@
 import { useEffect, useRef, useState } from 'react'
-import { GetEmailsForMailbox, GetEmailBody, GetMailboxes, LogoutUser, UpdateMailboxes, UpdateMessages } from "../wailsjs/go/wails_app/App"
-import { mail } from '../wailsjs/go/models'
+import { CancelEmailBody, GetEmailsForMailbox, GetEmailBody, GetMailboxes, LogoutUser, PrefetchBodies, UpdateMailboxes, UpdateMessages } from "../wailsjs/go/wails_app/App"
+import { mail, wails_app } from '../wailsjs/go/models'
 import { EventsOn } from '../wailsjs/runtime/runtime'
 import { Pages } from './main'
 import { FontAwesomeIcon } from '@fortawesome/react-fontawesome'
@@ -8,6 +8,7 @@ import { faEnvelopeOpen, faFileContract, faFolderOpen, faRightFromBracket, faSyn
 import { faEnvelope, faFile, faFolder, faPaperPlane, faTrashCan } from '@fortawesome/free-regular-svg-icons'
 import { faPaperPlane as faPaperPlaneSolid } from '@fortawesome/free-solid-svg-icons'
 import { formatDate } from './utils/dateUtils'
+import { errorMessage, isAppError } from './utils/errors'
 
 const knownMailboxIcons: { [key: string]: [IconDefinition, IconDefinition] } = {
     "INBOX": [faEnvelope, faEnvelopeOpen],
@@ -18,6 +19,10 @@ const knownMailboxIcons: { [key: string]: [IconDefinition, IconDefinition] } = {
 
 type MailboxByAccount = [accountId: number, mailbox: string]
 
+// payloads of the MessagesUpdated and BackfillFinished events
+type MessagesUpdated = { account_id: number, mailbox_name: string }
+type BackfillFinished = MessagesUpdated & { error?: string }
+
 const NUM_EMAILS_TO_FETCH = 20
 
 function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) => void}) {
@@ -28,14 +33,26 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
     const [selectedEmail, setSelectedEmail] = useState<mail.SerializableMessage | null>(null)
     const [loading, setLoading] = useState<boolean>(false)
     const [mailLoading, setMailLoading] = useState<boolean>(false)
+    const [syncProgress, setSyncProgress] = useState<{ [key: string]: wails_app.SyncProgress }>({})
     const emailListRef = useRef<HTMLDivElement>(null)
 
     const emailsPerInbox = useRef<{ [key: string]: mail.SerializableMessage[] }>({})
+    const cursorPerInbox = useRef<{ [key: string]: string }>({})
+    const backfillingPerInbox = useRef<{ [key: string]: boolean }>({})
+    const bodyAttempt = useRef(0)
     
     const getMailboxes = async () => {
         setLoading(true)
         for (const accountId of accounts) {
-            const newMailboxes = await GetMailboxes(accountId)
+            let newMailboxes: string[]
+            try {
+                newMailboxes = await GetMailboxes(accountId)
+            } catch (err) {
+                // accounts that have to sign in again keep their credentials
+                // until they do; leave them out of the list meanwhile
+                console.log(errorMessage(err))
+                continue
+            }
             if (newMailboxes && newMailboxes.length > 0) {
                 
                 // Sort the mailboxes so that mailboxes in the knownMailboxIcons object are displayed first
@@ -69,17 +86,32 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
             return
         }
         if (mailLoading) {
-            return
+            await CancelEmailBody()
         }
+        const attempt = ++bodyAttempt.current
         setMailLoading(true)
         setEmailBody('')
         setSelectedEmail(email || null);
-        setEmailBody(await GetEmailBody(accountId, email.mailbox_name, email.uid))
+        let body: string
+        try {
+            body = await GetEmailBody(accountId, email.mailbox_name, email.uid)
+        } catch (err) {
+            body = errorMessage(err)
+        }
+        if (attempt !== bodyAttempt.current) {
+            return
+        }
+        setEmailBody(body)
         setMailLoading(false)
     }
 
     const logOut = async (accountId: number) => {
-        await LogoutUser(accountId)
+        try {
+            await LogoutUser(accountId)
+        } catch (err) {
+            console.log(errorMessage(err))
+            return
+        }
         console.log('Logged out')
         setPage(Pages.LOGIN)
     }
@@ -92,13 +124,56 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
         if (!emailsPerInbox.current[mailboxIndex]) {
             emailsPerInbox.current[mailboxIndex] = []
         }
-        const numEmails = emailsPerInbox.current[mailboxIndex].length || 0
+        await getNextEmails(mailboxIndex)
+    }
+
+    const getNextEmails = async (mailboxIndex: number) => {
+        const cursor = cursorPerInbox.current[mailboxIndex] || ''
+        if (backfillingPerInbox.current[mailboxIndex] || (cursor === '' && emailsPerInbox.current[mailboxIndex].length > 0)) {
+            // waiting for older messages, or every message has been loaded
+            return
+        }
         const mailbox = mailboxes[mailboxIndex]
-        const newEmails = await GetEmailsForMailbox(mailbox[0], mailbox[1], numEmails, numEmails + NUM_EMAILS_TO_FETCH)
-        if (newEmails) {
-            emailsPerInbox.current[mailboxIndex].push(...newEmails)
+        let page: wails_app.MessagePage
+        try {
+            page = await GetEmailsForMailbox(mailbox[0], mailbox[1], '', cursor, NUM_EMAILS_TO_FETCH)
+        } catch (err) {
+            console.log(errorMessage(err))
+            if (cursor !== '' && isAppError(err) && err.code === 'invalid_argument') {
+                // the cursor is no good; page again from the newest message
+                emailsPerInbox.current[mailboxIndex] = []
+                cursorPerInbox.current[mailboxIndex] = ''
+                await getNextEmails(mailboxIndex)
+            }
+            return
+        }
+        if (page.messages) {
+            emailsPerInbox.current[mailboxIndex].push(...page.messages)
+            // cache the bodies of the page so opening its messages is instant
+            PrefetchBodies(mailbox[0], mailbox[1], page.messages.map((email) => email.uid))
+                .catch((err) => console.log(errorMessage(err)))
+        }
+        cursorPerInbox.current[mailboxIndex] = page.next_cursor
+        setEmails([...emailsPerInbox.current[mailboxIndex]])
+
+        if (page.backfilling) {
+            // older messages are being fetched from the server; continue
+            // from the cursor once they are in, or let scrolling try again
+            // if fetching them failed
+            backfillingPerInbox.current[mailboxIndex] = true
+            const unsubscribe = EventsOn("BackfillFinished", (finished: BackfillFinished) => {
+                if (finished.account_id !== mailbox[0] || finished.mailbox_name !== mailbox[1]) {
+                    return
+                }
+                unsubscribe()
+                backfillingPerInbox.current[mailboxIndex] = false
+                if (finished.error) {
+                    console.log(finished.error)
+                    return
+                }
+                getNextEmails(mailboxIndex)
+            })
         }
-        setEmails(emailsPerInbox.current[mailboxIndex])
     }
 
     const formatMailboxName = (mailbox: MailboxByAccount) => {
@@ -122,17 +197,35 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
         getMailboxes()
 
         emailsPerInbox.current = {}
+        cursorPerInbox.current = {}
+        backfillingPerInbox.current = {}
 
         let unsubscribeFunctions = [] as (() => void)[]
 
         unsubscribeFunctions.push(EventsOn("UserLoggedOut", () => {
             setPage(Pages.LOGIN)
         }))
+        unsubscribeFunctions.push(EventsOn("AccountNeedsReauth", () => {
+            setPage(Pages.LOGIN)
+        }))
         unsubscribeFunctions.push(EventsOn("MailboxesUpdated", () => {
             getMailboxes()
         }))
-        unsubscribeFunctions.push(EventsOn("MessagesUpdated", (mailboxName: string) => {
-            if (mailboxes[selectedMailboxIndex][1] === mailboxName) {
+        unsubscribeFunctions.push(EventsOn("SyncProgress", (progress: wails_app.SyncProgress) => {
+            const key = `${progress.account_id}:${progress.mailbox_name}`
+            setSyncProgress((current) => {
+                const next = { ...current }
+                if (progress.phase === "done" || progress.phase === "failed") {
+                    delete next[key]
+                } else {
+                    next[key] = progress
+                }
+                return next
+            })
+        }))
+        unsubscribeFunctions.push(EventsOn("MessagesUpdated", (updated: MessagesUpdated) => {
+            const mailbox = mailboxes[selectedMailboxIndex]
+            if (mailbox[0] === updated.account_id && mailbox[1] === updated.mailbox_name) {
                 getEmails(selectedMailboxIndex)
             }
         }))
@@ -149,7 +242,7 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
             if (emailListRef.current) {
                 const { scrollTop, scrollHeight, clientHeight } = emailListRef.current
                 if (scrollTop + clientHeight >= scrollHeight) {
-                    getEmails(selectedMailboxIndex)
+                    getNextEmails(selectedMailboxIndex)
                 }
             }
             console.log('Scrolled')
@@ -182,7 +275,7 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
                             className="transition ease-in-out duration-300 motion-reduce:transition-none hover:text-blue-500 text-gray-300 text-xs"
                             onClick={() => {
                                 for (const accountId of accounts) {
-                                    UpdateMailboxes(accountId)
+                                    UpdateMailboxes(accountId).catch((err) => console.log(errorMessage(err)))
                                 }}}
                             title="Refresh Mailboxes"
                         >
@@ -223,12 +316,20 @@ function Mail({accounts, setPage}: {accounts: number[], setPage: (page: Pages) =
                     <h2 className="font-bold text-xs text-gray-100 ml-2 select-none">Messages</h2>
                     <button 
                         className="transition ease-in-out duration-300 motion-reduce:transition-none hover:text-blue-500 text-gray-300 text-xs"
-                        onClick={() => UpdateMessages(...mailboxes[selectedMailboxIndex])}
+                        onClick={() => UpdateMessages(...mailboxes[selectedMailboxIndex]).catch((err) => console.log(errorMessage(err)))}
                         title="Refresh Messages"
                     >
                         <FontAwesomeIcon icon={faSync} />
                     </button>
                     </div>
+                {selectedMailboxIndex >= 0 && mailboxes[selectedMailboxIndex] && syncProgress[`${mailboxes[selectedMailboxIndex][0]}:${mailboxes[selectedMailboxIndex][1]}`] && (() => {
+                    const progress = syncProgress[`${mailboxes[selectedMailboxIndex][0]}:${mailboxes[selectedMailboxIndex][1]}`]
+                    return (
+                        <p className="text-xs text-gray-400 px-4 select-none">
+                            Syncing {progress.phase}{progress.total > 0 ? ` ${progress.fetched}/${progress.total}` : ''}
+                        </p>
+                    )
+                })()}
                 <div className="flex flex-col px-1"
                     ref={emailListRef}
                 >
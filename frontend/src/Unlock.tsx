@@ -0,0 +1,101 @@
+import { useEffect, useState } from "react";
+import { GetAccountIds, GetVaultStatus, SetupPassphrase, UnlockVault } from "../wailsjs/go/wails_app/App";
+import { Pages } from "./main";
+import { errorMessage, isAppError } from "./utils/errors";
+
+function Unlock({ setAccountIds, setPage }: { setAccountIds: (accountIds: number[]) => void, setPage: (page: Pages) => void }) {
+    const [setupRequired, setSetupRequired] = useState(false);
+    const [passphrase, setPassphrase] = useState('');
+    const [confirmPassphrase, setConfirmPassphrase] = useState('');
+    const [error, setError] = useState('');
+
+    const proceed = async () => {
+        const accountIds = await GetAccountIds();
+        setAccountIds(accountIds);
+        setPage(accountIds.length > 0 ? Pages.MAIL : Pages.LOGIN);
+    };
+
+    useEffect(() => {
+        GetVaultStatus().then((status) => {
+            if (status === 'unlocked') {
+                proceed();
+                return;
+            }
+            setSetupRequired(status === 'setup_required');
+        });
+    }, []);
+
+    const handleSubmit = async (e: React.FormEvent) => {
+        e.preventDefault();
+
+        if (setupRequired && passphrase !== confirmPassphrase) {
+            setError('Passphrases do not match.');
+            return;
+        }
+
+        try {
+            if (setupRequired) {
+                await SetupPassphrase(passphrase);
+            } else {
+                await UnlockVault(passphrase);
+            }
+        } catch (err) {
+            if (isAppError(err) && err.code === 'auth_failed') {
+                setError('Wrong passphrase.');
+            } else {
+                setError(setupRequired ? 'Could not set the passphrase.' : errorMessage(err));
+            }
+            return;
+        }
+
+        proceed();
+    };
+
+    return (
+        <div className="grid w-full h-screen place-items-center">
+            <div className="p-8 bg-white/20 rounded-lg text-center text-gray-100 drop-shadow-lg border-2 border-gray-400">
+                <h2 className="text-xl mb-4">{setupRequired ? 'Choose a Passphrase' : 'Unlock Your Accounts'}</h2>
+                {setupRequired && <p className="mb-4 text-sm text-gray-300">Your account credentials will be encrypted with this passphrase.</p>}
+                {error && <span className="text-red-500">{error}</span>}
+                <form
+                    className="flex flex-col gap-4"
+                    onSubmit={handleSubmit}
+                >
+                    <input
+                        type="password"
+                        autoFocus
+                        className="px-2 bg-white/10 py-1 rounded focus:outline-none focus:border-blue-400 focus:drop-shadow-xxl border-2 border-gray-400"
+                        placeholder="Passphrase"
+                        value={passphrase}
+                        onChange={(e) => {
+                            setError('');
+                            setPassphrase(e.target.value);
+                        }}
+                        required
+                    />
+                    {setupRequired && (
+                        <input
+                            type="password"
+                            className="px-2 bg-white/10 py-1 rounded focus:outline-none focus:border-blue-400 focus:drop-shadow-xxl border-2 border-gray-400"
+                            placeholder="Confirm Passphrase"
+                            value={confirmPassphrase}
+                            onChange={(e) => {
+                                setError('');
+                                setConfirmPassphrase(e.target.value);
+                            }}
+                            required
+                        />
+                    )}
+                    <button
+                        type="submit"
+                        className="transition ease-in-out duration-300 motion-reduce:transition-none focus:outline-none focus:bg-blue-500 focus:border-blue-400 hover:bg-blue-500 hover:border-blue-400 bg-white/20 text-white p-2 drop-shadow-lg rounded border-2 border-gray-400"
+                    >
+                        {setupRequired ? 'Set Passphrase' : 'Unlock'}
+                    </button>
+                </form>
+            </div>
+        </div>
+    )
+}
+
+export default Unlock
@@ -4,11 +4,14 @@ import ReactDOM from 'react-dom/client'
 import Mail from './Mail'
 import './index.css'
 import Login from './Login'
-import { GetAccountIds, IsLoggedIn } from '../wailsjs/go/wails_app/App'
+import Unlock from './Unlock'
+import { GetAccountIds, GetVaultStatus, IsLoggedIn } from '../wailsjs/go/wails_app/App'
+import { EventsOn } from '../wailsjs/runtime/runtime'
 
 export enum Pages {
     LOGIN = 'login',
     MAIL = 'mail',
+    UNLOCK = 'unlock',
 }
 
 function Main() {
@@ -23,6 +26,11 @@ function Main() {
 
     useEffect(() => {
         const init = async () => {
+            if (await GetVaultStatus() !== 'unlocked') {
+                setPage(Pages.UNLOCK)
+                return
+            }
+
             setAccountIds(await GetAccountIds())
 
             for (const accountId of accountIds) {
@@ -36,11 +44,17 @@ function Main() {
             }
         }
         init()
+
+        return EventsOn("VaultLocked", () => {
+            setAccountIds([])
+            setPage(Pages.UNLOCK)
+        })
     }, [])
 
     return (
         <div className={`${navigator.userAgent.includes('Chrome') && "bg-black"}`}>
             {page === Pages.LOGIN && <Login accountIds={accountIds} setAccountIds={setAccountIds} setPage={setPageAndStorage} />}
+            {page === Pages.UNLOCK && <Unlock setAccountIds={setAccountIds} setPage={setPageAndStorage} />}
             {page === Pages.MAIL && <Mail accounts={accountIds} setPage={setPageAndStorage} />}
         </div>
     )
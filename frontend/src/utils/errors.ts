@@ -0,0 +1,49 @@
+// Backend methods that fail reject with a {code, message} object
+
+export type ErrorCode =
+    | 'auth_failed'
+    | 'auth_required'
+    | 'network'
+    | 'tls'
+    | 'server_refused'
+    | 'not_found'
+    | 'quota'
+    | 'rate_limited'
+    | 'cancelled'
+    | 'invalid_argument'
+    | 'internal'
+
+export interface AppError {
+    code: ErrorCode
+    message: string
+}
+
+export function isAppError(err: unknown): err is AppError {
+    return typeof err === 'object' && err !== null && 'code' in err && 'message' in err
+}
+
+export function isCancelled(err: unknown): boolean {
+    return isAppError(err) && err.code === 'cancelled'
+}
+
+const errorMessages: { [code in ErrorCode]: string } = {
+    auth_failed: 'Wrong email address or password.',
+    auth_required: 'Sign in to this account again to keep using it.',
+    network: 'Could not reach the mail server. Check your connection and the server address.',
+    tls: 'Could not establish a secure connection to the mail server.',
+    server_refused: 'The mail server refused the request.',
+    not_found: 'Not found.',
+    quota: 'The mailbox is over its storage quota.',
+    rate_limited: 'The mail server is limiting requests. Try again later.',
+    cancelled: 'Cancelled.',
+    invalid_argument: 'That value is not allowed.',
+    internal: 'Something went wrong.',
+}
+
+// errorMessage describes an error for the user
+export function errorMessage(err: unknown): string {
+    if (isAppError(err)) {
+        return errorMessages[err.code] ?? err.message
+    }
+    return String(err)
+}
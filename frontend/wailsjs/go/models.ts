@@ -1,3 +1,62 @@
+export namespace discovery {
+	
+	export class Server {
+	    protocol: string;
+	    host: string;
+	    port: number;
+	    security: string;
+	    username: string;
+	    source: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Server(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.protocol = source["protocol"];
+	        this.host = source["host"];
+	        this.port = source["port"];
+	        this.security = source["security"];
+	        this.username = source["username"];
+	        this.source = source["source"];
+	    }
+	}
+	export class Result {
+	    imap: Server[];
+	    smtp: Server[];
+	
+	    static createFrom(source: any = {}) {
+	        return new Result(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.imap = this.convertValues(source["imap"], Server);
+	        this.smtp = this.convertValues(source["smtp"], Server);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+
+}
+
 export namespace imap {
 	
 	export class Address {
@@ -72,6 +131,26 @@ export namespace imap {
 
 export namespace mail {
 	
+	export class ConnectionSettings {
+	    security: string;
+	    ca_cert_pem: string;
+	    min_tls_version: string;
+	    client_cert_pem: string;
+	    client_key_pem: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new ConnectionSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.security = source["security"];
+	        this.ca_cert_pem = source["ca_cert_pem"];
+	        this.min_tls_version = source["min_tls_version"];
+	        this.client_cert_pem = source["client_cert_pem"];
+	        this.client_key_pem = source["client_key_pem"];
+	    }
+	}
 	export class EmailBody {
 	    plain: string;
 	    html: string;
@@ -87,10 +166,15 @@ export namespace mail {
 	    }
 	}
 	export class SerializableMessage {
+	    account_id: number;
 	    uid: number;
 	    envelope?: imap.Envelope;
 	    body: EmailBody;
 	    mailbox_name: string;
+	    // Go type: time
+	    internal_date: any;
+	    size: number;
+	    preview: string;
 	
 	    static createFrom(source: any = {}) {
 	        return new SerializableMessage(source);
@@ -98,10 +182,338 @@ export namespace mail {
 	
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.account_id = source["account_id"];
 	        this.uid = source["uid"];
 	        this.envelope = this.convertValues(source["envelope"], imap.Envelope);
 	        this.body = this.convertValues(source["body"], EmailBody);
 	        this.mailbox_name = source["mailbox_name"];
+	        this.internal_date = this.convertValues(source["internal_date"], null);
+	        this.size = source["size"];
+	        this.preview = source["preview"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+
+	export class SyncWindow {
+	    days: number;
+	    messages: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new SyncWindow(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.days = source["days"];
+	        this.messages = source["messages"];
+	    }
+	}
+	export class Thread {
+	    uid: number;
+	    children: Thread[];
+	
+	    static createFrom(source: any = {}) {
+	        return new Thread(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.uid = source["uid"];
+	        this.children = this.convertValues(source["children"], Thread);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+
+}
+
+export namespace wails_app {
+	
+	export class MailboxStorage {
+	    mailbox_name: string;
+	    messages: number;
+	    cached_bodies: number;
+	    envelope_bytes: number;
+	    body_bytes: number;
+	    attachment_bytes: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new MailboxStorage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.mailbox_name = source["mailbox_name"];
+	        this.messages = source["messages"];
+	        this.cached_bodies = source["cached_bodies"];
+	        this.envelope_bytes = source["envelope_bytes"];
+	        this.body_bytes = source["body_bytes"];
+	        this.attachment_bytes = source["attachment_bytes"];
+	    }
+	}
+	export class AccountStorage {
+	    account_id: number;
+	    email: string;
+	    bytes: number;
+	    mailboxes: MailboxStorage[];
+	
+	    static createFrom(source: any = {}) {
+	        return new AccountStorage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.account_id = source["account_id"];
+	        this.email = source["email"];
+	        this.bytes = source["bytes"];
+	        this.mailboxes = this.convertValues(source["mailboxes"], MailboxStorage);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class CacheSettings {
+	    max_database_mb: number;
+	    keep_days: number;
+	    keep_starred: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new CacheSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.max_database_mb = source["max_database_mb"];
+	        this.keep_days = source["keep_days"];
+	        this.keep_starred = source["keep_starred"];
+	    }
+	}
+	export class MessagePage {
+	    messages: mail.SerializableMessage[];
+	    next_cursor: string;
+	    backfilling: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new MessagePage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.messages = this.convertValues(source["messages"], mail.SerializableMessage);
+	        this.next_cursor = source["next_cursor"];
+	        this.backfilling = source["backfilling"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class MessageThread {
+	    thread?: mail.Thread;
+	    messages: mail.SerializableMessage[];
+	
+	    static createFrom(source: any = {}) {
+	        return new MessageThread(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.thread = this.convertValues(source["thread"], mail.Thread);
+	        this.messages = this.convertValues(source["messages"], mail.SerializableMessage);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class StorageUsage {
+	    database_bytes: number;
+	    free_bytes: number;
+	    accounts: AccountStorage[];
+	
+	    static createFrom(source: any = {}) {
+	        return new StorageUsage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.database_bytes = source["database_bytes"];
+	        this.free_bytes = source["free_bytes"];
+	        this.accounts = this.convertValues(source["accounts"], AccountStorage);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class SyncProgress {
+	    account_id: number;
+	    mailbox_name: string;
+	    phase: string;
+	    fetched: number;
+	    total: number;
+	    bytes: number;
+	    error?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new SyncProgress(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.account_id = source["account_id"];
+	        this.mailbox_name = source["mailbox_name"];
+	        this.phase = source["phase"];
+	        this.fetched = source["fetched"];
+	        this.total = source["total"];
+	        this.bytes = source["bytes"];
+	        this.error = source["error"];
+	    }
+	}
+	export class SyncScheduleEntry {
+	    mailbox_name: string;
+	    interval_seconds: number;
+	    next_run: number;
+	    failures: number;
+	    queued: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new SyncScheduleEntry(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.mailbox_name = source["mailbox_name"];
+	        this.interval_seconds = source["interval_seconds"];
+	        this.next_run = source["next_run"];
+	        this.failures = source["failures"];
+	        this.queued = source["queued"];
+	    }
+	}
+	export class SyncSettings {
+	    pause_on_battery: boolean;
+	    pause_on_metered: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new SyncSettings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.pause_on_battery = source["pause_on_battery"];
+	        this.pause_on_metered = source["pause_on_metered"];
+	    }
+	}
+	export class SyncStatus {
+	    account_id: number;
+	    mailbox_name: string;
+	    last_success: number;
+	    last_error: string;
+	    last_error_at: number;
+	    in_progress?: SyncProgress;
+	
+	    static createFrom(source: any = {}) {
+	        return new SyncStatus(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.account_id = source["account_id"];
+	        this.mailbox_name = source["mailbox_name"];
+	        this.last_success = source["last_success"];
+	        this.last_error = source["last_error"];
+	        this.last_error_at = source["last_error_at"];
+	        this.in_progress = this.convertValues(source["in_progress"], SyncProgress);
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
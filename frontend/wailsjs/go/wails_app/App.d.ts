@@ -1,25 +1,93 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
+import {discovery} from '../models';
 import {mail} from '../models';
+import {wails_app} from '../models';
+
+export function CancelEmailBody():Promise<void>;
+
+export function CancelOAuth():Promise<void>;
+
+export function ChangePassphrase(arg1:string,arg2:string):Promise<void>;
+
+export function DiscoverServers(arg1:string):Promise<discovery.Result>;
+
+export function GetAccountAuthState(arg1:number):Promise<string>;
 
 export function GetAccountIds():Promise<Array<number>>;
 
+export function GetCacheSettings():Promise<wails_app.CacheSettings>;
+
+export function GetConnectionSettings(arg1:number):Promise<mail.ConnectionSettings>;
+
 export function GetEmailBody(arg1:number,arg2:string,arg3:number):Promise<string>;
 
-export function GetEmailsForMailbox(arg1:number,arg2:string,arg3:number,arg4:number):Promise<Array<mail.SerializableMessage>>;
+export function GetEmailsForMailbox(arg1:number,arg2:string,arg3:string,arg4:string,arg5:number):Promise<wails_app.MessagePage>;
 
 export function GetMailboxes(arg1:number):Promise<Array<string>>;
 
+export function GetMessagesByIds(arg1:number,arg2:string,arg3:Array<number>):Promise<Array<mail.SerializableMessage>>;
+
+export function GetSortedEmailsForMailbox(arg1:number,arg2:string,arg3:string,arg4:boolean,arg5:number,arg6:number):Promise<Array<mail.SerializableMessage>>;
+
+export function GetStorageUsage():Promise<wails_app.StorageUsage>;
+
+export function GetSyncSchedule(arg1:number):Promise<Array<wails_app.SyncScheduleEntry>>;
+
+export function GetSyncSettings():Promise<wails_app.SyncSettings>;
+
+export function GetSyncStatus():Promise<Array<wails_app.SyncStatus>>;
+
+export function GetSyncWindow(arg1:number,arg2:string):Promise<mail.SyncWindow>;
+
+export function GetThreadsForMailbox(arg1:number,arg2:string,arg3:number,arg4:number):Promise<Array<wails_app.MessageThread>>;
+
+export function GetUnifiedEmails(arg1:string,arg2:string,arg3:number):Promise<wails_app.MessagePage>;
+
+export function GetVaultStatus():Promise<string>;
+
 export function IsLoggedIn(arg1:number):Promise<boolean>;
 
+export function IsSyncPaused():Promise<boolean>;
+
+export function LockVault():Promise<void>;
+
 export function LoginUser(arg1:string,arg2:string,arg3:string):Promise<number>;
 
-export function LoginUserWithOAuth(arg1:string):Promise<boolean>;
+export function LoginUserWithOAuth(arg1:string):Promise<void>;
+
+export function LoginUserWithSettings(arg1:string,arg2:string,arg3:string,arg4:mail.ConnectionSettings):Promise<number>;
 
 export function LogoutUser(arg1:number):Promise<void>;
 
+export function PrefetchBodies(arg1:number,arg2:string,arg3:Array<number>):Promise<void>;
+
+export function RemoveAccount(arg1:number):Promise<void>;
+
+export function RotateEncryptionKey(arg1:string):Promise<void>;
+
+export function SetCacheSettings(arg1:wails_app.CacheSettings):Promise<void>;
+
+export function SetConnectionSettings(arg1:number,arg2:mail.ConnectionSettings):Promise<void>;
+
+export function SetSyncInterval(arg1:number,arg2:string,arg3:number):Promise<void>;
+
+export function SetSyncSettings(arg1:wails_app.SyncSettings):Promise<void>;
+
+export function SetSyncWindow(arg1:number,arg2:string,arg3:mail.SyncWindow):Promise<void>;
+
+export function SetupPassphrase(arg1:string):Promise<void>;
+
+export function StartDeviceLogin(arg1:string):Promise<void>;
+
 export function StartOAuth(arg1:string):Promise<void>;
 
+export function SupportsDeviceLogin(arg1:string):Promise<boolean>;
+
+export function SyncNow(arg1:number):Promise<void>;
+
+export function UnlockVault(arg1:string):Promise<void>;
+
 export function UpdateMailboxes(arg1:number):Promise<void>;
 
 export function UpdateMessages(arg1:number,arg2:string):Promise<void>;
@@ -2,26 +2,102 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function CancelEmailBody() {
+  return window['go']['wails_app']['App']['CancelEmailBody']();
+}
+
+export function CancelOAuth() {
+  return window['go']['wails_app']['App']['CancelOAuth']();
+}
+
+export function ChangePassphrase(arg1, arg2) {
+  return window['go']['wails_app']['App']['ChangePassphrase'](arg1, arg2);
+}
+
+export function DiscoverServers(arg1) {
+  return window['go']['wails_app']['App']['DiscoverServers'](arg1);
+}
+
+export function GetAccountAuthState(arg1) {
+  return window['go']['wails_app']['App']['GetAccountAuthState'](arg1);
+}
+
 export function GetAccountIds() {
   return window['go']['wails_app']['App']['GetAccountIds']();
 }
 
+export function GetCacheSettings() {
+  return window['go']['wails_app']['App']['GetCacheSettings']();
+}
+
+export function GetConnectionSettings(arg1) {
+  return window['go']['wails_app']['App']['GetConnectionSettings'](arg1);
+}
+
 export function GetEmailBody(arg1, arg2, arg3) {
   return window['go']['wails_app']['App']['GetEmailBody'](arg1, arg2, arg3);
 }
 
-export function GetEmailsForMailbox(arg1, arg2, arg3, arg4) {
-  return window['go']['wails_app']['App']['GetEmailsForMailbox'](arg1, arg2, arg3, arg4);
+export function GetEmailsForMailbox(arg1, arg2, arg3, arg4, arg5) {
+  return window['go']['wails_app']['App']['GetEmailsForMailbox'](arg1, arg2, arg3, arg4, arg5);
 }
 
 export function GetMailboxes(arg1) {
   return window['go']['wails_app']['App']['GetMailboxes'](arg1);
 }
 
+export function GetMessagesByIds(arg1, arg2, arg3) {
+  return window['go']['wails_app']['App']['GetMessagesByIds'](arg1, arg2, arg3);
+}
+
+export function GetSortedEmailsForMailbox(arg1, arg2, arg3, arg4, arg5, arg6) {
+  return window['go']['wails_app']['App']['GetSortedEmailsForMailbox'](arg1, arg2, arg3, arg4, arg5, arg6);
+}
+
+export function GetStorageUsage() {
+  return window['go']['wails_app']['App']['GetStorageUsage']();
+}
+
+export function GetSyncSchedule(arg1) {
+  return window['go']['wails_app']['App']['GetSyncSchedule'](arg1);
+}
+
+export function GetSyncSettings() {
+  return window['go']['wails_app']['App']['GetSyncSettings']();
+}
+
+export function GetSyncStatus() {
+  return window['go']['wails_app']['App']['GetSyncStatus']();
+}
+
+export function GetSyncWindow(arg1, arg2) {
+  return window['go']['wails_app']['App']['GetSyncWindow'](arg1, arg2);
+}
+
+export function GetThreadsForMailbox(arg1, arg2, arg3, arg4) {
+  return window['go']['wails_app']['App']['GetThreadsForMailbox'](arg1, arg2, arg3, arg4);
+}
+
+export function GetUnifiedEmails(arg1, arg2, arg3) {
+  return window['go']['wails_app']['App']['GetUnifiedEmails'](arg1, arg2, arg3);
+}
+
+export function GetVaultStatus() {
+  return window['go']['wails_app']['App']['GetVaultStatus']();
+}
+
 export function IsLoggedIn(arg1) {
   return window['go']['wails_app']['App']['IsLoggedIn'](arg1);
 }
 
+export function IsSyncPaused() {
+  return window['go']['wails_app']['App']['IsSyncPaused']();
+}
+
+export function LockVault() {
+  return window['go']['wails_app']['App']['LockVault']();
+}
+
 export function LoginUser(arg1, arg2, arg3) {
   return window['go']['wails_app']['App']['LoginUser'](arg1, arg2, arg3);
 }
@@ -30,14 +106,70 @@ export function LoginUserWithOAuth(arg1) {
   return window['go']['wails_app']['App']['LoginUserWithOAuth'](arg1);
 }
 
+export function LoginUserWithSettings(arg1, arg2, arg3, arg4) {
+  return window['go']['wails_app']['App']['LoginUserWithSettings'](arg1, arg2, arg3, arg4);
+}
+
 export function LogoutUser(arg1) {
   return window['go']['wails_app']['App']['LogoutUser'](arg1);
 }
 
+export function PrefetchBodies(arg1, arg2, arg3) {
+  return window['go']['wails_app']['App']['PrefetchBodies'](arg1, arg2, arg3);
+}
+
+export function RemoveAccount(arg1) {
+  return window['go']['wails_app']['App']['RemoveAccount'](arg1);
+}
+
+export function RotateEncryptionKey(arg1) {
+  return window['go']['wails_app']['App']['RotateEncryptionKey'](arg1);
+}
+
+export function SetCacheSettings(arg1) {
+  return window['go']['wails_app']['App']['SetCacheSettings'](arg1);
+}
+
+export function SetConnectionSettings(arg1, arg2) {
+  return window['go']['wails_app']['App']['SetConnectionSettings'](arg1, arg2);
+}
+
+export function SetSyncInterval(arg1, arg2, arg3) {
+  return window['go']['wails_app']['App']['SetSyncInterval'](arg1, arg2, arg3);
+}
+
+export function SetSyncSettings(arg1) {
+  return window['go']['wails_app']['App']['SetSyncSettings'](arg1);
+}
+
+export function SetSyncWindow(arg1, arg2, arg3) {
+  return window['go']['wails_app']['App']['SetSyncWindow'](arg1, arg2, arg3);
+}
+
+export function SetupPassphrase(arg1) {
+  return window['go']['wails_app']['App']['SetupPassphrase'](arg1);
+}
+
+export function StartDeviceLogin(arg1) {
+  return window['go']['wails_app']['App']['StartDeviceLogin'](arg1);
+}
+
 export function StartOAuth(arg1) {
   return window['go']['wails_app']['App']['StartOAuth'](arg1);
 }
 
+export function SupportsDeviceLogin(arg1) {
+  return window['go']['wails_app']['App']['SupportsDeviceLogin'](arg1);
+}
+
+export function SyncNow(arg1) {
+  return window['go']['wails_app']['App']['SyncNow'](arg1);
+}
+
+export function UnlockVault(arg1) {
+  return window['go']['wails_app']['App']['UnlockVault'](arg1);
+}
+
 export function UpdateMailboxes(arg1) {
   return window['go']['wails_app']['App']['UpdateMailboxes'](arg1);
 }
@@ -54,11 +54,12 @@ func main() {
 		Bind: []interface{}{
 			app,
 		},
-		Logger:        &logger.DefaultLogger{},
-		LogLevel:      logger.ERROR,
-		OnDomReady:    app.DomReady,
-		OnShutdown:    app.Shutdown,
-		OnBeforeClose: app.BeforeClose,
+		ErrorFormatter: wails_app.FormatError,
+		Logger:         &logger.DefaultLogger{},
+		LogLevel:       logger.ERROR,
+		OnDomReady:     app.DomReady,
+		OnShutdown:     app.Shutdown,
+		OnBeforeClose:  app.BeforeClose,
 	})
 
 	if err != nil {